@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Builtin describes a builtin command for the help builtin.
+type Builtin struct {
+	// Name is the name of the builtin.
+	Name string
+	// Usage is a one line synopsis of how to call it.
+	Usage string
+	// Description is a longer description of what it does.
+	Description string
+}
+
+// builtins describes every builtin command.
+var builtins = []Builtin{
+	{
+		"cd", "cd dir",
+		"Change the current directory to dir, looking for it in $CDPATH if it's relative, and update $PWD and $OLDPWD.",
+	},
+	{
+		"set", "set var value",
+		"Set the environment variable var to value.",
+	},
+	{
+		"source", "source file [...other files]",
+		"Read and execute commands from each file in the current shell, or from standard input for -.",
+	},
+	{
+		"jobs", "jobs",
+		"List the background jobs.",
+	},
+	{
+		"bg", "bg job",
+		"Continue the stopped job in the background.",
+	},
+	{
+		"fg", "fg job",
+		"Continue the job in the foreground.",
+	},
+	{
+		"autocomplete", "autocomplete [-n position] regex value [more values...]",
+		"Suggest the values when completing a command that matches regex. Values starting with ! are run as a command, and each line of the output is suggested. With -n, only suggest them when completing argument number position. autocomplete -d regex deletes the rules for regex, and autocomplete -c deletes every rule.",
+	},
+	{
+		"read", "read [var...]",
+		"Read a line from standard in and assign each field to the next var, with the last var getting the rest of the line. With no vars, the line is assigned to $REPLY.",
+	},
+	{
+		"alias", "alias [name [value...]]",
+		"Define name as an alias for value. With no value, print the alias name, and with no name print all aliases.",
+	},
+	{
+		"help", "help [builtin]",
+		"List the builtins, or describe builtin.",
+	},
+	{
+		"clear", "clear",
+		"Clear the screen.",
+	},
+	{
+		"reset", "reset",
+		"Reset the terminal to a sane state, clearing the screen and any attributes, and restoring the terminal mode.",
+	},
+	{
+		"exec", "exec [cmd [args...]]",
+		"Replace the shell with cmd. Any redirections are applied first, and without a cmd they're applied to the shell itself.",
+	},
+	{
+		"getopts", "getopts optstring var [args...]",
+		"Parse the next option from args, setting var to the option, $OPTARG to its argument, and $OPTIND to the index of the next argument. Letters in optstring followed by : take an argument. When there are no more options, var is set to ? and $? to 1.",
+	},
+	{
+		"unalias", "unalias -a | name [names...]",
+		"Remove the aliases name, or every alias with -a.",
+	},
+	{
+		"compgen", "compgen command",
+		"Print the completions for the partially typed command.",
+	},
+	{
+		"readarray", "readarray [-t] [var]",
+		"Read lines from standard input into var_0, var_1, ... and var_COUNT. -t removes the newlines.",
+	},
+	{
+		"mapfile", "mapfile [-t] [var]",
+		"The same as readarray.",
+	},
+	{
+		"history", "history",
+		"Print the command history. $HISTSIZE is the number of lines to keep, set HISTDUPS off collapses repeated lines, set HISTIGNORESPACE on ignores lines that start with a space, and set HISTAPPEND off saves the history on exit instead of as lines are entered.",
+	},
+	{
+		"kill", "kill [options] pid|jobspec...",
+		"Send a signal to processes, like the kill program, except that job specs like %1, %name or %?name send it to every process in the job.",
+	},
+	{
+		"wait", "wait [-n] [jobspec...]",
+		"Wait for the jobs, or every job if none are given, to finish. With -n, wait for the next job to finish.",
+	},
+	{
+		"trap", "trap [command|-] signal... | trap [-l]",
+		"Run command when any of the signals arrive, or when the shell exits for EXIT. - removes the traps instead. With no arguments, list the traps, and with -l, list the signals.",
+	},
+	{
+		"noexpand", "noexpand command [args...]",
+		"Run command without expanding variables, command substitutions, ~ or globs in its arguments.",
+	},
+	{
+		"timeout", "timeout duration command [args...]",
+		"Run command, and stop it if it takes longer than duration, which is in seconds or like 100ms. $? is 124 if it was stopped.",
+	},
+	{
+		"readonly", "readonly [name[=value]...]",
+		"Mark the variables named as read-only, after setting them to value if given. Without arguments, list the read-only variables.",
+	},
+	{
+		"redo-as", "redo-as [command [args...]]",
+		"Run the last command in the history again, with command in front of it. Without a command, $ELEVATE is used, or sudo if it isn't set.",
+	},
+}
+
+// aliases maps the name of an alias to the command that it expands to.
+var aliases map[string]string
+
+// readonlyVars is the set of variables that can't be assigned to.
+var readonlyVars = make(map[string]bool)
+
+// IsBuiltin returns true if name is the name of a builtin command.
+func IsBuiltin(name string) bool {
+	for _, b := range builtins {
+		if b.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Read reads a line from r, and assigns the fields to the environment
+// variables named in vars. The last variable gets the remainder of the line.
+func Read(r io.Reader, vars []string) error {
+	if r == os.Stdin {
+		restore()
+		defer cbreak()
+	}
+
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := r.Read(buf)
+		if n == 1 {
+			if buf[0] == '\n' {
+				break
+			}
+			line = append(line, buf[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if len(vars) == 0 {
+		return setVariable("REPLY", string(line))
+	}
+	fields := strings.Fields(string(line))
+	for i, v := range vars {
+		var val string
+		switch {
+		case i >= len(fields):
+			val = ""
+		case i == len(vars)-1:
+			val = strings.Join(fields[i:], " ")
+		default:
+			val = fields[i]
+		}
+		if err := setVariable(v, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Alias defines the alias args[0] to be the remaining args, or writes the
+// alias args[0] to w if there are no remaining args. With no args, it writes
+// all aliases.
+func Alias(w io.Writer, args []string) error {
+	switch len(args) {
+	case 0:
+		names := make([]string, 0, len(aliases))
+		for name := range aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "alias %s '%s'\n", name, aliases[name])
+		}
+		return nil
+	case 1:
+		val, ok := aliases[args[0]]
+		if !ok {
+			return builtinError(ErrNotFound, "alias: %s: not found", args[0])
+		}
+		fmt.Fprintf(w, "alias %s '%s'\n", args[0], val)
+		return nil
+	}
+	if aliases == nil {
+		aliases = make(map[string]string)
+	}
+	aliases[args[0]] = strings.Join(args[1:], " ")
+	return nil
+}
+
+// Help writes the usage of every builtin to w, or a description of the
+// builtins named in args.
+func Help(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		for _, b := range builtins {
+			fmt.Fprintf(w, "%s\n", b.Usage)
+		}
+		return nil
+	}
+	for _, name := range args {
+		found := false
+		for _, b := range builtins {
+			if b.Name == name {
+				fmt.Fprintf(w, "Usage: %s\n\n%s\n", b.Usage, b.Description)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return builtinError(ErrNotFound, "help: no help for %s", name)
+		}
+	}
+	return nil
+}
+
+// Clear writes the escape sequence to clear the screen to w.
+func Clear(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "\033[H\033[2J")
+	return err
+}
+
+// Reset writes the escape sequence to reset the terminal to w, and restores
+// the terminal's mode.
+func Reset(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "\033c"); err != nil {
+		return err
+	}
+	restore()
+	cbreak()
+	return nil
+}
+
+// shellRedirects returns all of the redirections of p, including its
+// standard in and standard out, in the order that they should be applied.
+func (p ParsedCommand) shellRedirects() []Redirect {
+	var redirects []Redirect
+	if p.Stdin != "" {
+		redirects = append(redirects, Redirect{0, "<", p.Stdin})
+	}
+	if p.Stdout != "" {
+		redirects = append(redirects, Redirect{1, ">", p.Stdout})
+	}
+	return append(redirects, p.Redirects...)
+}
+
+// redirectShell applies redirects to the shell's own file descriptors.
+func redirectShell(redirects []Redirect) error {
+	for _, r := range redirects {
+		var src int
+		switch r.Op {
+		case "<", ">", ">|", ">>":
+			var f *os.File
+			var err error
+			if r.Op == "<" {
+				f, err = os.Open(r.Target)
+			} else if r.Op == ">>" {
+				f, err = appendFile(r.Target)
+			} else {
+				f, err = createFile(r.Target, r.Op == ">|")
+			}
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			src = int(f.Fd())
+		case ">&":
+			src, _ = strconv.Atoi(r.Target)
+		}
+		if src == r.Fd {
+			continue
+		}
+		if err := syscall.Dup3(src, r.Fd, 0); err != nil {
+			return fmt.Errorf("%d: %v", r.Fd, err)
+		}
+	}
+	return nil
+}
+
+// execArgs returns the path and arguments of the command that exec should
+// run for p, or an empty path if there's no command.
+func execArgs(p ParsedCommand) (string, []string, error) {
+	if len(p.Args) < 2 {
+		return "", nil, nil
+	}
+	path, err := resolveCommand(p.Args[1])
+	if err != nil {
+		return "", nil, commandFailed(p.Args[1], err)
+	}
+	return path, p.Args[1:], nil
+}
+
+// Exec applies the redirections of p to the shell, and then replaces the
+// shell with the command in p, if any.
+func Exec(p ParsedCommand) error {
+	path, args, err := execArgs(p)
+	if err != nil {
+		return err
+	}
+	if err := redirectShell(p.shellRedirects()); err != nil {
+		return err
+	}
+	if path == "" {
+		return nil
+	}
+	restore()
+	err = syscall.Exec(path, args, os.Environ())
+	cbreak()
+	return commandFailed(args[0], err)
+}
+
+// Unalias removes the aliases named in args, or every alias if args is -a.
+func Unalias(args []string) error {
+	if len(args) == 0 {
+		return builtinError(ErrUsage, "Usage: unalias -a | name [names...]")
+	}
+	if len(args) == 1 && args[0] == "-a" {
+		aliases = nil
+		return nil
+	}
+	for _, name := range args {
+		if _, ok := aliases[name]; !ok {
+			return builtinError(ErrNotFound, "unalias: %s: not found", name)
+		}
+		delete(aliases, name)
+	}
+	return nil
+}
+
+// Readarray reads every line from r into the numbered variables named by
+// args, with the number of lines in the _COUNT variable.
+func Readarray(r io.Reader, args []string) error {
+	trim := false
+	if len(args) > 0 && args[0] == "-t" {
+		trim, args = true, args[1:]
+	}
+	name := "MAPFILE"
+	switch len(args) {
+	case 0:
+	case 1:
+		name = args[0]
+	default:
+		return builtinError(ErrUsage, "Usage: readarray [-t] [var]")
+	}
+	if r == os.Stdin {
+		restore()
+		defer cbreak()
+	}
+
+	scanner := bufio.NewScanner(r)
+	if !trim {
+		scanner.Split(scanLinesWithNewline)
+	}
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	oldcount, _ := strconv.Atoi(os.Getenv(name + "_COUNT"))
+	// Check every variable first, so that the array isn't left half
+	// changed.
+	names := []string{name, name + "_COUNT"}
+	for i := 0; i < len(lines) || i < oldcount; i++ {
+		names = append(names, name+"_"+strconv.Itoa(i))
+	}
+	for _, n := range names {
+		if err := checkWritable(n); err != nil {
+			return err
+		}
+	}
+	for i := len(lines); i < oldcount; i++ {
+		if err := unsetVariable(name + "_" + strconv.Itoa(i)); err != nil {
+			return err
+		}
+	}
+	for i, line := range lines {
+		if err := setVariable(name+"_"+strconv.Itoa(i), line); err != nil {
+			return err
+		}
+	}
+	return setVariable(name+"_COUNT", strconv.Itoa(len(lines)))
+}
+
+// scanLinesWithNewline is a bufio.SplitFunc like bufio.ScanLines, except
+// that it keeps the newline at the end of each line.
+func scanLinesWithNewline(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// expandAliases returns tokens with the aliases in command position
+// expanded, and the position in tokens of the word that each of the
+// expanded words came from. The expansions aren't expanded again.
+func expandAliases(tokens []string) (expanded []string, from []int) {
+	command := true
+	for i, t := range tokens {
+		alias, ok := aliases[t]
+		if !command || !ok {
+			expanded = append(expanded, t)
+			from = append(from, i)
+			command = t == "|"
+			continue
+		}
+		for _, word := range Command(alias).Tokenize() {
+			expanded = append(expanded, word)
+			from = append(from, i)
+		}
+		command = strings.HasSuffix(alias, " ")
+	}
+	return expanded, from
+}
+
+// setVariable sets the variable name to value, unless it's read-only.
+func setVariable(name, value string) error {
+	if err := checkWritable(name); err != nil {
+		return err
+	}
+	switch name {
+	case "RANDOM":
+		seed, _ := strconv.ParseInt(value, 10, 64)
+		random.Seed(seed)
+		return nil
+	case "SECONDS":
+		n, _ := strconv.Atoi(value)
+		secondsStart = time.Now().Add(-time.Duration(n) * time.Second)
+		return nil
+	}
+	return os.Setenv(name, value)
+}
+
+// unsetVariable unsets the variable name, unless it's read-only.
+func unsetVariable(name string) error {
+	if err := checkWritable(name); err != nil {
+		return err
+	}
+	return os.Unsetenv(name)
+}
+
+// checkWritable returns an ErrReadOnly error if the variable name is
+// read-only.
+func checkWritable(name string) error {
+	if readonlyVars[name] {
+		return builtinError(ErrReadOnly, "%s: read-only variable", name)
+	}
+	return nil
+}
+
+// Readonly implements the readonly builtin.
+func Readonly(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		names := make([]string, 0, len(readonlyVars))
+		for name := range readonlyVars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "readonly %s='%s'\n", name, os.Getenv(name))
+		}
+		return nil
+	}
+	for _, arg := range args {
+		name := arg
+		if n, value, appending, ok := parseAssignment(arg); ok && !appending {
+			name = n
+			if err := setVariable(name, value); err != nil {
+				return err
+			}
+		} else if !isName(name) {
+			return builtinError(ErrInvalidArgument, "readonly: %s: not a valid name", arg)
+		}
+		readonlyVars[name] = true
+	}
+	return nil
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/pkg/term"
+	"github.com/pkg/term/termios"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestReadRedirect(t *testing.T) {
+	f, err := ioutil.TempFile("", "goshread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("hello  big world\nsecond line\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	tests := []struct {
+		cmd      Command
+		expected map[string]string
+	}{
+		{
+			Command("read GOSHTESTA < " + f.Name()),
+			map[string]string{"GOSHTESTA": "hello big world"},
+		},
+		{
+			Command("read GOSHTESTA GOSHTESTB < " + f.Name()),
+			map[string]string{"GOSHTESTA": "hello", "GOSHTESTB": "big world"},
+		},
+		{
+			Command("read GOSHTESTA GOSHTESTB GOSHTESTC GOSHTESTD < " + f.Name()),
+			map[string]string{"GOSHTESTA": "hello", "GOSHTESTB": "big", "GOSHTESTC": "world", "GOSHTESTD": ""},
+		},
+		{
+			Command("read < " + f.Name()),
+			map[string]string{"REPLY": "hello  big world"},
+		},
+	}
+	for i, tc := range tests {
+		if err := tc.cmd.HandleCmd(); err != nil {
+			t.Errorf("Unexpected error for test %d: %v", i, err)
+			continue
+		}
+		for name, val := range tc.expected {
+			if got := os.Getenv(name); got != val {
+				t.Errorf("Unexpected value for %v in test %d: got %q want %q", name, i, got, val)
+			}
+		}
+	}
+}
+
+// runBuiltin runs cmd with its standard out redirected to a temporary file,
+// and returns what it wrote.
+func runBuiltin(t *testing.T, cmd string) string {
+	f, err := ioutil.TempFile("", "goshbuiltin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if err := Command(cmd + " > " + f.Name()).HandleCmd(); err != nil {
+		t.Fatalf("Unexpected error running %v: %v", cmd, err)
+	}
+	out, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestHelp(t *testing.T) {
+	out := runBuiltin(t, "help")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != len(builtins) {
+		t.Errorf("Unexpected number of lines from help: got %v want %v", len(lines), len(builtins))
+	}
+	for _, name := range []string{"cd", "set", "source", "jobs", "bg", "fg", "autocomplete", "read", "alias", "help"} {
+		found := false
+		for _, l := range lines {
+			if strings.HasPrefix(l, name+" ") || l == name {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("help did not list %v", name)
+		}
+	}
+
+	out = runBuiltin(t, "help cd")
+	if !strings.HasPrefix(out, "Usage: cd dir\n") {
+		t.Errorf("Unexpected help for cd: got %q", out)
+	}
+
+	if err := Command("help notabuiltin").HandleCmd(); err == nil {
+		t.Errorf("Expected error for help on unknown builtin")
+	}
+}
+
+func TestClear(t *testing.T) {
+	if out := runBuiltin(t, "clear"); out != "\033[H\033[2J" {
+		t.Errorf("Unexpected output from clear: got %q", out)
+	}
+}
+
+func TestReset(t *testing.T) {
+	ptm, pts, err := termios.Pty()
+	if err != nil {
+		t.Skipf("Could not open pseudoterminal: %v", err)
+	}
+	defer ptm.Close()
+	defer pts.Close()
+
+	tty, err := term.Open(pts.Name())
+	if err != nil {
+		t.Skipf("Could not open pseudoterminal: %v", err)
+	}
+	defer tty.Close()
+
+	oldterminal, oldcaps := terminal, caps
+	defer func() { terminal, caps = oldterminal, oldcaps }()
+	terminal = tty
+	caps.LineEditing = true
+
+	if err := tty.SetRaw(); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := Reset(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "\033c" {
+		t.Errorf("Unexpected output from reset: got %q", out.String())
+	}
+
+	var attrs syscall.Termios
+	if _, _, err := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		pts.Fd(),
+		uintptr(syscall.TCGETS),
+		uintptr(unsafe.Pointer(&attrs)),
+	); err != 0 {
+		t.Fatal(err)
+	}
+	if attrs.Lflag&(syscall.ICANON|syscall.ECHO) != 0 {
+		t.Errorf("Terminal not in cbreak mode after reset")
+	}
+	if attrs.Oflag&syscall.OPOST == 0 {
+		t.Errorf("Terminal still in raw mode after reset")
+	}
+}
+
+func TestExecArgs(t *testing.T) {
+	cases := []struct {
+		Cmd       Command
+		Args      []string
+		Redirects []Redirect
+	}{
+		{"exec", nil, nil},
+		{"exec > out", nil, []Redirect{{1, ">", "out"}}},
+		{"exec 2>&1 < in", nil, []Redirect{{0, "<", "in"}, {2, ">&", "1"}}},
+		{"exec sh -c true 3> out", []string{"sh", "-c", "true"}, []Redirect{{3, ">", "out"}}},
+	}
+	for i, tc := range cases {
+		var tokens []Token
+		for _, t := range tc.Cmd.Tokenize() {
+			tokens = append(tokens, Token(t))
+		}
+		cmds, err := ParseCommands(tokens)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path, args, err := execArgs(cmds[0])
+		if err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+			continue
+		}
+		if (path == "") != (tc.Args == nil) {
+			t.Errorf("Unexpected path for case %d: %q", i, path)
+		}
+		if strings.Join(args, " ") != strings.Join(tc.Args, " ") {
+			t.Errorf("Unexpected args for case %d: got %v want %v", i, args, tc.Args)
+		}
+		redirects := cmds[0].shellRedirects()
+		if len(redirects) != len(tc.Redirects) {
+			t.Errorf("Unexpected redirects for case %d: got %v want %v", i, redirects, tc.Redirects)
+			continue
+		}
+		for j := range redirects {
+			if redirects[j] != tc.Redirects[j] {
+				t.Errorf("Unexpected redirect %d for case %d: got %v want %v", j, i, redirects[j], tc.Redirects[j])
+			}
+		}
+	}
+
+	if _, _, err := execArgs(ParsedCommand{Args: []string{"exec", "notarealcommandgosh"}}); err == nil {
+		t.Errorf("Expected error for a command that doesn't exist")
+	}
+}
+
+func TestRedirectShell(t *testing.T) {
+	f, err := ioutil.TempFile("", "goshexec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	const fd = 42
+	if err := redirectShell([]Redirect{{fd, ">", f.Name()}}); err != nil {
+		t.Fatal(err)
+	}
+	w := os.NewFile(fd, "redirected")
+	fmt.Fprintf(w, "hello")
+	w.Close()
+
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("Unexpected file contents: got %q want %q", got, "hello")
+	}
+}
+
+func TestUnalias(t *testing.T) {
+	oldaliases := aliases
+	defer func() { aliases = oldaliases }()
+	aliases = map[string]string{"ll": "ls -l", "la": "ls -a", "gs": "git status"}
+
+	if err := Command("unalias ll gs").HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 1 || aliases["la"] != "ls -a" {
+		t.Errorf("Unexpected aliases after unalias: %v", aliases)
+	}
+	if err := Command("unalias ll").HandleCmd(); err == nil {
+		t.Error("Expected error removing an alias that doesn't exist")
+	}
+	if err := Command("unalias -a").HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 0 {
+		t.Errorf("Unexpected aliases after unalias -a: %v", aliases)
+	}
+}
+
+func TestReadarray(t *testing.T) {
+	defer func() {
+		for _, v := range []string{"GOSHLINES_0", "GOSHLINES_1", "GOSHLINES_2", "GOSHLINES_COUNT"} {
+			os.Unsetenv(v)
+		}
+	}()
+	cases := []struct {
+		Input    string
+		Args     []string
+		Expected []string
+	}{
+		{"one\ntwo words\nthree\n", []string{"-t", "GOSHLINES"}, []string{"one", "two words", "three"}},
+		{"one\ntwo", []string{"GOSHLINES"}, []string{"one\n", "two"}},
+		{"", []string{"-t", "GOSHLINES"}, nil},
+		{"\n\n", []string{"-t", "GOSHLINES"}, []string{"", ""}},
+	}
+	for i, tc := range cases {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			fmt.Fprint(w, tc.Input)
+			w.Close()
+		}()
+		err = Readarray(r, tc.Args)
+		r.Close()
+		if err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+			continue
+		}
+		if got := os.Getenv("GOSHLINES_COUNT"); got != strconv.Itoa(len(tc.Expected)) {
+			t.Errorf("Unexpected count for case %d: got %v want %v", i, got, len(tc.Expected))
+		}
+		for j, line := range tc.Expected {
+			if got := os.Getenv("GOSHLINES_" + strconv.Itoa(j)); got != line {
+				t.Errorf("Unexpected line %d for case %d: got %q want %q", j, i, got, line)
+			}
+		}
+		if _, ok := os.LookupEnv("GOSHLINES_" + strconv.Itoa(len(tc.Expected))); ok {
+			t.Errorf("Leftover line %d for case %d", len(tc.Expected), i)
+		}
+	}
+	if err := Readarray(strings.NewReader(""), []string{"a", "b"}); err == nil {
+		t.Error("Expected usage error with two variables")
+	}
+}
+
+func TestNoexpand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshnoexpand")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(oldwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"a.txt", "b.txt"} {
+		if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("GOSHNOEXPAND", "value")
+	defer os.Unsetenv("GOSHNOEXPAND")
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	cases := []struct {
+		Cmd      Command
+		Expected string
+	}{
+		{"noexpand echo *", "*\n"},
+		{"noexpand echo *.txt ~ $GOSHNOEXPAND $(echo x)", "*.txt ~ $GOSHNOEXPAND $(echo x)\n"},
+		{`noexpand echo '$HOME' "\$HOME"`, "$HOME $HOME\n"},
+		{"echo *.txt $GOSHNOEXPAND", "a.txt b.txt value\n"},
+	}
+	for i, tc := range cases {
+		if err := Command(string(tc.Cmd) + " > out").Run(child); err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+			continue
+		}
+		if got, _ := ioutil.ReadFile("out"); string(got) != tc.Expected {
+			t.Errorf("Unexpected output for case %d (%v): got %q want %q", i, tc.Cmd, got, tc.Expected)
+		}
+	}
+	if err := Command("noexpand").HandleCmd(); err != nil {
+		t.Errorf("Unexpected error for noexpand on its own: %v", err)
+	}
+}
+
+func TestExpandAliases(t *testing.T) {
+	oldaliases := aliases
+	defer func() { aliases = oldaliases }()
+	aliases = map[string]string{
+		"ll":   "ls -l",
+		"sudo": "sudo ",
+		"e":    "echo",
+		"g":    "grep -i",
+	}
+
+	cases := []struct {
+		Tokens   []string
+		Expected []string
+		From     []int
+	}{
+		{[]string{"ll", "ll"}, []string{"ls", "-l", "ll"}, []int{0, 0, 1}},
+		{[]string{"echo", "ll"}, []string{"echo", "ll"}, []int{0, 1}},
+		{[]string{"ls", "|", "g", "foo", "|", "ll"}, []string{"ls", "|", "grep", "-i", "foo", "|", "ls", "-l"}, []int{0, 1, 2, 2, 3, 4, 5, 5}},
+		{[]string{"sudo", "ll", "ll"}, []string{"sudo", "ls", "-l", "ll"}, []int{0, 1, 1, 2}},
+		{[]string{"sudo", "sudo", "e", "ll"}, []string{"sudo", "sudo", "echo", "ll"}, []int{0, 1, 2, 3}},
+		{[]string{"e", "sudo", "ll"}, []string{"echo", "sudo", "ll"}, []int{0, 1, 2}},
+	}
+	for i, tc := range cases {
+		if got, from := expandAliases(tc.Tokens); !reflect.DeepEqual(got, tc.Expected) || !reflect.DeepEqual(from, tc.From) {
+			t.Errorf("Unexpected expansion for case %d: got %q %v want %q %v", i, got, from, tc.Expected, tc.From)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "goshalias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	if err := Command("e ll e | cat > " + out).Run(child); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(out); string(got) != "ll e\n" {
+		t.Errorf("Unexpected output: got %q want %q", got, "ll e\n")
+	}
+}
+
+func TestCdFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshcdfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "notes.txt")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(oldwd)
+	oldcdfile, oldpwd, oldoldpwd := os.Getenv("CD_FILE"), os.Getenv("PWD"), os.Getenv("OLDPWD")
+	defer func() {
+		os.Setenv("CD_FILE", oldcdfile)
+		os.Setenv("PWD", oldpwd)
+		os.Setenv("OLDPWD", oldoldpwd)
+	}()
+
+	os.Unsetenv("CD_FILE")
+	if err := Command("cd " + file).HandleCmd(); err == nil {
+		t.Error("Expected an error changing to a file with CD_FILE unset")
+	}
+	if wd, _ := os.Getwd(); wd != oldwd {
+		t.Errorf("Unexpected working directory: got %q want %q", wd, oldwd)
+	}
+
+	os.Setenv("CD_FILE", "on")
+	if err := Command("cd " + file).HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+	if wd, _ := os.Getwd(); wd != dir {
+		t.Errorf("Unexpected working directory: got %q want %q", wd, dir)
+	}
+	if pwd := os.Getenv("PWD"); pwd != dir {
+		t.Errorf("Unexpected $PWD: got %q want %q", pwd, dir)
+	}
+	if err := Command("cd " + filepath.Join(dir, "missing.txt")).HandleCmd(); !errors.Is(err, ErrNoSuchFile) {
+		t.Errorf("Unexpected error changing to a missing file: got %v", err)
+	}
+}
+
+func TestReadonly(t *testing.T) {
+	defer func() {
+		delete(readonlyVars, "GOSHRO")
+		delete(readonlyVars, "GOSHRO2")
+		os.Unsetenv("GOSHRO")
+		os.Unsetenv("GOSHRO2")
+	}()
+	if err := Command("readonly GOSHRO=foo GOSHRO2").HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+	if v := os.Getenv("GOSHRO"); v != "foo" {
+		t.Errorf("Unexpected value: got %q want %q", v, "foo")
+	}
+
+	f, err := ioutil.TempFile("", "goshreadonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "bar")
+	f.Close()
+
+	cases := []struct {
+		Cmd  Command
+		Name string
+	}{
+		{"set GOSHRO bar", "GOSHRO"},
+		{"GOSHRO=bar", "GOSHRO"},
+		{"GOSHRO+=bar", "GOSHRO"},
+		{"GOSHRO2=bar", "GOSHRO2"},
+		{"readonly GOSHRO=bar", "GOSHRO"},
+		{Command("read GOSHRO < " + f.Name()), "GOSHRO"},
+		{"getopts a GOSHRO -a", "GOSHRO"},
+		{Command("readarray GOSHRO < " + f.Name()), "GOSHRO"},
+	}
+	for i, tc := range cases {
+		err := tc.Cmd.HandleCmd()
+		if !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Unexpected error for case %d (%q): got %v want %v", i, tc.Cmd, err, ErrReadOnly)
+		} else if expected := tc.Name + ": read-only variable"; err.Error() != expected {
+			t.Errorf("Unexpected message for case %d (%q): got %q want %q", i, tc.Cmd, err, expected)
+		}
+		if v := os.Getenv("GOSHRO"); v != "foo" {
+			t.Errorf("Unexpected value after case %d (%q): got %q want %q", i, tc.Cmd, v, "foo")
+		}
+	}
+
+	// Marking it read-only again without a value is fine.
+	if err := Command("readonly GOSHRO").HandleCmd(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := Command("readonly 1GOSHRO").HandleCmd(); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Unexpected error for invalid name: got %v", err)
+	}
+
+	out := runBuiltin(t, "readonly")
+	if expected := "readonly GOSHRO='foo'\nreadonly GOSHRO2=''\n"; !strings.Contains(out, expected) {
+		t.Errorf("Unexpected list: got %q want it to contain %q", out, expected)
+	}
+}
+
+func TestReadonlyShellVariables(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	oldpwd := os.Getenv("PWD")
+	defer os.Setenv("PWD", oldpwd)
+	defer delete(readonlyVars, "PWD")
+	os.Setenv("PWD", wd)
+	readonlyVars["PWD"] = true
+	if err := Command("cd " + os.TempDir()).HandleCmd(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Unexpected error for cd with a read-only $PWD: got %v", err)
+	}
+	if now, _ := os.Getwd(); now != wd || os.Getenv("PWD") != wd {
+		t.Errorf("cd changed directory with a read-only $PWD: now in %v with $PWD %v", now, os.Getenv("PWD"))
+	}
+
+	// An element that readarray would unset is read-only too.
+	defer func() {
+		delete(readonlyVars, "GOSHARR_1")
+		for _, name := range []string{"GOSHARR_0", "GOSHARR_1", "GOSHARR_COUNT"} {
+			os.Unsetenv(name)
+		}
+	}()
+	os.Setenv("GOSHARR_0", "a")
+	os.Setenv("GOSHARR_1", "b")
+	os.Setenv("GOSHARR_COUNT", "2")
+	readonlyVars["GOSHARR_1"] = true
+	if err := Command("readarray GOSHARR < /dev/null").HandleCmd(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Unexpected error for readarray with a read-only element: got %v", err)
+	}
+	if a, b := os.Getenv("GOSHARR_0"), os.Getenv("GOSHARR_1"); a != "a" || b != "b" {
+		t.Errorf("readarray changed an array with a read-only element: got %q, %q", a, b)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// defaultColors are the colours used when $LS_COLORS doesn't specify one.
+var defaultColors = map[string]string{
+	"di": "01;34",
+	"ln": "01;36",
+	"ex": "01;32",
+	"pi": "33",
+	"so": "01;35",
+}
+
+// parseLSColors parses an $LS_COLORS style string into a map of file type
+// codes to SGR parameters.
+func parseLSColors(s string) map[string]string {
+	colors := make(map[string]string, len(defaultColors))
+	for k, v := range defaultColors {
+		colors[k] = v
+	}
+	for _, entry := range strings.Split(s, ":") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		colors[kv[0]] = kv[1]
+	}
+	return colors
+}
+
+// fileColor returns the SGR parameters to use for a file with the given mode,
+// or the empty string if it shouldn't be coloured.
+func fileColor(mode os.FileMode, colors map[string]string) string {
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return colors["ln"]
+	case mode.IsDir():
+		return colors["di"]
+	case mode&os.ModeNamedPipe != 0:
+		return colors["pi"]
+	case mode&os.ModeSocket != 0:
+		return colors["so"]
+	case mode&0111 != 0:
+		return colors["ex"]
+	}
+	return colors["fi"]
+}
+
+// completionColors returns the colours to use for displaying file
+// completions, or nil if they shouldn't be coloured.
+func completionColors() map[string]string {
+	if !caps.Color || os.Getenv("COMPLETION_COLORS") == "off" {
+		return nil
+	}
+	return parseLSColors(os.Getenv("LS_COLORS"))
+}
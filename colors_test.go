@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestFileColor(t *testing.T) {
+	colors := parseLSColors("di=01;34:ex=01;32:ln=01;36:fi=0")
+	cases := []struct {
+		Mode     os.FileMode
+		Expected string
+	}{
+		{os.ModeDir | 0755, "01;34"},
+		{os.ModeSymlink | 0777, "01;36"},
+		{0755, "01;32"},
+		{0644, "0"},
+		{0744, "01;32"},
+	}
+	for i, tc := range cases {
+		if got := fileColor(tc.Mode, colors); got != tc.Expected {
+			t.Errorf("Unexpected colour for case %d: got %v want %v", i, got, tc.Expected)
+		}
+	}
+}
+
+func TestParseLSColors(t *testing.T) {
+	colors := parseLSColors("di=00;31:*.go=01;33:garbage")
+	if colors["di"] != "00;31" {
+		t.Errorf("Did not override directory colour: got %v", colors["di"])
+	}
+	if colors["ex"] != defaultColors["ex"] {
+		t.Errorf("Did not use default executable colour: got %v", colors["ex"])
+	}
+	if _, ok := colors["garbage"]; ok {
+		t.Errorf("Invalid entry was added to colours")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// formatColumns formats items into columns, ordered down each column, which
+// fit into width characters.
+func formatColumns(items []string, width int) string {
+	if len(items) == 0 {
+		return ""
+	}
+
+	maxlen := 0
+	for _, item := range items {
+		if l := displayWidth(item); l > maxlen {
+			maxlen = l
+		}
+	}
+	colwidth := maxlen + 2
+	cols := width / colwidth
+	if cols < 1 {
+		cols = 1
+	}
+	rows := (len(items) + cols - 1) / cols
+
+	var b strings.Builder
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			idx := col*rows + row
+			if idx >= len(items) {
+				break
+			}
+			b.WriteString(items[idx])
+			if next := (col+1)*rows + row; next < len(items) {
+				b.WriteString(strings.Repeat(" ", colwidth-displayWidth(items[idx])))
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+type winsize struct {
+	Row, Col       uint16
+	Xpixel, Ypixel uint16
+}
+
+// TerminalWidth returns the width of the terminal attached to standard out,
+// or 80 if it can't be determined.
+func TerminalWidth() int {
+	var ws winsize
+	_, _, err := syscall.RawSyscall(
+		syscall.SYS_IOCTL,
+		uintptr(syscall.Stdout),
+		uintptr(syscall.TIOCGWINSZ),
+		uintptr(unsafe.Pointer(&ws)),
+	)
+	if err != syscall.Errno(0) || ws.Col == 0 {
+		return 80
+	}
+	return int(ws.Col)
+}
+
+// displayWidth returns the number of columns that s takes up on the screen,
+// ignoring any escape sequences.
+func displayWidth(s string) int {
+	width := 0
+	inEscape := false
+	for _, r := range s {
+		switch {
+		case inEscape:
+			if r == 'm' {
+				inEscape = false
+			}
+		case r == '\033':
+			inEscape = true
+		default:
+			width += runeWidth(r)
+		}
+	}
+	return width
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFormatColumns(t *testing.T) {
+	cases := []struct {
+		Items    []string
+		Width    int
+		Expected string
+	}{
+		// Nothing to display
+		{nil, 80, ""},
+
+		// Everything fits on one line
+		{[]string{"a", "b", "c"}, 80, "a  b  c\n"},
+
+		// Items go down the columns before they go across
+		{[]string{"a", "bb", "ccc", "dddd", "e"}, 20, "a     ccc   e\nbb    dddd\n"},
+
+		// Too narrow for more than one column
+		{[]string{"foo", "bar"}, 4, "foo\nbar\n"},
+
+		// Escape sequences don't take up any space
+		{[]string{"\033[01;34ma\033[0m", "bb"}, 80, "\033[01;34ma\033[0m   bb\n"},
+
+		// Wide characters take up two columns each
+		{[]string{"日本", "a", "bb"}, 12, "日本  bb\na\n"},
+	}
+	for i, tc := range cases {
+		if got := formatColumns(tc.Items, tc.Width); got != tc.Expected {
+			t.Errorf("Unexpected columns for case %d: got %q want %q", i, got, tc.Expected)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// isExecutable returns true if the file at path is a regular file with an
+// executable bit set.
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+}
+
+// resolveCommand returns the path of the command name, by searching the
+// directories in $PATH in order. Names with a / in them are returned as they
+// are.
+func resolveCommand(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+	// The first file that matched, but isn't executable.
+	var noexec string
+	for _, dir := range pathDirs() {
+		path := filepath.Join(dir, name)
+		if !filepath.IsAbs(path) {
+			// The current directory was in the $PATH, so
+			// make sure it doesn't get searched for again.
+			path = "./" + path
+		}
+		if isExecutable(path) {
+			return path, nil
+		}
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && noexec == "" {
+			noexec = path
+		}
+	}
+	if noexec != "" {
+		return noexec, nil
+	}
+	return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+}
+
+// CommandError is an error from a command that couldn't be run.
+type CommandError struct {
+	Name string
+	Msg  string
+	// Status is the value of $? for the error.
+	Status int
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("gosh: %s: %s", e.Name, e.Msg)
+}
+
+// commandFailed converts an error from finding or starting the command
+// name into a CommandError, and sets $? to its status.
+func commandFailed(name string, err error) error {
+	msg, status := commandStatus(name, err)
+	os.Setenv("?", strconv.Itoa(status))
+	return &CommandError{Name: name, Msg: msg, Status: status}
+}
+
+// commandStatus returns the message and $? for err, an error from finding
+// or starting the command name.
+func commandStatus(name string, err error) (string, int) {
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return "command not found", 127
+	case errors.Is(err, syscall.ENOENT):
+		return "No such file or directory", 127
+	case errors.Is(err, syscall.EACCES):
+		if path, perr := resolveCommand(name); perr == nil {
+			if info, serr := os.Stat(path); serr == nil && info.IsDir() {
+				return "Is a directory", 126
+			}
+		}
+		return "Permission denied", 126
+	}
+	return err.Error(), 1
+}
+
+// scriptShell returns the path of the shell that scripts without an
+// interpreter are run with.
+var scriptShell = os.Executable
+
+// scriptCommand returns a command that runs the script that c failed to
+// run with the shell instead.
+func scriptCommand(c *exec.Cmd) (*exec.Cmd, error) {
+	shell, err := scriptShell()
+	if err != nil {
+		return nil, err
+	}
+	return &exec.Cmd{
+		Path:        shell,
+		Args:        append([]string{c.Args[0], c.Path}, c.Args[1:]...),
+		Env:         c.Env,
+		Dir:         c.Dir,
+		Stdin:       c.Stdin,
+		Stdout:      c.Stdout,
+		Stderr:      c.Stderr,
+		ExtraFiles:  c.ExtraFiles,
+		SysProcAttr: c.SysProcAttr,
+	}, nil
+}
+
+// sourcing is the number of files that are being sourced.
+var sourcing int
+
+// interactive returns true if a user is typing the commands that are being
+// run, and so should see a prompt.
+func interactive() bool {
+	return caps.Interactive && sourcing == 0
+}
+
+// readCommand reads the next command from r, which may go on for more than
+// one line. Like ReadString, it returns what it read along with any error.
+func readCommand(r *bufio.Reader) (string, error) {
+	var cmd string
+	for {
+		line, err := r.ReadString('\n')
+		cmd += line
+		if err != nil {
+			return cmd, err
+		}
+		if _, perr := Command(cmd).Parse(); perr != ErrIncomplete {
+			return cmd, nil
+		}
+	}
+}
+
+// sourceReader runs the commands read from r in the current shell. name
+// is what r is called in error messages.
+func sourceReader(r io.Reader, name string) error {
+	sourcing++
+	defer func() { sourcing-- }()
+	defer func(old int) { lineNumber = old }(lineNumber)
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	scanner := bufio.NewReader(r)
+	lineno := 1
+	for {
+		line, err := readCommand(scanner)
+		if line != "" {
+			lineNumber = lineno
+			if err := Command(line).Run(child); err != nil {
+				return fmt.Errorf("%s:%d: %v", name, lineno, err)
+			}
+			lineno += strings.Count(line, "\n")
+		}
+		switch err {
+		case io.EOF:
+			return nil
+		case nil:
+			// Nothing special
+		default:
+			return fmt.Errorf("%s:%d: %v", name, lineno, err)
+		}
+	}
+}
+
+// sourceFailed sets $? for err, the error from a line of a sourced file, if
+// the line didn't set it, and returns err.
+func sourceFailed(err error) error {
+	if os.Getenv("?") == "0" {
+		os.Setenv("?", "1")
+	}
+	return err
+}
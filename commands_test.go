@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestResolveCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshresolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	for _, d := range []string{first, second} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []struct {
+		Path string
+		Mode os.FileMode
+	}{
+		{filepath.Join(first, "both"), 0755},
+		{filepath.Join(second, "both"), 0755},
+		{filepath.Join(first, "noexec"), 0644},
+		{filepath.Join(second, "noexec"), 0755},
+		{filepath.Join(second, "onlysecond"), 0755},
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(f.Path, nil, f.Mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(first, "adir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(second); err != nil {
+		t.Fatal(err)
+	}
+
+	oldpath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldpath)
+
+	cases := []struct {
+		Path     string
+		Name     string
+		Expected string
+	}{
+		{first + ":" + second, "both", filepath.Join(first, "both")},
+		{second + ":" + first, "both", filepath.Join(second, "both")},
+		{first + ":" + second, "noexec", filepath.Join(second, "noexec")},
+		{first + ":" + second, "onlysecond", filepath.Join(second, "onlysecond")},
+		{first + ":", "onlysecond", "./onlysecond"},
+		{first, "/bin/sh", "/bin/sh"},
+		{first, "./onlysecond", "./onlysecond"},
+		{first, "sub/cmd", "sub/cmd"},
+		{first, "adir", ""},
+		{first, "onlysecond", ""},
+	}
+	for i, tc := range cases {
+		os.Setenv("PATH", tc.Path)
+		got, err := resolveCommand(tc.Name)
+		if tc.Expected == "" {
+			if err == nil {
+				t.Errorf("Expected error for case %d (%v), got %v", i, tc.Name, got)
+			} else if e, ok := err.(*exec.Error); !ok || e.Name != tc.Name {
+				t.Errorf("Unexpected error for case %d (%v): %v", i, tc.Name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for case %d (%v): %v", i, tc.Name, err)
+		} else if got != tc.Expected {
+			t.Errorf("Unexpected path for case %d (%v): got %v want %v", i, tc.Name, got, tc.Expected)
+		}
+	}
+}
+
+func TestCommandNotFound(t *testing.T) {
+	oldpath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldpath)
+	os.Setenv("PATH", "/nonexistent")
+
+	cases := []struct {
+		Cmd      Command
+		Expected string
+	}{
+		{"goshnotacommand foo", "gosh: goshnotacommand: command not found"},
+		{"/nonexistent/goshnotacommand", "gosh: /nonexistent/goshnotacommand: No such file or directory"},
+	}
+	for i, tc := range cases {
+		os.Setenv("?", "0")
+		err := tc.Cmd.HandleCmd()
+		if err == nil || err.Error() != tc.Expected {
+			t.Errorf("Unexpected error for case %d: got %v want %v", i, err, tc.Expected)
+		}
+		if cerr, ok := err.(*CommandError); !ok || cerr.Status != 127 {
+			t.Errorf("Unexpected error type for case %d: %#v", i, err)
+		}
+		if status := os.Getenv("?"); status != "127" {
+			t.Errorf("Unexpected $? for case %d: got %v want 127", i, status)
+		}
+	}
+}
+
+func TestCommandNotExecutable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshnoexec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	noexec := filepath.Join(dir, "goshnoexec")
+	if err := ioutil.WriteFile(noexec, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	subdir := filepath.Join(dir, "subdir")
+	if err := os.Mkdir(subdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	oldpath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldpath)
+	os.Setenv("PATH", dir)
+
+	cases := []struct {
+		Cmd      Command
+		Expected string
+		Status   string
+	}{
+		{Command(noexec), "gosh: " + noexec + ": Permission denied", "126"},
+		{"goshnoexec", "gosh: goshnoexec: Permission denied", "126"},
+		{Command(subdir), "gosh: " + subdir + ": Is a directory", "126"},
+		{"goshnotacommand", "gosh: goshnotacommand: command not found", "127"},
+		{Command(filepath.Join(dir, "goshnotacommand")), "gosh: " + filepath.Join(dir, "goshnotacommand") + ": No such file or directory", "127"},
+	}
+	for i, tc := range cases {
+		os.Setenv("?", "0")
+		err := tc.Cmd.HandleCmd()
+		if err == nil || err.Error() != tc.Expected {
+			t.Errorf("Unexpected error for case %d: got %v want %v", i, err, tc.Expected)
+		}
+		if status := os.Getenv("?"); status != tc.Status {
+			t.Errorf("Unexpected $? for case %d: got %v want %v", i, status, tc.Status)
+		}
+	}
+}
+
+func TestExecNotExecutable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshnoexec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "goshnoexec"), []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldpath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldpath)
+	os.Setenv("PATH", dir)
+
+	cases := []struct {
+		Cmd      Command
+		Expected string
+		Status   string
+	}{
+		{"exec goshnoexec", "gosh: goshnoexec: Permission denied", "126"},
+		{Command("exec " + dir), "gosh: " + dir + ": Is a directory", "126"},
+		{"exec goshnotacommand", "gosh: goshnotacommand: command not found", "127"},
+	}
+	for i, tc := range cases {
+		os.Setenv("?", "0")
+		err := tc.Cmd.HandleCmd()
+		if err == nil || err.Error() != tc.Expected {
+			t.Errorf("Unexpected error for case %d: got %v want %v", i, err, tc.Expected)
+		}
+		if status := os.Getenv("?"); status != tc.Status {
+			t.Errorf("Unexpected $? for case %d: got %v want %v", i, status, tc.Status)
+		}
+	}
+}
+
+func TestScriptWithoutInterpreter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshscript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "script")
+	if err := ioutil.WriteFile(script, []byte("tr a-z A-Z\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+
+	oldshell := scriptShell
+	defer func() { scriptShell = oldshell }()
+	var ran bool
+	scriptShell = func() (string, error) {
+		ran = true
+		return "/bin/sh", nil
+	}
+
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	if err := Command("echo hello | " + script + " | cat > " + out).Run(child); err != nil {
+		t.Fatal(err)
+	}
+	if !ran {
+		t.Error("Script was not run with the shell")
+	}
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "HELLO\n" {
+		t.Errorf("Unexpected output: got %q want %q", got, "HELLO\n")
+	}
+}
+
+func TestPrintPromptNonInteractive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshprompt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "prompted")
+
+	oldprompt, oldcaps := os.Getenv("PROMPT"), caps
+	defer func() {
+		os.Setenv("PROMPT", oldprompt)
+		caps = oldcaps
+	}()
+	os.Setenv("PROMPT", "!touch "+marker)
+
+	cases := []struct {
+		Interactive bool
+		Sourcing    int
+		Expected    bool
+	}{
+		{false, 0, false},
+		{true, 1, false},
+		{true, 0, true},
+	}
+	for i, tc := range cases {
+		os.Remove(marker)
+		caps.Interactive = tc.Interactive
+		sourcing = tc.Sourcing
+		PrintPrompt()
+		sourcing = 0
+		if _, err := os.Stat(marker); (err == nil) != tc.Expected {
+			t.Errorf("Unexpected prompt for case %d: got %v want %v", i, err == nil, tc.Expected)
+		}
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	cases := []struct {
+		Input    string
+		Expected []string
+	}{
+		{"ls\npwd\n", []string{"ls\n", "pwd\n"}},
+		{"ls\npwd", []string{"ls\n", "pwd"}},
+		{"echo 'one\ntwo'\nls\n", []string{"echo 'one\ntwo'\n", "ls\n"}},
+		{"echo \"a \\\" b\nc\"\n", []string{"echo \"a \\\" b\nc\"\n"}},
+		{"echo \"it's\"\nls\n", []string{"echo \"it's\"\n", "ls\n"}},
+		{"echo 'unterminated\n", []string{"echo 'unterminated\n"}},
+	}
+	for i, tc := range cases {
+		r := bufio.NewReader(strings.NewReader(tc.Input))
+		var got []string
+		for {
+			cmd, err := readCommand(r)
+			if cmd != "" {
+				got = append(got, cmd)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if strings.Join(got, "|") != strings.Join(tc.Expected, "|") {
+			t.Errorf("Unexpected commands for case %d: got %q want %q", i, got, tc.Expected)
+		}
+	}
+}
+
+func TestSourceFileMultiLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshsource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out, script := filepath.Join(dir, "out"), filepath.Join(dir, "script")
+	source := "set GOSHSOURCEA \"one\ntwo\"\n" +
+		"echo hello > " + out + "\n" +
+		"set GOSHSOURCEB done"
+	if err := ioutil.WriteFile(script, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("GOSHSOURCEA")
+	defer os.Unsetenv("GOSHSOURCEB")
+
+	if err := SourceFile(script); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("GOSHSOURCEA"); got != "one\ntwo" {
+		t.Errorf("Unexpected multi-line value: got %q", got)
+	}
+	if got, _ := ioutil.ReadFile(out); string(got) != "hello\n" {
+		t.Errorf("Unexpected output from external command: got %q", got)
+	}
+	if got := os.Getenv("GOSHSOURCEB"); got != "done" {
+		t.Errorf("Command after external command didn't run: got %q", got)
+	}
+}
+
+func TestSourceReader(t *testing.T) {
+	defer os.Unsetenv("GOSHSOURCED")
+	defer os.Unsetenv("GOSHSOURCED2")
+	r := strings.NewReader("set GOSHSOURCED one\nset GOSHSOURCED2 $GOSHSOURCED-two")
+	if err := sourceReader(r, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("GOSHSOURCED"); got != "one" {
+		t.Errorf("Unexpected value: got %q want one", got)
+	}
+	if got := os.Getenv("GOSHSOURCED2"); got != "one-two" {
+		t.Errorf("Unexpected value: got %q want one-two", got)
+	}
+	if sourcing != 0 {
+		t.Errorf("Still sourcing after sourceReader returned: %v", sourcing)
+	}
+
+	dir, err := ioutil.TempDir("", "goshsourcestdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "in")
+	if err := ioutil.WriteFile(in, []byte("set GOSHSOURCED three\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Command("source - < " + in).HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("GOSHSOURCED"); got != "three" {
+		t.Errorf("Unexpected value from source -: got %q want three", got)
+	}
+}
+
+func TestSourceReaderErrors(t *testing.T) {
+	defer os.Unsetenv("GOSHSOURCEA")
+	defer os.Unsetenv("GOSHSOURCEB")
+	cases := []struct {
+		Input string
+		Err   string
+		A, B  string
+	}{
+		{"set GOSHSOURCEA a\nset GOSHSOURCEB b\n", "", "a", "b"},
+		{"set GOSHSOURCEA a\nset GOSHSOURCEB b", "", "a", "b"},
+		{"", "", "", ""},
+		{"\n\n# comment\n", "", "", ""},
+		{"set GOSHSOURCEA a\nset\nset GOSHSOURCEB b\n", "test:2: Usage: set var value", "a", ""},
+		{"set GOSHSOURCEA 'a\nb'\n\nset GOSHSOURCEB\n", "test:4: Usage: set var value", "a\nb", ""},
+		{"set GOSHSOURCEA a\nset GOSHSOURCEB 'b\n", "test:2: incomplete command", "a", ""},
+		{"set GOSHSOURCEA a\n{ a; ) \n", "test:2: syntax error near unexpected token ')'", "a", ""},
+	}
+	for i, tc := range cases {
+		os.Unsetenv("GOSHSOURCEA")
+		os.Unsetenv("GOSHSOURCEB")
+		err := sourceReader(strings.NewReader(tc.Input), "test")
+		if (err == nil && tc.Err != "") || (err != nil && err.Error() != tc.Err) {
+			t.Errorf("Unexpected error for case %d: got %v want %v", i, err, tc.Err)
+		}
+		if a, b := os.Getenv("GOSHSOURCEA"), os.Getenv("GOSHSOURCEB"); a != tc.A || b != tc.B {
+			t.Errorf("Unexpected values for case %d: got %q, %q want %q, %q", i, a, b, tc.A, tc.B)
+		}
+	}
+}
+
+func TestSourceBuiltinErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshsource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	defer os.Setenv("?", os.Getenv("?"))
+
+	cases := []struct {
+		Script string
+		Err    string
+		Status string
+	}{
+		{"true\n{ a; ) \n", ":2: syntax error near unexpected token ')'", "1"},
+		{"true\ngoshnotacommand\n", ":2: gosh: goshnotacommand: command not found", "127"},
+		{"true\n", "", "0"},
+	}
+	for i, tc := range cases {
+		script := filepath.Join(dir, "script")
+		if err := ioutil.WriteFile(script, []byte(tc.Script), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []Command{Command("source " + script), Command("source - < " + script)} {
+			os.Setenv("?", "")
+			err := c.Run(child)
+			if (err == nil && tc.Err != "") || (err != nil && (tc.Err == "" || !strings.HasSuffix(err.Error(), tc.Err))) {
+				t.Errorf("Unexpected error for case %d (%v): got %v want %v", i, c, err, tc.Err)
+			}
+			if got := os.Getenv("?"); got != tc.Status {
+				t.Errorf("Unexpected $? for case %d (%v): got %q want %q", i, c, got, tc.Status)
+			}
+		}
+	}
+}
@@ -1,21 +1,68 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
-var autocompletions map[*regexp.Regexp][]Token
+// An autocompletion is a rule added by the autocomplete builtin.
+type autocompletion struct {
+	Regexp      *regexp.Regexp
+	Suggestions []Token
+	// Position is the argument position that the rule is restricted
+	// to, or -1 if it applies to any position.
+	Position int
+}
+
+// autocompletions is the rules added by the autocomplete builtin, in the
+// order that they were added.
+var autocompletions []*autocompletion
+
+// helpFlags is the flags found in the --help output of each command.
+var helpFlags = make(map[string][]string)
+
+// helpFlagRe matches a flag in the --help output of a command.
+var helpFlagRe = regexp.MustCompile(`(?m)(?:^|[\s,\[(])(--?[[:alnum:]][-[:alnum:]_]*)`)
+
+// helpTimeout is how long to wait for the --help output of a command.
+var helpTimeout = 2 * time.Second
+
+// completionLine is the command line that the completion key last left
+// ambiguous, and completionPending is whether it was the last key pressed.
+var (
+	completionLine    Command
+	completionPending bool
+)
+
+// menu is the completion menu being gone through, if any.
+var menu *completionMenu
 
-func (c *Command) Complete() error {
+// Suggestions returns the possible completions for c. psuggestions are
+// completions of the partially typed last token base, while wsuggestions
+// are new tokens to add to the end of the command.
+func (c Command) Suggestions() (psuggestions, wsuggestions []string, base string) {
 	tokens := c.Tokenize()
-	var psuggestions, wsuggestions []string
-	var base string
+
+	if target, ok := redirectTarget(c, tokens); ok {
+		base = target
+		if target == "" {
+			target = "./"
+		}
+		psuggestions = FileSuggestions(target)
+		return
+	}
 
 	var firstpart string
 	if len(tokens) > 0 {
@@ -24,8 +71,14 @@ func (c *Command) Complete() error {
 	}
 	wholecmd := strings.Join(tokens, " ")
 
-	for re, resuggestions := range autocompletions {
-		if matches := re.FindStringSubmatch(firstpart); matches != nil {
+	// matched is whether any rule applied to the command, even if it
+	// didn't have any suggestions.
+	var matched bool
+	for _, rule := range autocompletions {
+		re, resuggestions, position := rule.Regexp, rule.Suggestions, rule.Position
+		anchored := position >= 0
+		if matches := re.FindStringSubmatch(firstpart); matches != nil && (!anchored || position == len(tokens)-1) {
+			matched = true
 			for _, val := range resuggestions {
 				for n, match := range matches {
 					val = Token(strings.Replace(string(val), fmt.Sprintf(`\%d`, n), match, -1))
@@ -44,12 +97,17 @@ func (c *Command) Complete() error {
 						println(err.Error())
 						continue
 					}
-					sugs := strings.Split(string(out), "\n")
-					for _, val := range sugs {
+					for _, val := range splitFields(string(out)) {
 						if val != base && strings.HasPrefix(val, base) {
 							psuggestions = append(psuggestions, val)
 						}
 					}
+				} else if len(val) > 1 && val[0] == '@' {
+					for _, word := range wordListFile(string(val[1:])) {
+						if word != base && strings.HasPrefix(word, base) {
+							psuggestions = append(psuggestions, word)
+						}
+					}
 				} else if string(val) != base && strings.HasPrefix(string(val), base) {
 					psuggestions = append(psuggestions, string(val))
 				}
@@ -60,7 +118,8 @@ func (c *Command) Complete() error {
 			continue
 		}
 
-		if matches := re.FindStringSubmatch(wholecmd); matches != nil {
+		if matches := re.FindStringSubmatch(wholecmd); matches != nil && (!anchored || position == len(tokens)) {
+			matched = true
 			for _, val := range resuggestions {
 				for n, match := range matches {
 					val = Token(strings.Replace(string(val), fmt.Sprintf(`\%d`, n), match, -1))
@@ -77,12 +136,13 @@ func (c *Command) Complete() error {
 						println(err.Error())
 						continue
 					}
-					sugs := strings.Split(string(out), "\n")
-					for _, val := range sugs {
+					for _, val := range splitFields(string(out)) {
 						if val != base {
 							wsuggestions = append(wsuggestions, val)
 						}
 					}
+				} else if len(val) > 1 && val[0] == '@' {
+					wsuggestions = append(wsuggestions, wordListFile(string(val[1:]))...)
 				} else {
 					// There was no last token, to take the prefix of, so
 					// just suggest the whole val.
@@ -91,11 +151,19 @@ func (c *Command) Complete() error {
 			}
 		}
 	}
+	psuggestions = uniqueSuggestions(psuggestions)
+	wsuggestions = uniqueSuggestions(wsuggestions)
+	if !matched && len(psuggestions) == 0 && len(wsuggestions) == 0 && strings.HasSuffix(string(c), " ") {
+		if targets, ok := TargetSuggestions(append(tokens, ""), ""); ok {
+			wsuggestions = targets
+		}
+	}
 	if len(psuggestions) > 0 {
 		wsuggestions = nil
-		goto foundSuggestions
-	} else if len(wsuggestions) > 0 {
-		goto foundSuggestions
+		return
+	} else if len(wsuggestions) > 0 || matched {
+		// A rule applied, so the generic suggestions don't.
+		return
 	}
 
 	switch len(tokens) {
@@ -107,68 +175,102 @@ func (c *Command) Complete() error {
 		psuggestions = CommandSuggestions(base)
 	default:
 		base = tokens[len(tokens)-1]
-		psuggestions = FileSuggestions(base)
+		if os.Getenv("COMPLETION_REMOTE") == "on" && isRemotePath(base) {
+			psuggestions = RemoteSuggestions(base)
+		} else if isUserPath(base) {
+			psuggestions = UserSuggestions(base)
+		} else if isVariablePrefix(base) {
+			psuggestions = VariableSuggestions(base)
+		} else if tokens[0] == "cd" && len(tokens) == 2 {
+			psuggestions = CdSuggestions(base)
+		} else if os.Getenv("COMPLETION_FLAGS") == "on" && strings.HasPrefix(base, "-") {
+			psuggestions = FlagSuggestions(tokens[0], base)
+		} else if targets, _ := TargetSuggestions(tokens, base); len(targets) > 0 && !strings.HasPrefix(base, "-") {
+			psuggestions = targets
+		} else if psuggestions = FileSuggestions(base); len(psuggestions) == 0 {
+			psuggestions = delimitedFileSuggestions(base)
+		}
 	}
+	return
+}
 
-foundSuggestions:
-	switch len(psuggestions) + len(wsuggestions) {
+// CompleteInsert completes as much of the command as is unambiguous. If
+// there's more than one possible completion, it displays them when it's
+// called again right away.
+func (c *Command) CompleteInsert() error {
+	if os.Getenv("COMPLETION_MENU") == "on" && menu != nil && *c == menu.shown {
+		*c, _ = applyEdit(*c, len([]rune(string(*c))), replaceLine(menu.Next(1)))
+		return nil
+	}
+	suggestions, base := Completions(string(*c), len([]rune(string(*c))))
+	switch len(suggestions) {
 	case 0:
 		// Print BEL to warn that there were no suggestions.
-		fmt.Printf("\u0007")
+		fmt.Fprintf(screen, "\u0007")
 	case 1:
-		if len(psuggestions) == 1 {
-			suggest := psuggestions[0]
-			*c = Command(strings.TrimSpace(string(*c)))
-			*c = Command(strings.TrimSuffix(string(*c), base))
-			*c += Command(suggest)
-
-			PrintPrompt()
-			fmt.Printf("%s", *c)
-		} else {
-			suggest := wsuggestions[0]
-			*c = Command(strings.TrimSpace(string(*c)))
-			*c += Command(suggest)
-
-			PrintPrompt()
-			fmt.Printf("%s", *c)
-		}
+		c.insertCompletion(base, suggestions[0])
+		redrawLine(*c)
 	default:
-		suggestions := append(psuggestions, wsuggestions...)
-
-		if len(wsuggestions) == 0 {
-			suggest := LongestPrefix(suggestions)
-			*c = Command(strings.TrimSpace(string(*c)))
-			*c = Command(strings.TrimSuffix(string(*c), base))
-			*c += Command(suggest)
+		if os.Getenv("COMPLETION_MENU") == "on" {
+			menu = newCompletionMenu(*c, base, suggestions)
+			*c, _ = applyEdit(*c, len([]rune(string(*c))), replaceLine(menu.Next(1)))
+			return nil
 		}
-		fmt.Printf("\n[")
-		for i, s := range suggestions {
-			if strings.ContainsAny(s, " \t") {
-				fmt.Printf(`"%v"`, s)
-			} else {
-				fmt.Printf("%v", s)
-			}
-			if i != len(suggestions)-1 {
-				fmt.Printf(" ")
-			}
+		if completionPending && *c == completionLine {
+			c.displaySuggestions(suggestions)
+			return nil
 		}
-		fmt.Printf("]\n")
+		old := *c
+		if prefix := LongestPrefix(suggestions); len(prefix) > len(base) {
+			c.insertCompletion(base, prefix)
+		}
+		if strings.HasPrefix(string(*c), string(old)) {
+			fmt.Fprintf(screen, "%s", strings.TrimPrefix(string(*c), string(old)))
+		} else {
+			redrawLine(*c)
+		}
+		// Ring the bell to say that it's still ambiguous.
+		fmt.Fprintf(screen, "\u0007")
+		completionLine, completionPending = *c, true
+	}
+	return nil
+}
 
-		PrintPrompt()
-		fmt.Printf("%s", *c)
+// CompleteList displays the possible completions of the command without
+// changing it.
+func (c *Command) CompleteList() error {
+	suggestions, _ := Completions(string(*c), len([]rune(string(*c))))
+	if len(suggestions) == 0 {
+		// Print BEL to warn that there were no suggestions.
+		fmt.Fprintf(screen, "\u0007")
+		return nil
 	}
+	c.displaySuggestions(suggestions)
 	return nil
 }
 
 func CommandSuggestions(base string) []string {
-	paths := strings.Split(os.Getenv("PATH"), ":")
 	var matches []string
-	for _, path := range paths {
+	seen := make(map[string]bool)
+	for _, b := range builtins {
+		if name := b.Name; strings.HasPrefix(name, base) && !seen[name] {
+			seen[name] = true
+			matches = append(matches, name)
+		}
+	}
+	for name := range aliases {
+		if strings.HasPrefix(name, base) && !seen[name] {
+			seen[name] = true
+			matches = append(matches, name)
+		}
+	}
+	for _, path := range pathDirs() {
 		// We don't care if there's an invalid path in $PATH, so ignore
 		// the error.
 		files, _ := ioutil.ReadDir(path)
 		for _, file := range files {
-			if name := file.Name(); strings.HasPrefix(name, base) {
+			if name := file.Name(); strings.HasPrefix(name, base) && !seen[name] {
+				seen[name] = true
 				matches = append(matches, name)
 			}
 		}
@@ -177,6 +279,178 @@ func CommandSuggestions(base string) []string {
 }
 
 func FileSuggestions(base string) []string {
+	matches := prefixFileSuggestions(base)
+	if len(matches) == 0 && os.Getenv("COMPLETION_ABBREVIATED") == "on" {
+		return abbreviatedFileSuggestions(base)
+	}
+	return matches
+}
+
+// shouldPromptCompletions returns whether the user should be asked before
+// displaying count suggestions, given the value of $COMPLETION_QUERY_ITEMS.
+func shouldPromptCompletions(count int, option string) bool {
+	threshold := 100
+	if n, err := strconv.Atoi(option); err == nil {
+		threshold = n
+	}
+	if threshold < 0 {
+		return false
+	}
+	return count >= threshold
+}
+
+// displaySuggestions displays suggestions below the current line, and then
+// redraws the prompt.
+func (c Command) displaySuggestions(suggestions []string) {
+	if shouldPromptCompletions(len(suggestions), os.Getenv("COMPLETION_QUERY_ITEMS")) {
+		fmt.Fprintf(screen, "\nDisplay all %d possibilities? (y or n)", len(suggestions))
+		flushScreen()
+		if answer, _, err := input.ReadRune(); err != nil || (answer != 'y' && answer != 'Y') {
+			fmt.Fprintf(screen, "\n")
+			redrawLine(c)
+			return
+		}
+		fmt.Fprintf(screen, "\n")
+	}
+
+	colors := completionColors()
+	display := make([]string, 0, len(suggestions))
+	for _, s := range suggestions {
+		d := s
+		if strings.ContainsAny(s, " \t") {
+			d = `"` + s + `"`
+		}
+		if colors != nil {
+			if fi, err := os.Lstat(replaceTilde(s)); err == nil {
+				if code := fileColor(fi.Mode(), colors); code != "" {
+					d = "\033[" + code + "m" + d + "\033[0m"
+				}
+			}
+		}
+		display = append(display, d)
+	}
+	fmt.Fprintf(screen, "\n%s", formatColumns(display, TerminalWidth()))
+	redrawLine(c)
+}
+
+// uniqueSuggestions returns suggestions without any duplicates or empty
+// strings.
+func uniqueSuggestions(suggestions []string) []string {
+	var unique []string
+	seen := make(map[string]bool)
+	for _, s := range suggestions {
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+		unique = append(unique, s)
+	}
+	return unique
+}
+
+// insertCompletion replaces the partially typed token typed at the end of c
+// with completion. If typed is empty, completion is added as a new token.
+func (c *Command) insertCompletion(typed, completion string) {
+	cmd := strings.TrimSpace(string(*c))
+	if typed != "" {
+		cmd = strings.TrimSuffix(cmd, typed)
+	} else if cmd != "" {
+		cmd += " "
+	}
+	*c = Command(cmd + completion)
+}
+
+// passwdFile is the file that usernames are read from for completion.
+var passwdFile = "/etc/passwd"
+
+// isUserPath returns true if base is a ~user token that hasn't gotten to
+// the path after the username yet.
+func isUserPath(base string) bool {
+	return strings.HasPrefix(base, "~") && !strings.Contains(base, "/")
+}
+
+// UserSuggestions returns the suggestions for the ~user token base.
+func UserSuggestions(base string) []string {
+	contents, err := ioutil.ReadFile(passwdFile)
+	if err != nil {
+		return nil
+	}
+	prefix := strings.TrimPrefix(base, "~")
+	var matches []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := strings.SplitN(line, ":", 2)[0]
+		if strings.HasPrefix(name, prefix) {
+			matches = append(matches, "~"+name+"/")
+		}
+	}
+	return uniqueSuggestions(matches)
+}
+
+// pathDirs returns the directories in $PATH, with empty entries replaced
+// by the current directory.
+func pathDirs() []string {
+	dirs := filepath.SplitList(os.Getenv("PATH"))
+	for i, dir := range dirs {
+		if dir == "" {
+			dirs[i] = "."
+		}
+	}
+	return dirs
+}
+
+// wordList is the cached contents of a file of completion words.
+type wordList struct {
+	ModTime time.Time
+	Size    int64
+	Words   []string
+}
+
+// wordLists is the word list files that have been read, by name.
+var wordLists = make(map[string]wordList)
+
+// wordListFile returns the non-empty lines of the file name, which are
+// cached until the file changes.
+func wordListFile(name string) []string {
+	name = replaceTilde(name)
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil
+	}
+	if cached, ok := wordLists[name]; ok && cached.ModTime.Equal(info.ModTime()) && cached.Size == info.Size() {
+		return cached.Words
+	}
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+	var words []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			words = append(words, line)
+		}
+	}
+	wordLists[name] = wordList{info.ModTime(), info.Size(), words}
+	return words
+}
+
+// splitFields splits s into fields on the characters in $IFS, or on
+// whitespace if $IFS isn't set. Empty fields are skipped.
+func splitFields(s string) []string {
+	ifs, ok := os.LookupEnv("IFS")
+	if !ok {
+		return strings.Fields(s)
+	}
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return strings.ContainsRune(ifs, r)
+	})
+}
+
+// prefixFileSuggestions returns the files which start with the last
+// component of the path base.
+func prefixFileSuggestions(base string) []string {
 	base = replaceTilde(base)
 	if files, err := ioutil.ReadDir(base); err == nil {
 		// This was a directory, so use the empty string as a prefix.
@@ -206,3 +480,442 @@ func FileSuggestions(base string) []string {
 	}
 	return matches
 }
+
+// abbreviatedFileSuggestions returns the paths where each component of
+// base is a prefix of the corresponding component of the path.
+func abbreviatedFileSuggestions(base string) []string {
+	base = replaceTilde(base)
+	if !strings.Contains(base, "/") {
+		return nil
+	}
+	dirs := []string{""}
+	if filepath.IsAbs(base) {
+		dirs = []string{"/"}
+	}
+	components := strings.Split(strings.TrimPrefix(base, "/"), "/")
+	for i, component := range components {
+		last := i == len(components)-1
+		var matches []string
+		for _, dir := range dirs {
+			if !last {
+				if component == "" {
+					matches = append(matches, dir)
+					continue
+				}
+				exact := filepath.Join(dir, component)
+				if fi, err := os.Stat(exact); err == nil && fi.IsDir() {
+					matches = append(matches, exact)
+					continue
+				}
+			}
+			readdir := dir
+			if readdir == "" {
+				readdir = "."
+			}
+			files, err := ioutil.ReadDir(readdir)
+			if err != nil {
+				continue
+			}
+			for _, file := range files {
+				name := file.Name()
+				if !strings.HasPrefix(name, component) {
+					continue
+				}
+				path := filepath.Join(dir, name)
+				if !last {
+					if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+						continue
+					}
+				}
+				matches = append(matches, path)
+			}
+		}
+		dirs = matches
+	}
+	return dirs
+}
+
+// redirectTarget returns the partially typed file name that c is
+// redirecting to or from, if the last token being typed follows a
+// redirection.
+func redirectTarget(c Command, tokens []string) (string, bool) {
+	if len(tokens) == 0 {
+		return "", false
+	}
+	isFileRedirect := func(t string) bool {
+		_, op, ok := Token(t).Redirection()
+		return ok && op != ">&"
+	}
+	last := tokens[len(tokens)-1]
+	if isFileRedirect(last) {
+		// Nothing has been typed after the operator yet.
+		return "", true
+	}
+	if len(tokens) > 1 && isFileRedirect(tokens[len(tokens)-2]) && !strings.HasSuffix(string(c), " ") {
+		return last, true
+	}
+	return "", false
+}
+
+// cdpathDirs returns the directories that a relative dir given to cd is
+// looked for in, in order.
+func cdpathDirs(dir string) []string {
+	if filepath.IsAbs(dir) || dir == "." || dir == ".." || strings.HasPrefix(dir, "./") || strings.HasPrefix(dir, "../") {
+		return []string{""}
+	}
+	cdpath := os.Getenv("CDPATH")
+	if cdpath == "" {
+		return []string{""}
+	}
+	var dirs []string
+	for _, d := range filepath.SplitList(cdpath) {
+		if d == "." {
+			d = ""
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs
+}
+
+// resolveCd returns the directory that cd dir changes to, and whether it
+// was found in $CDPATH instead of the current directory.
+func resolveCd(dir string) (string, bool) {
+	for _, d := range cdpathDirs(dir) {
+		path := filepath.Join(d, dir)
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			return path, d != ""
+		}
+	}
+	return dir, false
+}
+
+// CdSuggestions returns the directories that base could be completed to as
+// the argument to cd.
+func CdSuggestions(base string) []string {
+	var suggestions []string
+	for _, d := range cdpathDirs(base) {
+		for _, s := range FileSuggestions(filepath.Join(d, base)) {
+			if fi, err := os.Stat(replaceTilde(s)); err != nil || !fi.IsDir() {
+				continue
+			}
+			if d != "" {
+				s = strings.TrimPrefix(s, filepath.Clean(d)+"/")
+			}
+			suggestions = append(suggestions, s)
+		}
+	}
+	return uniqueSuggestions(suggestions)
+}
+
+// FlagSuggestions returns the flags that the command cmd takes which start
+// with base.
+func FlagSuggestions(cmd, base string) []string {
+	flags, ok := helpFlags[cmd]
+	if !ok {
+		flags = parseHelpFlags(helpOutput(cmd))
+		helpFlags[cmd] = flags
+	}
+	var suggestions []string
+	for _, flag := range flags {
+		if strings.HasPrefix(flag, base) {
+			suggestions = append(suggestions, flag)
+		}
+	}
+	return suggestions
+}
+
+// helpOutput returns what the command cmd prints for --help.
+func helpOutput(cmd string) string {
+	path, err := resolveCommand(cmd)
+	if err != nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), helpTimeout)
+	defer cancel()
+	out, _ := exec.CommandContext(ctx, path, "--help").CombinedOutput()
+	return string(out)
+}
+
+// parseHelpFlags returns the flags mentioned in help, sorted.
+func parseHelpFlags(help string) []string {
+	var flags []string
+	for _, match := range helpFlagRe.FindAllStringSubmatch(help, -1) {
+		flags = append(flags, match[1])
+	}
+	sort.Strings(flags)
+	return uniqueSuggestions(flags)
+}
+
+// removeAutocompletions implements autocomplete -d and autocomplete -c.
+func removeAutocompletions(args []string) error {
+	switch {
+	case args[0] == "-c" && len(args) == 1:
+		autocompletions = nil
+		return nil
+	case args[0] == "-d" && len(args) > 1:
+		for _, pattern := range args[1:] {
+			found := false
+			var kept []*autocompletion
+			for _, rule := range autocompletions {
+				if rule.Regexp.String() == pattern {
+					found = true
+					continue
+				}
+				kept = append(kept, rule)
+			}
+			autocompletions = kept
+			if !found {
+				return builtinError(ErrNotFound, "autocomplete: %s: no such rule", pattern)
+			}
+		}
+		return nil
+	}
+	return builtinError(ErrUsage, "Usage: autocomplete -d regex [regexes...] | autocomplete -c")
+}
+
+// Compgen prints the completions for the partial command in args to w.
+func Compgen(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return builtinError(ErrUsage, "Usage: compgen command")
+	}
+	psuggestions, wsuggestions, _ := Command(strings.Join(args, " ")).Suggestions()
+	suggestions := uniqueSuggestions(append(psuggestions, wsuggestions...))
+	sort.Strings(suggestions)
+	for _, s := range suggestions {
+		fmt.Fprintln(w, s)
+	}
+	return nil
+}
+
+// redrawLine prints the prompt followed by the command line c.
+func redrawLine(c Command) {
+	PrintPrompt()
+	fmt.Fprintf(screen, "%s", c)
+	if width, ok := promptWidth(); ok {
+		if row, col := cursorPosition(width, c, len([]rune(string(c))), TerminalWidth()); row > 0 && col == 0 {
+			fmt.Fprintf(screen, " \r")
+		}
+	}
+}
+
+// A completionMenu cycles through the possible completions of a word on the
+// command line.
+type completionMenu struct {
+	// line is the command line before anything was completed, and typed is
+	// the partially typed word in it that's being completed.
+	line  Command
+	typed string
+
+	suggestions []string
+	// selected is the position in suggestions of the completion on the
+	// command line, or -1 before the first one.
+	selected int
+	// shown is the command line with the selected completion.
+	shown Command
+}
+
+// newCompletionMenu returns a menu of suggestions for completing typed at
+// the end of line.
+func newCompletionMenu(line Command, typed string, suggestions []string) *completionMenu {
+	return &completionMenu{
+		line:        line,
+		typed:       typed,
+		suggestions: suggestions,
+		selected:    -1,
+	}
+}
+
+// Next selects the completion n after the currently selected one, going
+// around at either end, and returns the command line with it.
+func (m *completionMenu) Next(n int) Command {
+	if m.selected < 0 && n < 0 {
+		// Going backwards starts at the last one.
+		m.selected = 0
+	}
+	count := len(m.suggestions)
+	m.selected = ((m.selected+n)%count + count) % count
+	c := m.line
+	c.insertCompletion(m.typed, m.suggestions[m.selected])
+	m.shown = c
+	return c
+}
+
+// Completions returns the sorted completions of line up to the position
+// cursor, in runes, and the word before the cursor that they replace.
+func Completions(line string, cursor int) ([]string, string) {
+	runes := []rune(line)
+	if cursor > len(runes) {
+		cursor = len(runes)
+	}
+	psuggestions, wsuggestions, base := Command(runes[:cursor]).Suggestions()
+	if len(psuggestions) == 0 {
+		base = ""
+	}
+	suggestions := uniqueSuggestions(append(psuggestions, wsuggestions...))
+	sort.Strings(suggestions)
+	return suggestions, base
+}
+
+// isVariablePrefix returns true if base is the start of a $NAME or ${NAME}
+// variable.
+func isVariablePrefix(base string) bool {
+	_, name, _ := splitVariablePrefix(base)
+	return strings.HasPrefix(base, "$") && (name == "" || isName(name))
+}
+
+// splitVariablePrefix splits the variable base into the part before the
+// name, the name, and what goes after the name once it's complete.
+func splitVariablePrefix(base string) (prefix, name, suffix string) {
+	if strings.HasPrefix(base, "${") {
+		return "${", base[2:], "}"
+	}
+	return "$", strings.TrimPrefix(base, "$"), ""
+}
+
+// VariableSuggestions returns the suggestions for the variable base.
+func VariableSuggestions(base string) []string {
+	prefix, name, suffix := splitVariablePrefix(base)
+	var matches []string
+	for _, v := range os.Environ() {
+		if eq := strings.Index(v, "="); eq > 0 && strings.HasPrefix(v[:eq], name) && isName(v[:eq]) {
+			matches = append(matches, prefix+v[:eq]+suffix)
+		}
+	}
+	return matches
+}
+
+// containsToken returns true if t is one of tokens.
+func containsToken(tokens []Token, t Token) bool {
+	for _, token := range tokens {
+		if token == t {
+			return true
+		}
+	}
+	return false
+}
+
+// A targetFile is a file in the current directory that defines the names
+// that a command takes as arguments, like a Makefile.
+type targetFile struct {
+	// Command is the start of the command line that the names are
+	// arguments to.
+	Command []string
+	// Names is the names that the file can have, in the order that the
+	// command looks for them.
+	Names []string
+	// Parse returns the names defined in contents.
+	Parse func(contents []byte) []string
+}
+
+// targetFiles is the kinds of files that arguments are completed from.
+var targetFiles = []targetFile{
+	{[]string{"make"}, []string{"GNUmakefile", "makefile", "Makefile"}, makeTargets},
+	{[]string{"npm", "run"}, []string{"package.json"}, packageScripts},
+	{[]string{"yarn", "run"}, []string{"package.json"}, packageScripts},
+}
+
+// makeRule matches the targets of a rule in a Makefile.
+var makeRule = regexp.MustCompile(`^([^\s:=#][^:=#]*)::?(?:[^=]|$)`)
+
+// makeTargets returns the targets of the rules in the Makefile contents.
+func makeTargets(contents []byte) []string {
+	var targets []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		matches := makeRule.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+		for _, t := range strings.Fields(matches[1]) {
+			if !strings.HasPrefix(t, ".") && !strings.ContainsAny(t, "%$") {
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets
+}
+
+// packageScripts returns the names of the scripts in the package.json
+// contents.
+func packageScripts(contents []byte) []string {
+	var pkg struct {
+		Scripts map[string]string
+	}
+	if err := json.Unmarshal(contents, &pkg); err != nil {
+		return nil
+	}
+	var scripts []string
+	for name := range pkg.Scripts {
+		scripts = append(scripts, name)
+	}
+	return scripts
+}
+
+// targetLists is the names found in the target files that have been read,
+// by path.
+var targetLists = make(map[string]wordList)
+
+// TargetSuggestions returns the suggestions for base from the target file
+// for the command in tokens, and whether there was one.
+func TargetSuggestions(tokens []string, base string) ([]string, bool) {
+	for _, tf := range targetFiles {
+		if len(tokens) <= len(tf.Command) || !reflect.DeepEqual(tokens[:len(tf.Command)], tf.Command) {
+			continue
+		}
+		for _, name := range tf.Names {
+			targets, ok := tf.targets(name)
+			if !ok {
+				continue
+			}
+			var suggestions []string
+			for _, t := range targets {
+				if strings.HasPrefix(t, base) {
+					suggestions = append(suggestions, t)
+				}
+			}
+			return suggestions, true
+		}
+	}
+	return nil, false
+}
+
+// targets returns the names in the file name, and whether it exists.
+func (tf targetFile) targets(name string) ([]string, bool) {
+	info, err := os.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, false
+	}
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return nil, false
+	}
+	if cached, ok := targetLists[path]; ok && cached.ModTime.Equal(info.ModTime()) && cached.Size == info.Size() {
+		return cached.Words, true
+	}
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, false
+	}
+	targets := uniqueSuggestions(tf.Parse(contents))
+	targetLists[path] = wordList{info.ModTime(), info.Size(), targets}
+	return targets, true
+}
+
+// delimitedFileSuggestions returns the suggestions for the file after the
+// last character in base that isn't part of a word, other than a /, with
+// what's before it in front of them.
+func delimitedFileSuggestions(base string) []string {
+	runes := []rune(base)
+	i := len(runes)
+	for i > 0 && (runes[i-1] == '/' || isWordRune(runes[i-1])) {
+		i--
+	}
+	if i == 0 {
+		return nil
+	}
+	prefix := string(runes[:i])
+	var suggestions []string
+	for _, s := range FileSuggestions(string(runes[i:])) {
+		suggestions = append(suggestions, prefix+s)
+	}
+	return suggestions
+}
@@ -0,0 +1,1114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestShouldPromptCompletions(t *testing.T) {
+	cases := []struct {
+		Count    int
+		Option   string
+		Expected bool
+	}{
+		// Default threshold of 100
+		{5, "", false},
+		{99, "", false},
+		{100, "", true},
+		{500, "", true},
+
+		// Explicitly set threshold
+		{5, "5", true},
+		{4, "5", false},
+
+		// Negative never prompts
+		{5000, "-1", false},
+
+		// Invalid values use the default
+		{150, "lots", true},
+		{50, "lots", false},
+	}
+	for i, tc := range cases {
+		if got := shouldPromptCompletions(tc.Count, tc.Option); got != tc.Expected {
+			t.Errorf("Unexpected result for case %d: got %v want %v", i, got, tc.Expected)
+		}
+	}
+}
+
+// completionDir creates a temporary directory with some files in it to
+// complete.
+func completionDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "goshcompletion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"foo1", "foo2", "bar"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCompleteInsert(t *testing.T) {
+	dir := completionDir(t)
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		Cmd      string
+		Expected string
+	}{
+		// One match gets completed
+		{"ls " + dir + "/b", "ls " + dir + "/bar"},
+		// Multiple matches complete the common prefix
+		{"ls " + dir + "/f", "ls " + dir + "/foo"},
+		// No matches leave the command alone
+		{"ls " + dir + "/x", "ls " + dir + "/x"},
+	}
+	for i, tc := range cases {
+		c := Command(tc.Cmd)
+		if err := c.CompleteInsert(); err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+		}
+		if string(c) != tc.Expected {
+			t.Errorf("Unexpected command for case %d: got %v want %v", i, c, tc.Expected)
+		}
+	}
+}
+
+func TestCompleteList(t *testing.T) {
+	dir := completionDir(t)
+	defer os.RemoveAll(dir)
+
+	for i, cmd := range []string{"ls " + dir + "/b", "ls " + dir + "/f", "ls " + dir + "/x"} {
+		c := Command(cmd)
+		if err := c.CompleteList(); err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+		}
+		if string(c) != cmd {
+			t.Errorf("Command was modified for case %d: got %v want %v", i, c, cmd)
+		}
+	}
+}
+
+func TestCommandSuggestionsAliases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "greet"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "grep"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	oldpath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldpath)
+	os.Setenv("PATH", dir+":"+dir)
+
+	oldaliases := aliases
+	defer func() { aliases = oldaliases }()
+	aliases = map[string]string{"greet": "echo hello", "gronk": "echo gronk", "ls": "ls -F"}
+
+	suggestions := CommandSuggestions("gr")
+	expected := map[string]bool{"greet": true, "gronk": true, "grep": true}
+	if len(suggestions) != len(expected) {
+		t.Fatalf("Unexpected suggestions: got %v want %v", suggestions, expected)
+	}
+	for _, s := range suggestions {
+		if !expected[s] {
+			t.Errorf("Unexpected suggestion %v", s)
+		}
+	}
+}
+
+func TestCommandSuggestionsBuiltins(t *testing.T) {
+	oldpath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldpath)
+	os.Setenv("PATH", "")
+
+	suggestions := CommandSuggestions("jo")
+	if len(suggestions) != 1 || suggestions[0] != "jobs" {
+		t.Errorf("Unexpected suggestions for jo: got %v want [jobs]", suggestions)
+	}
+
+	c := Command("jo")
+	if err := c.CompleteInsert(); err != nil {
+		t.Fatal(err)
+	}
+	if c != "jobs" {
+		t.Errorf("Unexpected completion for jo: got %v want jobs", c)
+	}
+}
+
+func TestAutocompletePosition(t *testing.T) {
+	oldcompletions := autocompletions
+	defer func() { autocompletions = oldcompletions }()
+	autocompletions = nil
+
+	for _, cmd := range []Command{
+		`autocomplete -n 1 ^git checkout commit`,
+		`autocomplete -n 2 "^git checkout" master develop`,
+	} {
+		if err := cmd.HandleCmd(); err != nil {
+			t.Fatalf("Unexpected error for %v: %v", cmd, err)
+		}
+	}
+
+	cases := []struct {
+		Cmd      Command
+		Expected []string
+	}{
+		{"git ", []string{"checkout", "commit"}},
+		{"git ch", []string{"checkout"}},
+		{"git checkout ", []string{"develop", "master"}},
+		{"git checkout m", []string{"master"}},
+		// Both regexes match, but we're past both positions.
+		{"git checkout master ", nil},
+		{"git checkout master d", nil},
+	}
+	for i, tc := range cases {
+		psuggestions, wsuggestions, _ := tc.Cmd.Suggestions()
+		// Filter out file suggestions, which we don't care about.
+		var got []string
+		for _, s := range append(psuggestions, wsuggestions...) {
+			if s == "checkout" || s == "commit" || s == "master" || s == "develop" {
+				got = append(got, s)
+			}
+		}
+		sort.Strings(got)
+		if len(got) != len(tc.Expected) {
+			t.Errorf("Unexpected suggestions for case %d: got %v want %v", i, got, tc.Expected)
+			continue
+		}
+		for j := range got {
+			if got[j] != tc.Expected[j] {
+				t.Errorf("Unexpected suggestions for case %d: got %v want %v", i, got, tc.Expected)
+				break
+			}
+		}
+	}
+
+	if err := Command("autocomplete -n x ^git foo").HandleCmd(); err == nil {
+		t.Errorf("Expected error for invalid position")
+	}
+}
+
+func TestSuggestionPrecedence(t *testing.T) {
+	dir := completionDir(t)
+	defer os.RemoveAll(dir)
+
+	oldcompletions := autocompletions
+	defer func() { autocompletions = oldcompletions }()
+	autocompletions = []*autocompletion{
+		{regexp.MustCompile("^tool$"), []Token{
+			Token(`!printf %s\n%s\n%s\n ` + dir + "/foo1 " + dir + "/foo1 " + dir + "/foo3"),
+		}, -1},
+		{regexp.MustCompile("^tool$"), []Token{Token(dir + "/foo1")}, -1},
+	}
+
+	cases := []struct {
+		Cmd          Command
+		PSuggestions []string
+		WSuggestions []string
+	}{
+		// The rules' suggestions are used without duplicates, and
+		// without the file foo2.
+		{Command("tool " + dir + "/foo"), []string{dir + "/foo1", dir + "/foo3"}, nil},
+		// The rule matched, so we don't fall back to the file bar.
+		{Command("tool " + dir + "/b"), nil, nil},
+		// New tokens are de-duplicated, and don't include the empty
+		// line at the end of the command's output.
+		{"tool ", nil, []string{dir + "/foo1", dir + "/foo3"}},
+		// No rules match, so we get the files.
+		{Command("other " + dir + "/b"), []string{dir + "/bar"}, nil},
+	}
+	for i, tc := range cases {
+		psuggestions, wsuggestions, _ := tc.Cmd.Suggestions()
+		sort.Strings(psuggestions)
+		sort.Strings(wsuggestions)
+		if strings.Join(psuggestions, "|") != strings.Join(tc.PSuggestions, "|") {
+			t.Errorf("Unexpected psuggestions for case %d: got %v want %v", i, psuggestions, tc.PSuggestions)
+		}
+		if strings.Join(wsuggestions, "|") != strings.Join(tc.WSuggestions, "|") {
+			t.Errorf("Unexpected wsuggestions for case %d: got %v want %v", i, wsuggestions, tc.WSuggestions)
+		}
+	}
+}
+
+func TestAutocompleteOrder(t *testing.T) {
+	oldcompletions := autocompletions
+	defer func() { autocompletions = oldcompletions }()
+	autocompletions = nil
+
+	for _, cmd := range []Command{
+		"autocomplete ^tool$ zeta beta",
+		"autocomplete ^tool alpha beta",
+		"autocomplete -n 1 ^tool gamma",
+	} {
+		if err := cmd.HandleCmd(); err != nil {
+			t.Fatalf("Unexpected error for %v: %v", cmd, err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		_, wsuggestions, _ := Command("tool ").Suggestions()
+		if expected := []string{"zeta", "beta", "alpha", "gamma"}; !reflect.DeepEqual(wsuggestions, expected) {
+			t.Fatalf("Unexpected suggestions: got %v want %v", wsuggestions, expected)
+		}
+	}
+}
+
+func TestCompleteInsertNewTokens(t *testing.T) {
+	oldcompletions := autocompletions
+	defer func() { autocompletions = oldcompletions }()
+	autocompletions = []*autocompletion{
+		{regexp.MustCompile("^git$"), []Token{"add"}, -1},
+		{regexp.MustCompile("^git commit$"), []Token{"--amend", "--all"}, -1},
+	}
+
+	cases := []struct {
+		Cmd      string
+		Expected string
+	}{
+		{"git ", "git add"},
+		{"git", "git add"},
+		{"git commit ", "git commit --a"},
+		{"git commit --a", "git commit --a"},
+		{"git commit --am", "git commit --amend"},
+	}
+	for i, tc := range cases {
+		c := Command(tc.Cmd)
+		if err := c.CompleteInsert(); err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+		}
+		if string(c) != tc.Expected {
+			t.Errorf("Unexpected command for case %d: got %q want %q", i, c, tc.Expected)
+		}
+	}
+}
+
+func TestUserSuggestions(t *testing.T) {
+	f, err := ioutil.TempFile("", "goshpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "root:x:0:0:root:/root:/bin/sh\n# comment\njohn:x:1000:1000::/home/john:/bin/sh\njoan:x:1001:1001::/home/joan:/bin/sh\n")
+	f.Close()
+
+	oldpasswd := passwdFile
+	passwdFile = f.Name()
+	defer func() { passwdFile = oldpasswd }()
+
+	cases := []struct {
+		Cmd      Command
+		Expected []string
+	}{
+		{"ls ~jo", []string{"~joan/", "~john/"}},
+		{"ls ~", []string{"~joan/", "~john/", "~root/"}},
+		{"ls ~r", []string{"~root/"}},
+		{"ls ~x", nil},
+	}
+	for i, tc := range cases {
+		psuggestions, _, _ := tc.Cmd.Suggestions()
+		sort.Strings(psuggestions)
+		if strings.Join(psuggestions, " ") != strings.Join(tc.Expected, " ") {
+			t.Errorf("Unexpected suggestions for case %d (%v): got %v want %v", i, tc.Cmd, psuggestions, tc.Expected)
+		}
+	}
+}
+
+func TestPathDirs(t *testing.T) {
+	oldpath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldpath)
+
+	cases := []struct {
+		Path     string
+		Expected []string
+	}{
+		{"", nil},
+		{"/bin:/usr/bin", []string{"/bin", "/usr/bin"}},
+		{":/bin", []string{".", "/bin"}},
+		{"/bin:", []string{"/bin", "."}},
+		{"/bin::/usr/bin", []string{"/bin", ".", "/usr/bin"}},
+	}
+	for i, tc := range cases {
+		os.Setenv("PATH", tc.Path)
+		if got := pathDirs(); strings.Join(got, " ") != strings.Join(tc.Expected, " ") || len(got) != len(tc.Expected) {
+			t.Errorf("Unexpected directories for case %d (%q): got %q want %q", i, tc.Path, got, tc.Expected)
+		}
+	}
+}
+
+func TestCommandSuggestionsEmptyPathEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "goshtestcmd"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	oldpath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldpath)
+	for _, path := range []string{":/nonexistent", "/nonexistent:", "/nonexistent::/nonexistent"} {
+		os.Setenv("PATH", path)
+		if got := CommandSuggestions("goshtest"); len(got) != 1 || got[0] != "goshtestcmd" {
+			t.Errorf("Unexpected suggestions for PATH %q: got %v want [goshtestcmd]", path, got)
+		}
+	}
+}
+
+func TestWordListCompletion(t *testing.T) {
+	f, err := ioutil.TempFile("", "goshwords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "alpha.example.com\nbeta.example.com\n\nalpine.example.com\n")
+	f.Close()
+
+	oldcompletions := autocompletions
+	defer func() { autocompletions = oldcompletions }()
+	autocompletions = nil
+	if err := Command("autocomplete ^goshssh @" + f.Name()).HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Cmd      Command
+		Expected []string
+	}{
+		{"goshssh al", []string{"alpha.example.com", "alpine.example.com"}},
+		{"goshssh b", []string{"beta.example.com"}},
+		{"goshssh ", []string{"alpha.example.com", "alpine.example.com", "beta.example.com"}},
+	}
+	check := func() {
+		for i, tc := range cases {
+			psuggestions, wsuggestions, _ := tc.Cmd.Suggestions()
+			got := append(psuggestions, wsuggestions...)
+			sort.Strings(got)
+			if strings.Join(got, " ") != strings.Join(tc.Expected, " ") {
+				t.Errorf("Unexpected suggestions for case %d (%v): got %v want %v", i, tc.Cmd, got, tc.Expected)
+			}
+		}
+	}
+	check()
+
+	// A different size is enough to notice the change, even if the
+	// modification time is the same.
+	if err := ioutil.WriteFile(f.Name(), []byte("gamma.example.com\nbeta.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cases = cases[1:]
+	cases[1].Expected = []string{"beta.example.com", "gamma.example.com"}
+	check()
+}
+
+func TestSplitFields(t *testing.T) {
+	oldifs, hadifs := os.LookupEnv("IFS")
+	defer func() {
+		if hadifs {
+			os.Setenv("IFS", oldifs)
+		} else {
+			os.Unsetenv("IFS")
+		}
+	}()
+
+	cases := []struct {
+		// The value of $IFS, or "unset" to leave it unset.
+		IFS      string
+		Input    string
+		Expected []string
+	}{
+		{"unset", "one two\tthree\n\nfour \n", []string{"one", "two", "three", "four"}},
+		{"unset", "", nil},
+		{":", "a:b::c", []string{"a", "b", "c"}},
+		{"\n", "one two\nthree\n", []string{"one two", "three"}},
+	}
+	for i, tc := range cases {
+		if tc.IFS == "unset" {
+			os.Unsetenv("IFS")
+		} else {
+			os.Setenv("IFS", tc.IFS)
+		}
+		if got := splitFields(tc.Input); strings.Join(got, ",") != strings.Join(tc.Expected, ",") || len(got) != len(tc.Expected) {
+			t.Errorf("Unexpected fields for case %d: got %q want %q", i, got, tc.Expected)
+		}
+	}
+}
+
+func TestGeneratorFieldSplitting(t *testing.T) {
+	oldcompletions := autocompletions
+	defer func() { autocompletions = oldcompletions }()
+	autocompletions = nil
+	if err := Command(`autocomplete ^goshgen "!echo start stop status"`).HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Cmd      Command
+		Expected []string
+	}{
+		{"goshgen st", []string{"start", "status", "stop"}},
+		{"goshgen sto", []string{"stop"}},
+		{"goshgen ", []string{"start", "status", "stop"}},
+	}
+	for i, tc := range cases {
+		psuggestions, wsuggestions, _ := tc.Cmd.Suggestions()
+		got := append(psuggestions, wsuggestions...)
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(tc.Expected, " ") {
+			t.Errorf("Unexpected suggestions for case %d (%v): got %q want %q", i, tc.Cmd, got, tc.Expected)
+		}
+	}
+}
+
+func TestAbbreviatedFileSuggestions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshabbrev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"usr/local/bin", "usr/lib", "usr/local/share", "src/gosh"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "usr/lfile"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldopt := os.Getenv("COMPLETION_ABBREVIATED")
+	defer os.Setenv("COMPLETION_ABBREVIATED", oldopt)
+
+	cases := []struct {
+		Option   string
+		Base     string
+		Expected []string
+	}{
+		{"on", "/u/lo/b", []string{"/usr/local/bin"}},
+		{"on", "/u/l/b", []string{"/usr/local/bin"}},
+		{"on", "/u/l", []string{"/usr/lfile", "/usr/lib", "/usr/local"}},
+		{"on", "/u/lo/", []string{"/usr/local/bin", "/usr/local/share"}},
+		{"on", "/usr/lo", []string{"/usr/local"}},
+		{"on", "/s/g", []string{"/src/gosh"}},
+		{"on", "/u/lf/x", nil},
+		{"on", "/x/l", nil},
+		{"off", "/u/lo/b", nil},
+		{"", "/u/lo/b", nil},
+	}
+	for i, tc := range cases {
+		os.Setenv("COMPLETION_ABBREVIATED", tc.Option)
+		got := FileSuggestions(dir + tc.Base)
+		sort.Strings(got)
+		var expected []string
+		for _, e := range tc.Expected {
+			expected = append(expected, dir+e)
+		}
+		if strings.Join(got, " ") != strings.Join(expected, " ") {
+			t.Errorf("Unexpected suggestions for case %d (%v): got %q want %q", i, tc.Base, got, expected)
+		}
+	}
+}
+
+func TestRedirectCompletion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshredirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"log1", "log2", "data"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "logs", "today"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(oldwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	oldcompletions := autocompletions
+	defer func() { autocompletions = oldcompletions }()
+	autocompletions = nil
+	if err := Command(`autocomplete ^goshcat "start stop"`).HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Cmd      Command
+		Expected []string
+		Base     string
+	}{
+		{"cat > log", []string{"log1", "log2", "logs"}, "log"},
+		{"cat >log", []string{"log1", "log2", "logs"}, "log"},
+		{"cat < d", []string{"data"}, "d"},
+		{"cat 2> lo", []string{"log1", "log2", "logs"}, "lo"},
+		{"cat > ", []string{"data", "log1", "log2", "logs"}, ""},
+		{"cat >", []string{"data", "log1", "log2", "logs"}, ""},
+		{"goshcat > l", []string{"log1", "log2", "logs"}, "l"},
+		{"> logs/", []string{"logs/today"}, "logs/"},
+	}
+	for i, tc := range cases {
+		psuggestions, wsuggestions, base := tc.Cmd.Suggestions()
+		sort.Strings(psuggestions)
+		if strings.Join(psuggestions, " ") != strings.Join(tc.Expected, " ") || len(wsuggestions) != 0 || base != tc.Base {
+			t.Errorf("Unexpected suggestions for case %d (%v): got %v %v %q want %v %q", i, tc.Cmd, psuggestions, wsuggestions, base, tc.Expected, tc.Base)
+		}
+	}
+}
+
+func TestCdPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshcdpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects, local := filepath.Join(dir, "projects"), filepath.Join(dir, "local")
+	for _, d := range []string{"projects/gosh/src", "projects/gofmt", "projects/web", "local/goals"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(projects, "gonotes.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(oldwd)
+	oldcdpath, oldpwd, oldoldpwd := os.Getenv("CDPATH"), os.Getenv("PWD"), os.Getenv("OLDPWD")
+	defer func() {
+		os.Setenv("CDPATH", oldcdpath)
+		os.Setenv("PWD", oldpwd)
+		os.Setenv("OLDPWD", oldoldpwd)
+	}()
+	if err := os.Chdir(local); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CDPATH", ":"+projects)
+
+	cases := []struct {
+		Cmd      Command
+		Expected []string
+	}{
+		{"cd go", []string{"goals", "gofmt", "gosh"}},
+		{"cd gosh/s", []string{"gosh/src"}},
+		{"cd w", []string{"web"}},
+		{"cd ./go", []string{"goals"}},
+		{"ls go", []string{"goals"}},
+	}
+	for i, tc := range cases {
+		psuggestions, _, _ := tc.Cmd.Suggestions()
+		sort.Strings(psuggestions)
+		if strings.Join(psuggestions, " ") != strings.Join(tc.Expected, " ") {
+			t.Errorf("Unexpected suggestions for case %d (%v): got %v want %v", i, tc.Cmd, psuggestions, tc.Expected)
+		}
+	}
+
+	if err := Command("cd gosh").HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+	if wd, _ := os.Getwd(); wd != filepath.Join(projects, "gosh") {
+		t.Errorf("Unexpected directory after cd: got %v", wd)
+	}
+	if err := Command("cd goals").HandleCmd(); err == nil {
+		t.Error("Expected error changing to a directory that isn't in $CDPATH")
+	}
+}
+
+func TestFlagSuggestions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshflags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	help := `Usage: fakecmd [OPTION]... FILE
+  -a, --all               show everything
+      --color[=WHEN]      colorize the output
+  -o, --output=FILE       write to FILE (see -a)
+      --help              display this help
+`
+	script := "#!/bin/sh\necho run >> " + filepath.Join(dir, "runs") + "\ncat >&2 <<'EOF'\n" + help + "EOF\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "fakecmd"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldpath, oldflags := os.Getenv("PATH"), os.Getenv("COMPLETION_FLAGS")
+	defer func() {
+		os.Setenv("PATH", oldpath)
+		os.Setenv("COMPLETION_FLAGS", oldflags)
+	}()
+	os.Setenv("PATH", dir+":"+oldpath)
+
+	expected := []string{"--all", "--color", "--help", "--output", "-a", "-o"}
+	if got := parseHelpFlags(help); strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("Unexpected flags: got %v want %v", got, expected)
+	}
+
+	os.Setenv("COMPLETION_FLAGS", "")
+	if psuggestions, _, _ := Command("fakecmd --").Suggestions(); len(psuggestions) != 0 {
+		t.Errorf("Suggested flags without $COMPLETION_FLAGS: %v", psuggestions)
+	}
+	os.Setenv("COMPLETION_FLAGS", "on")
+	cases := []struct {
+		Cmd      Command
+		Expected []string
+	}{
+		{"fakecmd --", []string{"--all", "--color", "--help", "--output"}},
+		{"fakecmd foo --c", []string{"--color"}},
+		{"fakecmd -", expected},
+		{"fakecmd --x", nil},
+	}
+	for i, tc := range cases {
+		psuggestions, _, _ := tc.Cmd.Suggestions()
+		if strings.Join(psuggestions, " ") != strings.Join(tc.Expected, " ") {
+			t.Errorf("Unexpected suggestions for case %d (%v): got %v want %v", i, tc.Cmd, psuggestions, tc.Expected)
+		}
+	}
+	if runs, _ := ioutil.ReadFile(filepath.Join(dir, "runs")); string(runs) != "run\n" {
+		t.Errorf("Unexpected runs of fakecmd --help: got %q want one", runs)
+	}
+}
+
+func TestRemoveAutocompletions(t *testing.T) {
+	oldcompletions := autocompletions
+	defer func() { autocompletions = oldcompletions }()
+	autocompletions = nil
+
+	for _, cmd := range []Command{
+		`autocomplete ^git add commit`,
+		`autocomplete -n 1 ^git push`,
+		`autocomplete ^go build test`,
+	} {
+		if err := cmd.HandleCmd(); err != nil {
+			t.Fatalf("Unexpected error for %v: %v", cmd, err)
+		}
+	}
+
+	patterns := func() []string {
+		var p []string
+		for _, rule := range autocompletions {
+			p = append(p, rule.Regexp.String())
+		}
+		sort.Strings(p)
+		return p
+	}
+
+	if err := Command("autocomplete -d ^git").HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+	if got := patterns(); len(got) != 1 || got[0] != "^go" {
+		t.Errorf("Unexpected rules after -d: %v", got)
+	}
+	if err := Command("autocomplete -d ^git").HandleCmd(); err == nil {
+		t.Error("Expected error deleting a rule that doesn't exist")
+	}
+	if err := Command("autocomplete -c").HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+	if got := patterns(); len(got) != 0 {
+		t.Errorf("Unexpected rules after -c: %v", got)
+	}
+	psuggestions, wsuggestions, _ := Command("go ").Suggestions()
+	for _, s := range append(psuggestions, wsuggestions...) {
+		if s == "build" || s == "test" {
+			t.Errorf("Unexpected suggestion after -c: %v", s)
+		}
+	}
+}
+
+func TestCompgen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshcompgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"goshfoo", "goshbar", "goshfoobar"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldpath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldpath)
+	os.Setenv("PATH", dir)
+
+	cases := []struct {
+		Args     []string
+		Expected string
+	}{
+		{[]string{"goshfoo"}, "goshfoo\ngoshfoobar\n"},
+		{[]string{"goshb"}, "goshbar\n"},
+		{[]string{"goshx"}, ""},
+		{[]string{"ls", dir + "/goshf"}, dir + "/goshfoo\n" + dir + "/goshfoobar\n"},
+	}
+	for i, tc := range cases {
+		var buf bytes.Buffer
+		if err := Compgen(&buf, tc.Args); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tc.Expected {
+			t.Errorf("Unexpected output for case %d (%v): got %q want %q", i, tc.Args, got, tc.Expected)
+		}
+	}
+	if err := Compgen(ioutil.Discard, nil); err == nil {
+		t.Error("Expected usage error with no arguments")
+	}
+}
+
+func TestCompleteTwice(t *testing.T) {
+	dir := completionDir(t)
+	defer os.RemoveAll(dir)
+
+	var out bytes.Buffer
+	oldscreen := screen
+	defer func() {
+		screen = oldscreen
+		completionPending = false
+	}()
+	screen = bufio.NewWriter(&out)
+
+	c := Command("ls " + dir + "/f")
+	if err := c.CompleteInsert(); err != nil {
+		t.Fatal(err)
+	}
+	screen.Flush()
+	if expected := "ls " + dir + "/foo"; string(c) != expected {
+		t.Errorf("Common prefix not completed: got %q want %q", c, expected)
+	}
+	if got := out.String(); got != "oo\u0007" {
+		t.Errorf("Unexpected output for first completion: got %q want %q", got, "oo\u0007")
+	}
+
+	out.Reset()
+	if err := c.CompleteInsert(); err != nil {
+		t.Fatal(err)
+	}
+	screen.Flush()
+	if expected := "ls " + dir + "/foo"; string(c) != expected {
+		t.Errorf("Second completion changed the command: got %q want %q", c, expected)
+	}
+	if got := out.String(); !strings.Contains(got, "foo1") || !strings.Contains(got, "foo2") {
+		t.Errorf("Second completion didn't list the suggestions: got %q", got)
+	}
+
+	// If something else was pressed in between, it's a first press again.
+	completionPending = false
+	out.Reset()
+	if err := c.CompleteInsert(); err != nil {
+		t.Fatal(err)
+	}
+	screen.Flush()
+	if got := out.String(); got != "\u0007" {
+		t.Errorf("Unexpected output for completion without progress: got %q want %q", got, "\u0007")
+	}
+}
+
+func TestCompletionMenu(t *testing.T) {
+	m := newCompletionMenu("ls fo", "fo", []string{"foo1", "foo2", "foo3"})
+	for i, tc := range []struct {
+		N        int
+		Expected Command
+	}{
+		{1, "ls foo1"},
+		{1, "ls foo2"},
+		{1, "ls foo3"},
+		{1, "ls foo1"},
+		{-1, "ls foo3"},
+		{-1, "ls foo2"},
+	} {
+		if got := m.Next(tc.N); got != tc.Expected || m.shown != tc.Expected {
+			t.Errorf("Unexpected command line for press %d: got %q want %q", i, got, tc.Expected)
+		}
+	}
+
+	m = newCompletionMenu("git ", "", []string{"add", "commit"})
+	if got := m.Next(-1); got != "git commit" {
+		t.Errorf("Going backwards didn't start at the end: got %q", got)
+	}
+}
+
+func TestCompleteInsertMenu(t *testing.T) {
+	dir := completionDir(t)
+	defer os.RemoveAll(dir)
+
+	oldoption, oldmenu := os.Getenv("COMPLETION_MENU"), menu
+	defer func() {
+		os.Setenv("COMPLETION_MENU", oldoption)
+		menu = oldmenu
+	}()
+	os.Setenv("COMPLETION_MENU", "on")
+	menu = nil
+
+	c := Command("ls " + dir + "/f")
+	for i, expected := range []string{"foo1", "foo2", "foo1"} {
+		if err := c.CompleteInsert(); err != nil {
+			t.Fatal(err)
+		}
+		if string(c) != "ls "+dir+"/"+expected {
+			t.Errorf("Unexpected command line for press %d: got %q want %q", i, c, "ls "+dir+"/"+expected)
+		}
+	}
+
+	// Completing something else starts a new menu.
+	c = Command("ls " + dir + "/b")
+	if err := c.CompleteInsert(); err != nil {
+		t.Fatal(err)
+	}
+	c += " " + Command(dir) + "/f"
+	if err := c.CompleteInsert(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "ls " + dir + "/bar " + dir + "/foo1"; string(c) != expected {
+		t.Errorf("Unexpected command line for new menu: got %q want %q", c, expected)
+	}
+}
+
+func TestCompletions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshcompletions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"foo1", "foo2", "bar"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range []string{"GOSHCOMPLETIONSB", "GOSHCOMPLETIONSA"} {
+		os.Setenv(v, "x")
+		defer os.Unsetenv(v)
+	}
+
+	cases := []struct {
+		Line     string
+		Cursor   int
+		Expected []string
+		Base     string
+	}{
+		// Commands
+		{"autocomp", 8, []string{"autocomplete"}, "autocomp"},
+		// Files
+		{"ls " + dir + "/f", len(dir) + 5, []string{dir + "/foo1", dir + "/foo2"}, dir + "/f"},
+		{"ls " + dir + "/b | wc", len(dir) + 5, []string{dir + "/bar"}, dir + "/b"},
+		{"ls " + dir + "/z", len(dir) + 5, nil, ""},
+		// Variables
+		{"echo $GOSHCOMPLETIONS", 21, []string{"$GOSHCOMPLETIONSA", "$GOSHCOMPLETIONSB"}, "$GOSHCOMPLETIONS"},
+		{"echo ${GOSHCOMPLETIONSA", 23, []string{"${GOSHCOMPLETIONSA}"}, "${GOSHCOMPLETIONSA"},
+		{"echo $GOSHCOMPLETIONSA foo", 22, []string{"$GOSHCOMPLETIONSA"}, "$GOSHCOMPLETIONSA"},
+		// The cursor is past the end of the line.
+		{"echo $GOSHCOMPLETIONSB", 100, []string{"$GOSHCOMPLETIONSB"}, "$GOSHCOMPLETIONSB"},
+	}
+	for i, tc := range cases {
+		suggestions, base := Completions(tc.Line, tc.Cursor)
+		if !reflect.DeepEqual(suggestions, tc.Expected) || base != tc.Base {
+			t.Errorf("Unexpected completions for case %d (%q): got %q %q want %q %q", i, tc.Line, suggestions, base, tc.Expected, tc.Base)
+		}
+	}
+}
+
+func TestAutocompleteSourcedTwice(t *testing.T) {
+	oldcompletions := autocompletions
+	defer func() { autocompletions = oldcompletions }()
+	autocompletions = nil
+
+	f, err := ioutil.TempFile("", "goshautocomplete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "autocomplete ^gosh-git checkout commit")
+	fmt.Fprintln(f, "autocomplete ^gosh-git commit push")
+	fmt.Fprintln(f, "autocomplete -n 1 ^gosh-go build test")
+	f.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := SourceFile(f.Name()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(autocompletions) != 2 {
+		t.Errorf("Unexpected number of rules: got %d want 2", len(autocompletions))
+	}
+	for _, rule := range autocompletions {
+		var expected []Token
+		switch rule.Regexp.String() {
+		case "^gosh-git":
+			expected = []Token{"checkout", "commit", "push"}
+		case "^gosh-go":
+			expected = []Token{"build", "test"}
+			if rule.Position != 1 {
+				t.Errorf("Unexpected position for %v: got %d want 1", rule.Regexp, rule.Position)
+			}
+		}
+		if !reflect.DeepEqual(rule.Suggestions, expected) {
+			t.Errorf("Unexpected values for %v: got %v want %v", rule.Regexp, rule.Suggestions, expected)
+		}
+	}
+
+	suggestions, _ := Completions("gosh-git ", 9)
+	if expected := []string{"checkout", "commit", "push"}; !reflect.DeepEqual(suggestions, expected) {
+		t.Errorf("Unexpected suggestions: got %v want %v", suggestions, expected)
+	}
+}
+
+func TestTargetSuggestions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshtargets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(oldwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	makefile := `CC := gcc
+PREFIX ?= /usr/local
+.PHONY: all clean install
+all: gosh
+# comment: not a target
+gosh: main.go
+	go build -o gosh
+%.o: %.c
+	$(CC) -c $<
+clean install::
+	rm -f gosh
+$(PREFIX)/bin/gosh: gosh
+`
+	if err := ioutil.WriteFile("Makefile", []byte(makefile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pkg := `{"name": "gosh", "scripts": {"build": "tsc", "test": "jest", "test:watch": "jest --watch"}}`
+	if err := ioutil.WriteFile("package.json", []byte(pkg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Line     string
+		Expected []string
+		Base     string
+	}{
+		{"make ", []string{"all", "clean", "gosh", "install"}, ""},
+		{"make c", []string{"clean"}, "c"},
+		{"make all i", []string{"install"}, "i"},
+		{"make Make", []string{"Makefile"}, "Make"},
+		{"npm run ", []string{"build", "test", "test:watch"}, ""},
+		{"npm run test", []string{"test", "test:watch"}, "test"},
+		{"yarn run b", []string{"build"}, "b"},
+		{"make all ", []string{"all", "clean", "gosh", "install"}, ""},
+		{"npm pack", []string{"package.json"}, "pack"},
+	}
+	for i, tc := range cases {
+		suggestions, base := Completions(tc.Line, len(tc.Line))
+		if !reflect.DeepEqual(suggestions, tc.Expected) || base != tc.Base {
+			t.Errorf("Unexpected completions for case %d (%q): got %q %q want %q %q", i, tc.Line, suggestions, base, tc.Expected, tc.Base)
+		}
+	}
+
+	// Changing the file changes the targets, even if it's in the same
+	// second.
+	if err := ioutil.WriteFile("Makefile", []byte("all:\ncheck:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if suggestions, _ := Completions("make ", 5); !reflect.DeepEqual(suggestions, []string{"all", "check"}) {
+		t.Errorf("Unexpected completions after changing the Makefile: got %q", suggestions)
+	}
+}
+
+func TestDelimitedCompletion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshdelimited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(oldwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"main.go", "src/parse.go"} {
+		if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldwordchars, set := os.LookupEnv("WORDCHARS")
+	defer func() {
+		if set {
+			os.Setenv("WORDCHARS", oldwordchars)
+		} else {
+			os.Unsetenv("WORDCHARS")
+		}
+	}()
+
+	cases := []struct {
+		// The value of $WORDCHARS, or "unset" to leave it unset.
+		Wordchars string
+		Line      string
+		Expected  []string
+	}{
+		{"unset", "gofmt --file=ma", nil},
+		{"", "gofmt --file=ma", []string{"--file=main.go"}},
+		{"", "gofmt --file=src/pa", []string{"--file=src/parse.go"}},
+		{"", "scp host:ma", []string{"host:main.go"}},
+		{"=", "gofmt --file=ma", nil},
+		{"", "ls ma", []string{"main.go"}},
+	}
+	for i, tc := range cases {
+		if tc.Wordchars == "unset" {
+			os.Unsetenv("WORDCHARS")
+		} else {
+			os.Setenv("WORDCHARS", tc.Wordchars)
+		}
+		if suggestions, _ := Completions(tc.Line, len(tc.Line)); !reflect.DeepEqual(suggestions, tc.Expected) {
+			t.Errorf("Unexpected completions for case %d (%q): got %q want %q", i, tc.Line, suggestions, tc.Expected)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// The kinds of errors that builtins return.
+var (
+	// ErrUsage means that the builtin was given the wrong arguments.
+	ErrUsage = errors.New("usage")
+	// ErrNoSuchJob means that a job spec didn't match any job.
+	ErrNoSuchJob = errors.New("no such job")
+	// ErrNoSuchFile means that a file or directory doesn't exist.
+	ErrNoSuchFile = errors.New("no such file or directory")
+	// ErrNotFound means that something named, like an alias, doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidArgument means that an argument isn't valid, like an
+	// unknown signal.
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrReadOnly means that a read-only variable was assigned to.
+	ErrReadOnly = errors.New("read-only variable")
+)
+
+// A BuiltinError is an error from a builtin command.
+type BuiltinError struct {
+	// Kind is the kind of error, like ErrUsage.
+	Kind error
+	// Message is the error to show to the user.
+	Message string
+}
+
+func (e *BuiltinError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the kind of error that e is, so that errors.Is can check it.
+func (e *BuiltinError) Unwrap() error {
+	return e.Kind
+}
+
+// builtinError returns a BuiltinError of the kind kind, with the message
+// formatted from format and args like fmt.Errorf.
+func builtinError(kind error, format string, args ...interface{}) error {
+	return &BuiltinError{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+// Status returns the value of $? for e.
+func (e *BuiltinError) Status() int {
+	if errors.Is(e.Kind, ErrUsage) {
+		return 2
+	}
+	return 1
+}
+
+// setBuiltinStatus sets $? for err if it's a BuiltinError, and returns err.
+func setBuiltinStatus(err error) error {
+	var berr *BuiltinError
+	if errors.As(err, &berr) {
+		os.Setenv("?", strconv.Itoa(berr.Status()))
+	}
+	return err
+}
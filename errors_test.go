@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+)
+
+func TestBuiltinErrors(t *testing.T) {
+	oldaliases := aliases
+	defer func() { aliases = oldaliases }()
+	aliases = map[string]string{}
+	defer setJobs()()
+
+	cases := []struct {
+		Cmd  Command
+		Kind error
+	}{
+		{"set GOSHERROR", ErrUsage},
+		{"cd", ErrUsage},
+		{"source", ErrUsage},
+		{"unalias", ErrUsage},
+		{"getopts", ErrUsage},
+		{"readarray a b", ErrUsage},
+		{"compgen", ErrUsage},
+		{"trap KILL", ErrUsage},
+		{"cd /nonexistent/gosh", ErrNoSuchFile},
+		{"source /nonexistent/gosh", ErrNoSuchFile},
+		{"bg %3", ErrNoSuchJob},
+		{"bg %goshnosuchjob", ErrNoSuchJob},
+		{"kill %3", ErrNoSuchJob},
+		{"kill -s GOSH 1", ErrInvalidArgument},
+		{"trap 'echo x' GOSH", ErrInvalidArgument},
+		{"trap 'echo x' KILL", ErrInvalidArgument},
+		{"autocomplete -n x ls foo", ErrInvalidArgument},
+		{"alias goshnosuchalias", ErrNotFound},
+		{"unalias goshnosuchalias", ErrNotFound},
+		{"help goshnosuchbuiltin", ErrNotFound},
+		{"autocomplete -d goshnosuchrule", ErrNotFound},
+	}
+	for i, tc := range cases {
+		err := tc.Cmd.HandleCmd()
+		if !errors.Is(err, tc.Kind) {
+			t.Errorf("Unexpected error for case %d (%v): got %v want %v", i, tc.Cmd, err, tc.Kind)
+		}
+		var berr *BuiltinError
+		if !errors.As(err, &berr) || berr.Message == "" {
+			t.Errorf("Error for case %d (%v) isn't a BuiltinError with a message: %#v", i, tc.Cmd, err)
+		}
+	}
+	if err := Command("set GOSHERROR").HandleCmd(); err.Error() != "Usage: set var value" {
+		t.Errorf("Unexpected message: got %q", err)
+	}
+	os.Unsetenv("GOSHERROR")
+}
+
+func TestBuiltinErrorStatus(t *testing.T) {
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	defer os.Setenv("?", os.Getenv("?"))
+
+	cases := []struct {
+		Cmd    Command
+		Status string
+	}{
+		{"cd /nonexistent/gosh", "1"},
+		{"set GOSHERROR", "2"},
+		{"timeout", "2"},
+		{"alias goshnosuchalias", "1"},
+		{"! cd /nonexistent/gosh", "0"},
+	}
+	for i, tc := range cases {
+		os.Setenv("?", "")
+		tc.Cmd.Run(child)
+		if got := os.Getenv("?"); got != tc.Status {
+			t.Errorf("Unexpected $? for case %d (%v): got %q want %q", i, tc.Cmd, got, tc.Status)
+		}
+	}
+
+	// A builtin that succeeds resets $?, after its arguments see the old one.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	defer os.Unsetenv("GOSHSTATUS")
+	if err := Command("false; set GOSHSTATUS $?; cd " + os.TempDir()).Run(child); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("?"); got != "0" {
+		t.Errorf("Unexpected $? after a builtin succeeded: got %q want %q", got, "0")
+	}
+	if got := os.Getenv("GOSHSTATUS"); got != "1" {
+		t.Errorf("Unexpected $? in a builtin's arguments: got %q want %q", got, "1")
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReplaceTilde(t *testing.T) {
+	oldhome, olduser := os.Getenv("HOME"), currentUser
+	defer func() {
+		os.Setenv("HOME", oldhome)
+		currentUser = olduser
+	}()
+	currentUser = func() (*user.User, error) {
+		return &user.User{Username: "gosh", HomeDir: "/home/gosh"}, nil
+	}
+	os.Setenv("HOME", "/home/fromenv")
+
+	cases := []struct {
+		Token    string
+		Expected string
+	}{
+		{"~", "/home/gosh"},
+		{"~/src", "/home/gosh/src"},
+		{"~/", "/home/gosh/"},
+		{"a~", "a~"},
+		{"~goshnosuchuser/src", "~goshnosuchuser/src"},
+	}
+	for i, tc := range cases {
+		if got := replaceTilde(tc.Token); got != tc.Expected {
+			t.Errorf("Unexpected expansion for case %d (%v): got %v want %v", i, tc.Token, got, tc.Expected)
+		}
+	}
+
+	// Without the user database, $HOME is used.
+	currentUser = func() (*user.User, error) {
+		return nil, errors.New("no user database")
+	}
+	if got := replaceTilde("~/src"); got != "/home/fromenv/src" {
+		t.Errorf("$HOME not used when the user lookup failed: got %v", got)
+	}
+	os.Unsetenv("HOME")
+	if got := replaceTilde("~/src"); got != "~/src" {
+		t.Errorf("Unexpected expansion without a user or $HOME: got %v", got)
+	}
+}
+
+func TestHistoryFileHome(t *testing.T) {
+	oldhome, olduser, oldhist := os.Getenv("HOME"), currentUser, os.Getenv("HISTFILE")
+	defer func() {
+		os.Setenv("HOME", oldhome)
+		os.Setenv("HISTFILE", oldhist)
+		currentUser = olduser
+	}()
+	os.Unsetenv("HISTFILE")
+	currentUser = func() (*user.User, error) {
+		return nil, errors.New("no user database")
+	}
+	os.Setenv("HOME", "/home/fromenv")
+	if got := historyFile(); got != "/home/fromenv/.gosh_history" {
+		t.Errorf("Unexpected history file: got %v", got)
+	}
+	os.Unsetenv("HOME")
+	if got := historyFile(); got != "" {
+		t.Errorf("Unexpected history file without a home directory: got %v", got)
+	}
+}
+
+func TestGlobHiddenFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshglob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"b", "a", ".hidden", ".a", "c.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, ".dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Pattern  string
+		Expected []string
+	}{
+		{"*", []string{"a", "b", "c.txt"}},
+		{".*", []string{".a", ".dir", ".hidden"}},
+		{"*a*", []string{"a"}},
+		{".h*", []string{".hidden"}},
+		{"*dden", nil},
+		{".dir/*", nil},
+	}
+	for i, tc := range cases {
+		got, err := globFiles(filepath.Join(dir, tc.Pattern))
+		if err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+			continue
+		}
+		var expected []string
+		for _, name := range tc.Expected {
+			expected = append(expected, filepath.Join(dir, name))
+		}
+		if !reflect.DeepEqual(got, expected) && (len(got) != 0 || len(expected) != 0) {
+			t.Errorf("Unexpected matches for case %d (%v): got %v want %v", i, tc.Pattern, got, expected)
+		}
+	}
+}
+
+func TestShellName(t *testing.T) {
+	cases := []struct {
+		Args     []string
+		Expected string
+	}{
+		{[]string{"gosh"}, "gosh"},
+		{[]string{"/usr/local/bin/gosh"}, "gosh"},
+		{[]string{"gosh", "script.sh"}, "script.sh"},
+		{[]string{"gosh", "./bin/build", "arg"}, "./bin/build"},
+		{[]string{"gosh", "-c", "echo $0"}, "gosh"},
+		{[]string{"gosh", "-c", "echo $0", "name"}, "name"},
+	}
+	for i, tc := range cases {
+		if got := shellName(tc.Args); got != tc.Expected {
+			t.Errorf("Unexpected name for case %d (%v): got %v want %v", i, tc.Args, got, tc.Expected)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "goshname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	defer os.Unsetenv("0")
+	os.Setenv("0", shellName([]string{"gosh"}))
+
+	out := filepath.Join(dir, "out")
+	if err := Command("echo $0 > " + out).Run(child); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(out); string(got) != "gosh\n" {
+		t.Errorf("Unexpected $0 for a command: got %q want %q", got, "gosh\n")
+	}
+
+	script := filepath.Join(dir, "script")
+	if err := ioutil.WriteFile(script, []byte("echo $0 > "+out+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SourceFile(script); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(out); string(got) != "gosh\n" {
+		t.Errorf("Unexpected $0 in a sourced file: got %q want %q", got, "gosh\n")
+	}
+}
+
+func TestExpandRedirectTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshhome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	olduser := currentUser
+	defer func() { currentUser = olduser }()
+	currentUser = func() (*user.User, error) {
+		return &user.User{Username: "gosh", HomeDir: dir}, nil
+	}
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	defer os.Unsetenv("GOSHLOG")
+	defer os.Unsetenv("GOSHTARGET")
+	os.Setenv("GOSHTARGET", "target")
+
+	for _, cmd := range []Command{
+		"echo foo > ~/foo",
+		"echo target >~/$GOSHTARGET",
+		"echo bar 2>&1 >~/$GOSHTARGET.bar",
+		"{ echo group; } > ~/group",
+	} {
+		if err := cmd.Run(child); err != nil {
+			t.Fatalf("Unexpected error for %v: %v", cmd, err)
+		}
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "foo")); string(got) != "foo\n" {
+		t.Errorf("Unexpected contents of ~/foo: got %q", got)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "target.bar")); string(got) != "bar\n" {
+		t.Errorf("Unexpected contents of ~/target.bar: got %q", got)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "group")); string(got) != "group\n" {
+		t.Errorf("Unexpected contents of ~/group: got %q", got)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "target")); string(got) != "target\n" {
+		t.Errorf("Unexpected contents of ~/target: got %q", got)
+	}
+
+	if err := Command("set GOSHLOG ~/log").Run(child); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("GOSHLOG"); got != filepath.Join(dir, "log") {
+		t.Errorf("Unexpected value for set: got %v want %v", got, filepath.Join(dir, "log"))
+	}
+
+	if err := Command("echo ambiguous > " + dir + "/*").Run(child); err == nil {
+		t.Errorf("No error for a redirection to more than one file")
+	}
+}
+
+func TestQuotedGlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshquotedglob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(oldwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"foo1", "foo2", "file"} {
+		if err := ioutil.WriteFile(f, []byte("foo*\nfoo1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldaliases := aliases
+	defer func() { aliases = oldaliases }()
+	aliases = map[string]string{"g": "grep -F"}
+
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	cases := []struct {
+		Cmd      Command
+		Expected string
+	}{
+		{`grep -F "foo*" file > out`, "foo*\n"},
+		{`grep -F 'foo*' file > out`, "foo*\n"},
+		{`grep -F foo"*" file > out`, "foo*\n"},
+		{`echo foo* "foo*" > out`, "foo1 foo2 foo*\n"},
+		{`echo foo* | g "foo*" > out`, ""},
+		{`cat file | g "foo*" > out`, "foo*\n"},
+		{`echo "foo*" | g "foo*" > out`, "foo*\n"},
+	}
+	for i, tc := range cases {
+		os.Remove("out")
+		tc.Cmd.Run(child)
+		if got, _ := ioutil.ReadFile("out"); string(got) != tc.Expected {
+			t.Errorf("Unexpected output for case %d (%v): got %q want %q", i, tc.Cmd, got, tc.Expected)
+		}
+	}
+}
+
+func TestDynamicVariables(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		v := expandVariables("$RANDOM")
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 32767 {
+			t.Errorf("Unexpected $RANDOM: got %q", v)
+		}
+		seen[v] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("$RANDOM didn't change: got %v", seen)
+	}
+
+	// Seeding it gives the same numbers again.
+	if err := Command("RANDOM=42").HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+	first := expandVariables("$RANDOM ${RANDOM}")
+	if err := Command("RANDOM=42").HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+	if second := expandVariables("$RANDOM ${RANDOM}"); first != second {
+		t.Errorf("Unexpected numbers after seeding: got %q want %q", second, first)
+	}
+	if v, ok := os.LookupEnv("RANDOM"); ok {
+		t.Errorf("Unexpected $RANDOM in the environment: %q", v)
+	}
+
+	oldstart := secondsStart
+	defer func() {
+		secondsStart = oldstart
+	}()
+	if err := Command("SECONDS=10").HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+	if v := expandVariables("$SECONDS"); v != "10" {
+		t.Errorf("Unexpected $SECONDS: got %q want %q", v, "10")
+	}
+	secondsStart = secondsStart.Add(-2 * time.Second)
+	if v := expandVariables("$SECONDS"); v != "12" {
+		t.Errorf("Unexpected $SECONDS after 2 seconds: got %q want %q", v, "12")
+	}
+}
+
+func TestLineno(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshlineno")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Each command writes its line number to its own file in dir.
+	out := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	nested := filepath.Join(dir, "nested")
+	if err := ioutil.WriteFile(nested, []byte("\necho $LINENO > "+out("nested")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "script")
+	lines := []string{
+		"echo $LINENO > " + out("first"),
+		"",
+		"echo $LINENO |",
+		"  cat > " + out("pipeline"),
+		"source " + nested,
+		"echo $LINENO > " + out("last"),
+	}
+	if err := ioutil.WriteFile(script, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldline := lineNumber
+	defer func() {
+		lineNumber = oldline
+	}()
+	lineNumber = 42
+	if err := SourceFile(script); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ Name, Expected string }{
+		{"first", "1\n"},
+		{"pipeline", "3\n"},
+		{"nested", "2\n"},
+		{"last", "6\n"},
+	} {
+		if got, _ := ioutil.ReadFile(out(tc.Name)); string(got) != tc.Expected {
+			t.Errorf("Unexpected line number for %s: got %q want %q", tc.Name, got, tc.Expected)
+		}
+	}
+	if lineNumber != 42 {
+		t.Errorf("Line number wasn't restored after sourcing: got %d want %d", lineNumber, 42)
+	}
+}
+
+func TestPwdSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshpwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(oldwd)
+	oldpwd, oldoldpwd := os.Getenv("PWD"), os.Getenv("OLDPWD")
+	defer func() {
+		os.Setenv("PWD", oldpwd)
+		os.Setenv("OLDPWD", oldoldpwd)
+	}()
+
+	os.Setenv("PWD", oldwd)
+	os.Setenv("OLDPWD", "")
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := expandVariables("$PWD $OLDPWD"); got != dir+" "+oldwd {
+		t.Errorf("Unexpected $PWD $OLDPWD: got %q want %q", got, dir+" "+oldwd)
+	}
+
+	// A path to the same directory through a symlink is left alone.
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("PWD", link)
+	if got := expandVariables("$PWD"); got != link {
+		t.Errorf("Unexpected $PWD through a symlink: got %q want %q", got, link)
+	}
+}
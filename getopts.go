@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// getoptsState is where getopts is in its arguments.
+type getoptsState struct {
+	// Optind is the 1-based index of the argument being parsed.
+	Optind int
+	// Offset is the index of the next option letter in that argument, or
+	// 0 if we haven't started it.
+	Offset int
+}
+
+// getoptsLast is the state at the end of the last call to the getopts
+// builtin.
+var getoptsLast getoptsState
+
+// getopts parses the next option from args, starting at state. It returns
+// the option and its argument, and the new state. If there are no more
+// options, ok is false. An invalid option or missing argument is returned as
+// "?" (or ":" for a missing argument if optstring starts with ":") and a
+// non-nil err that describes it.
+func getopts(optstring string, args []string, state getoptsState) (opt, optarg string, next getoptsState, ok bool, err error) {
+	next = state
+	silent := strings.HasPrefix(optstring, ":")
+	if next.Offset == 0 {
+		if next.Optind < 1 || next.Optind > len(args) {
+			return "?", "", next, false, nil
+		}
+		arg := args[next.Optind-1]
+		if arg == "--" {
+			next.Optind++
+			return "?", "", next, false, nil
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			return "?", "", next, false, nil
+		}
+		next.Offset = 1
+	}
+
+	arg := args[next.Optind-1]
+	c := arg[next.Offset]
+	next.Offset++
+	// Move on to the next argument when we've finished this one.
+	finishArg := func() {
+		if next.Offset >= len(arg) {
+			next.Optind++
+			next.Offset = 0
+		}
+	}
+
+	i := strings.IndexByte(optstring, c)
+	if c == ':' || i < 0 {
+		finishArg()
+		if silent {
+			return "?", string(c), next, true, nil
+		}
+		return "?", "", next, true, fmt.Errorf("getopts: illegal option -- %c", c)
+	}
+	if i+1 >= len(optstring) || optstring[i+1] != ':' {
+		finishArg()
+		return string(c), "", next, true, nil
+	}
+
+	// The option takes an argument, which is either the rest of this
+	// argument or the next one.
+	if next.Offset < len(arg) {
+		optarg = arg[next.Offset:]
+		next.Optind++
+		next.Offset = 0
+		return string(c), optarg, next, true, nil
+	}
+	next.Optind++
+	next.Offset = 0
+	if next.Optind > len(args) {
+		if silent {
+			return ":", string(c), next, true, nil
+		}
+		return "?", "", next, true, fmt.Errorf("getopts: option requires an argument -- %c", c)
+	}
+	optarg = args[next.Optind-1]
+	next.Optind++
+	return string(c), optarg, next, true, nil
+}
+
+// Getopts implements the getopts builtin.
+func Getopts(args []string) error {
+	if len(args) < 2 {
+		return builtinError(ErrUsage, "Usage: getopts optstring var [args...]")
+	}
+	optstring, name, params := args[0], args[1], args[2:]
+
+	state := getoptsState{Optind: 1}
+	if optind, err := strconv.Atoi(os.Getenv("OPTIND")); err == nil {
+		state.Optind = optind
+	}
+	if state.Optind == getoptsLast.Optind {
+		state.Offset = getoptsLast.Offset
+	}
+
+	opt, optarg, next, ok, err := getopts(optstring, params, state)
+	getoptsLast = next
+	os.Setenv("OPTIND", strconv.Itoa(next.Optind))
+	if err := setVariable(name, opt); err != nil {
+		return err
+	}
+	if optarg != "" {
+		os.Setenv("OPTARG", optarg)
+	} else {
+		os.Unsetenv("OPTARG")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	if ok {
+		os.Setenv("?", "0")
+	} else {
+		os.Setenv("?", "1")
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGetopts(t *testing.T) {
+	type result struct {
+		Opt, Optarg string
+	}
+	cases := []struct {
+		Optstring string
+		Args      []string
+		Expected  []result
+		Optind    int
+	}{
+		{
+			"ab:c:d",
+			[]string{"-a", "-b", "val", "-cfoo", "-ad", "--", "-b", "rest"},
+			[]result{{"a", ""}, {"b", "val"}, {"c", "foo"}, {"a", ""}, {"d", ""}},
+			7,
+		},
+		{
+			"ab",
+			[]string{"-ab", "file", "-a"},
+			[]result{{"a", ""}, {"b", ""}},
+			2,
+		},
+		{
+			"a",
+			[]string{"-x", "-a", "-"},
+			[]result{{"?", ""}, {"a", ""}},
+			3,
+		},
+		{
+			// Silent error reporting
+			":ab:",
+			[]string{"-x", "-b"},
+			[]result{{"?", "x"}, {":", "b"}},
+			3,
+		},
+		{"a", nil, nil, 1},
+	}
+	for i, tc := range cases {
+		state := getoptsState{Optind: 1}
+		var got []result
+		for {
+			opt, optarg, next, ok, _ := getopts(tc.Optstring, tc.Args, state)
+			state = next
+			if !ok {
+				break
+			}
+			got = append(got, result{opt, optarg})
+			if len(got) > len(tc.Args)*2 {
+				t.Fatalf("getopts did not terminate for case %d", i)
+			}
+		}
+		if len(got) != len(tc.Expected) {
+			t.Errorf("Unexpected options for case %d: got %v want %v", i, got, tc.Expected)
+			continue
+		}
+		for j := range got {
+			if got[j] != tc.Expected[j] {
+				t.Errorf("Unexpected option %d for case %d: got %v want %v", j, i, got[j], tc.Expected[j])
+			}
+		}
+		if state.Optind != tc.Optind {
+			t.Errorf("Unexpected OPTIND for case %d: got %v want %v", i, state.Optind, tc.Optind)
+		}
+	}
+}
+
+func TestGetoptsBuiltin(t *testing.T) {
+	os.Setenv("OPTIND", "1")
+	expected := []struct {
+		Opt, Optarg, Status string
+	}{
+		{"v", "", "0"},
+		{"o", "out", "0"},
+		{"?", "", "1"},
+	}
+	for i, e := range expected {
+		if err := Command("getopts vo: GOSHTESTOPT -v -o out file").HandleCmd(); err != nil {
+			t.Fatal(err)
+		}
+		if got := os.Getenv("GOSHTESTOPT"); got != e.Opt {
+			t.Errorf("Unexpected option for call %d: got %q want %q", i, got, e.Opt)
+		}
+		if got := os.Getenv("OPTARG"); got != e.Optarg {
+			t.Errorf("Unexpected $OPTARG for call %d: got %q want %q", i, got, e.Optarg)
+		}
+		if got := os.Getenv("?"); got != e.Status {
+			t.Errorf("Unexpected $? for call %d: got %q want %q", i, got, e.Status)
+		}
+	}
+	if got := os.Getenv("OPTIND"); got != "4" {
+		t.Errorf("Unexpected $OPTIND: got %q want 4", got)
+	}
+}
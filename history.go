@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// history is the lines that have been entered in this shell, oldest first.
+var history []string
+
+// historySize returns the maximum number of lines to keep in the history,
+// or -1 if there's no maximum.
+func historySize() int {
+	size, err := strconv.Atoi(os.Getenv("HISTSIZE"))
+	if err != nil {
+		return 500
+	}
+	if size < 0 {
+		return -1
+	}
+	return size
+}
+
+// historyEntry returns line as it should be added to hist, and whether the
+// history options say that it should be added at all.
+func historyEntry(hist []string, line string) (string, bool) {
+	if os.Getenv("HISTIGNORESPACE") == "on" && strings.HasPrefix(line, " ") {
+		return "", false
+	}
+	line = strings.TrimSpace(line)
+	if line == "" || historySize() == 0 {
+		return "", false
+	}
+	if os.Getenv("HISTDUPS") == "off" && len(hist) > 0 && hist[len(hist)-1] == line {
+		return "", false
+	}
+	return line, true
+}
+
+// appendHistory adds line to hist, unless the history options say that it
+// shouldn't be, and returns the new history.
+func appendHistory(hist []string, line string) []string {
+	line, ok := historyEntry(hist, line)
+	if !ok {
+		return hist
+	}
+	hist = append(hist, line)
+	if size := historySize(); size >= 0 && len(hist) > size {
+		hist = hist[len(hist)-size:]
+	}
+	return hist
+}
+
+// addHistory adds a line that was entered to the history. Lines from
+// scripts aren't history.
+func addHistory(line string) {
+	if !caps.Interactive {
+		return
+	}
+	entry, ok := historyEntry(history, line)
+	if !ok {
+		return
+	}
+	history = appendHistory(history, line)
+	if os.Getenv("HISTAPPEND") != "off" {
+		if err := writeHistoryLine(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "gosh: could not save history: %v\n", err)
+		}
+	}
+}
+
+// historyFile returns the name of the file that history is saved in.
+func historyFile() string {
+	if f := os.Getenv("HISTFILE"); f != "" {
+		return f
+	}
+	home, ok := homeDir("")
+	if !ok {
+		return ""
+	}
+	return filepath.Join(home, ".gosh_history")
+}
+
+// readHistory reads history lines from r.
+func readHistory(r io.Reader) []string {
+	var hist []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		hist = appendHistory(hist, scanner.Text())
+	}
+	return hist
+}
+
+// loadHistory loads the history from the history file.
+func loadHistory() {
+	f, err := openHistoryFile(os.O_RDWR)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		return
+	}
+	history = readHistory(strings.NewReader(string(contents)))
+	if os.Getenv("HISTAPPEND") == "off" || len(history) == strings.Count(string(contents), "\n") {
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if err := f.Truncate(0); err != nil {
+		return
+	}
+	for _, line := range history {
+		fmt.Fprintf(f, "%s\n", line)
+	}
+}
+
+// saveHistory writes the history to the history file.
+func saveHistory() error {
+	if !caps.Interactive || os.Getenv("HISTAPPEND") != "off" {
+		// The lines were saved as they were entered.
+		return nil
+	}
+	f, err := openHistoryFile(os.O_WRONLY | os.O_CREATE | os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, line := range history {
+		if _, err := fmt.Fprintf(f, "%s\n", line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exitShell saves the history, restores the terminal, and exits with status.
+func exitShell(status int) {
+	runExitTrap()
+	if err := saveHistory(); err != nil {
+		fmt.Fprintf(os.Stderr, "gosh: could not save history: %v\n", err)
+	}
+	restore()
+	os.Exit(status)
+}
+
+// History prints the history to w.
+func History(w io.Writer) error {
+	for i, line := range history {
+		if _, err := fmt.Fprintf(w, "%5d  %s\n", i+1, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openHistoryFile opens the history file with flag, and locks it. The lock
+// is released when the file is closed.
+func openHistoryFile(flag int) (*os.File, error) {
+	name := historyFile()
+	if name == "" {
+		return nil, os.ErrNotExist
+	}
+	f, err := os.OpenFile(name, flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeHistoryLine appends line to the history file.
+func writeHistoryLine(line string) error {
+	f, err := openHistoryFile(os.O_WRONLY | os.O_APPEND | os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s\n", line)
+	return err
+}
+
+// elevatedLine returns the last line in hist that didn't run redo-as, with
+// elevator in front of it.
+func elevatedLine(hist []string, elevator string) (string, error) {
+	for i := len(hist) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(hist[i])
+		if words, _ := expandAliases(Command(line).Tokenize()); len(words) == 0 || words[0] == "redo-as" {
+			continue
+		}
+		return elevator + " " + line, nil
+	}
+	return "", builtinError(ErrNotFound, "redo-as: no previous command")
+}
+
+// RedoAs implements the redo-as builtin.
+func RedoAs(args []string) error {
+	elevator := strings.Join(args, " ")
+	if elevator == "" {
+		elevator = os.Getenv("ELEVATE")
+	}
+	if elevator == "" {
+		elevator = "sudo"
+	}
+	line, err := elevatedLine(history, elevator)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, line)
+
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	return Command(line).Run(child)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// setHistoryOptions sets the history environment variables, and returns a
+// function which restores them.
+func setHistoryOptions(options map[string]string) func() {
+	old := make(map[string]string)
+	for _, name := range []string{"HISTSIZE", "HISTDUPS", "HISTIGNORESPACE", "HISTFILE", "HISTAPPEND"} {
+		old[name] = os.Getenv(name)
+		os.Setenv(name, options[name])
+	}
+	return func() {
+		for name, value := range old {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+func TestAppendHistory(t *testing.T) {
+	lines := []string{"ls", "ls", " secret", "", "make", "make\n", "ls"}
+	cases := []struct {
+		Options  map[string]string
+		Expected []string
+	}{
+		{nil, []string{"ls", "ls", "secret", "make", "make", "ls"}},
+		{map[string]string{"HISTDUPS": "off"}, []string{"ls", "secret", "make", "ls"}},
+		{map[string]string{"HISTIGNORESPACE": "on"}, []string{"ls", "ls", "make", "make", "ls"}},
+		{map[string]string{"HISTSIZE": "2"}, []string{"make", "ls"}},
+		{map[string]string{"HISTSIZE": "0"}, nil},
+		{map[string]string{"HISTSIZE": "-1", "HISTDUPS": "off", "HISTIGNORESPACE": "on"}, []string{"ls", "make", "ls"}},
+	}
+	for i, tc := range cases {
+		undo := setHistoryOptions(tc.Options)
+		var hist []string
+		for _, line := range lines {
+			hist = appendHistory(hist, line)
+		}
+		undo()
+		if strings.Join(hist, ",") != strings.Join(tc.Expected, ",") || len(hist) != len(tc.Expected) {
+			t.Errorf("Unexpected history for case %d (%v): got %q want %q", i, tc.Options, hist, tc.Expected)
+		}
+	}
+}
+
+func TestSaveHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshhistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setHistoryOptions(map[string]string{"HISTFILE": filepath.Join(dir, "history"), "HISTAPPEND": "off"})()
+
+	oldhistory, oldcaps := history, caps
+	defer func() { history, caps = oldhistory, oldcaps }()
+	caps.Interactive = true
+
+	history = []string{"ls", "cd /tmp", "make"}
+	if err := saveHistory(); err != nil {
+		t.Fatal(err)
+	}
+	history = nil
+	loadHistory()
+	if strings.Join(history, ",") != "ls,cd /tmp,make" {
+		t.Errorf("Unexpected history: got %q", history)
+	}
+
+	os.Setenv("HISTSIZE", "1")
+	loadHistory()
+	if len(history) != 1 || history[0] != "make" {
+		t.Errorf("Unexpected history with HISTSIZE 1: got %q", history)
+	}
+}
+
+func TestConcurrentHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshhistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "history")
+	defer setHistoryOptions(map[string]string{"HISTFILE": name, "HISTSIZE": "-1"})()
+
+	const lines = 200
+	var wg sync.WaitGroup
+	for _, writer := range []string{"first", "second"} {
+		wg.Add(1)
+		go func(writer string) {
+			defer wg.Done()
+			for i := 0; i < lines; i++ {
+				if err := writeHistoryLine(fmt.Sprintf("%s %d", writer, i)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(writer)
+	}
+	wg.Wait()
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	hist := readHistory(f)
+	if len(hist) != 2*lines {
+		t.Fatalf("Unexpected number of lines: got %v want %v", len(hist), 2*lines)
+	}
+	seen := make(map[string]bool)
+	for _, line := range hist {
+		seen[line] = true
+	}
+	for _, writer := range []string{"first", "second"} {
+		for i := 0; i < lines; i++ {
+			if line := fmt.Sprintf("%s %d", writer, i); !seen[line] {
+				t.Errorf("Missing line %q", line)
+			}
+		}
+	}
+}
+
+func TestLoadHistoryTrims(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshhistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "history")
+	defer setHistoryOptions(map[string]string{"HISTFILE": name, "HISTSIZE": "2", "HISTDUPS": "off"})()
+	if err := ioutil.WriteFile(name, []byte("ls\nmake\nmake\nls\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldhistory := history
+	defer func() { history = oldhistory }()
+	loadHistory()
+	if strings.Join(history, ",") != "make,ls" {
+		t.Errorf("Unexpected history: got %q", history)
+	}
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "make\nls\n" {
+		t.Errorf("Unexpected history file: got %q", contents)
+	}
+}
+
+func TestElevatedLine(t *testing.T) {
+	oldaliases := aliases
+	defer func() { aliases = oldaliases }()
+	aliases = map[string]string{"please": "redo-as", "l": "ls -l"}
+
+	cases := []struct {
+		History  []string
+		Elevator string
+		Expected string
+		Err      error
+	}{
+		{[]string{"ls", "apt install gosh"}, "sudo", "sudo apt install gosh", nil},
+		{[]string{"apt install gosh", "redo-as"}, "sudo", "sudo apt install gosh", nil},
+		{[]string{"apt install gosh", "redo-as", " redo-as doas"}, "doas", "doas apt install gosh", nil},
+		{[]string{"cat /etc/shadow", "please"}, "su root -c", "su root -c cat /etc/shadow", nil},
+		{[]string{"l /root", "please"}, "sudo", "sudo l /root", nil},
+		{[]string{"echo 'a  b' > /etc/motd", "redo-as"}, "sudo", "sudo echo 'a  b' > /etc/motd", nil},
+		{[]string{"redo-as", "please"}, "sudo", "", ErrNotFound},
+		{nil, "sudo", "", ErrNotFound},
+	}
+	for i, tc := range cases {
+		line, err := elevatedLine(tc.History, tc.Elevator)
+		if line != tc.Expected || !errors.Is(err, tc.Err) {
+			t.Errorf("Unexpected line for case %d: got %q, %v want %q, %v", i, line, err, tc.Expected, tc.Err)
+		}
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// wait4Func is the signature of syscall.Wait4, so that it can be replaced in
+// tests.
+type wait4Func func(pid int, status *syscall.WaitStatus, options int, rusage *syscall.Rusage) (int, error)
+
+// stoppedJobs is the process groups of the jobs which are stopped.
+var stoppedJobs = make(map[uint32]bool)
+
+// jobCommands is the command line that started each job, by process group.
+var jobCommands = make(map[uint32]string)
+
+// jobOrder is the process groups of jobs in the order that they became
+// the current job, most recent last.
+var jobOrder []uint32
+
+// promptDirty is true if we've told the user about a job since the prompt
+// was last drawn.
+var promptDirty bool
+
+// jobIDs is the job number of each job, by process group.
+var jobIDs = make(map[uint32]int)
+
+// signals is the number of each signal, by its name without the SIG prefix.
+var signals = map[string]syscall.Signal{
+	"HUP":    syscall.SIGHUP,
+	"INT":    syscall.SIGINT,
+	"QUIT":   syscall.SIGQUIT,
+	"ILL":    syscall.SIGILL,
+	"TRAP":   syscall.SIGTRAP,
+	"ABRT":   syscall.SIGABRT,
+	"BUS":    syscall.SIGBUS,
+	"FPE":    syscall.SIGFPE,
+	"KILL":   syscall.SIGKILL,
+	"USR1":   syscall.SIGUSR1,
+	"SEGV":   syscall.SIGSEGV,
+	"USR2":   syscall.SIGUSR2,
+	"PIPE":   syscall.SIGPIPE,
+	"ALRM":   syscall.SIGALRM,
+	"TERM":   syscall.SIGTERM,
+	"CHLD":   syscall.SIGCHLD,
+	"CONT":   syscall.SIGCONT,
+	"STOP":   syscall.SIGSTOP,
+	"TSTP":   syscall.SIGTSTP,
+	"TTIN":   syscall.SIGTTIN,
+	"TTOU":   syscall.SIGTTOU,
+	"URG":    syscall.SIGURG,
+	"XCPU":   syscall.SIGXCPU,
+	"XFSZ":   syscall.SIGXFSZ,
+	"VTALRM": syscall.SIGVTALRM,
+	"PROF":   syscall.SIGPROF,
+	"WINCH":  syscall.SIGWINCH,
+	"IO":     syscall.SIGIO,
+	"SYS":    syscall.SIGSYS,
+}
+
+// reapJobs checks each of the process groups in groups without blocking, and
+// returns the ones that are still running along with a notice for each one
+// that finished.
+func reapJobs(groups []uint32, wait4 wait4Func) (running []uint32, notices []string) {
+	for _, pg := range groups {
+		var status syscall.WaitStatus
+		pid, err := wait4(int(pg), &status, syscall.WNOHANG, nil)
+		switch {
+		case err == syscall.ECHILD:
+			// Something else already waited for it, so it's
+			// not our child anymore.
+		case err != nil || pid == 0:
+			// Still running, or we couldn't tell, so keep it.
+			running = append(running, pg)
+		case status.Exited():
+			notices = append(notices, exitNotice(pg, status))
+		case status.Signaled():
+			notices = append(notices, fmt.Sprintf("%v terminated by signal %v", pg, signalName(status.Signal())))
+		default:
+			running = append(running, pg)
+		}
+	}
+	return running, notices
+}
+
+// exitNotice returns the notice to tell the user that the background job with
+// the process group pg exited with status.
+func exitNotice(pg uint32, status syscall.WaitStatus) string {
+	return fmt.Sprintf("%v exited (exit status: %v)", pg, status.ExitStatus())
+}
+
+// ReapJobs removes any finished jobs from processGroups, and tells the user
+// about them.
+func ReapJobs() {
+	var notices []string
+	processGroups, notices = reapJobs(processGroups, syscall.Wait4)
+	for _, n := range notices {
+		fmt.Fprintf(os.Stderr, "%s\n", n)
+	}
+}
+
+// waitProcessGroup waits for every remaining process in the process group pg
+// to exit.
+func waitProcessGroup(pg uint32) {
+	for {
+		var status syscall.WaitStatus
+		_, err := syscall.Wait4(-int(pg), &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			// ECHILD means there's nothing left in the group.
+			return
+		}
+	}
+}
+
+// stopJob records that job number id, with the process group pg, has been
+// stopped, and returns a notice to tell the user about it.
+func stopJob(id int, pg uint32) string {
+	stoppedJobs[pg] = true
+	return fmt.Sprintf("Job %d (%d) stopped", id, pg)
+}
+
+// continueJob records that the job with the process group pg is running.
+func continueJob(pg uint32) {
+	delete(stoppedJobs, pg)
+}
+
+// parseJob returns the job number and process group of the job spec.
+func parseJob(spec string) (int, uint32, error) {
+	i, err := resolveJobSpec(spec)
+	if err != nil {
+		return 0, 0, err
+	}
+	return jobIDs[processGroups[i]], processGroups[i], nil
+}
+
+// signalGroup sends sig to every process in the process group pg. It's a
+// variable so that tests can replace it.
+var signalGroup = func(pg uint32, sig syscall.Signal) error {
+	return syscall.Kill(-int(pg), sig)
+}
+
+// jobCommand returns the command line c as it should be shown for a job.
+func jobCommand(c Command) string {
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(string(c)), "&"))
+}
+
+// Bg continues the stopped job named in args in the background, and tells
+// the user about it on w.
+func Bg(w io.Writer, args []string) error {
+	if len(args) < 1 {
+		return builtinError(ErrUsage, "Must specify job to background.")
+	}
+	i, pg, err := parseJob(args[0])
+	if err != nil {
+		return err
+	}
+	if err := signalGroup(pg, syscall.SIGCONT); err != nil {
+		return err
+	}
+	continueJob(pg)
+	fmt.Fprintf(w, "[%d] %s &\n", i, jobCommands[pg])
+	return nil
+}
+
+// resolveJobSpec returns the position in processGroups of the job that spec
+// refers to.
+func resolveJobSpec(spec string) (int, error) {
+	switch spec {
+	case "%%", "%+", "%-":
+		current, previous := currentJobs()
+		if spec == "%-" {
+			current = previous
+		}
+		if current < 0 {
+			return 0, builtinError(ErrNoSuchJob, "%s: no such job", spec)
+		}
+		return current, nil
+	}
+	name := strings.TrimPrefix(spec, "%")
+	if n, err := strconv.Atoi(name); err == nil {
+		for i, pg := range processGroups {
+			if id, ok := jobIDs[pg]; ok && id == n {
+				return i, nil
+			}
+		}
+		return 0, builtinError(ErrNoSuchJob, "Invalid job id %d", n)
+	}
+	if name == spec || name == "" || name == "?" {
+		return 0, builtinError(ErrNoSuchJob, "%s: no such job", spec)
+	}
+	match := func(cmd string) bool {
+		return strings.HasPrefix(cmd, name)
+	}
+	if name[0] == '?' {
+		match = func(cmd string) bool {
+			return strings.Contains(cmd, name[1:])
+		}
+	}
+	for i := len(processGroups) - 1; i >= 0; i-- {
+		if match(jobCommands[processGroups[i]]) {
+			return i, nil
+		}
+	}
+	return 0, builtinError(ErrNoSuchJob, "%s: no such job", spec)
+}
+
+// killArgs returns the arguments to run the kill program with for the
+// kill builtin's args, with job specs replaced by their process groups.
+func killArgs(args []string) ([]string, error) {
+	var options, targets []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			targets = append(targets, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || len(targets) > 0 {
+			targets = append(targets, arg)
+			continue
+		}
+		options = append(options, arg)
+		if (arg == "-s" || arg == "-n") && i+1 < len(args) {
+			// The signal is in the next argument.
+			i++
+			if _, ok := signalByName(args[i]); !ok {
+				return nil, builtinError(ErrInvalidArgument, "kill: %s: invalid signal specification", args[i])
+			}
+			options = append(options, args[i])
+		}
+	}
+
+	var converted bool
+	for i, target := range targets {
+		if !strings.HasPrefix(target, "%") {
+			continue
+		}
+		_, pg, err := parseJob(target)
+		if err != nil {
+			return nil, fmt.Errorf("kill: %w", err)
+		}
+		targets[i] = "-" + strconv.Itoa(int(pg))
+		converted = true
+	}
+	if !converted {
+		return args, nil
+	}
+	return append(append(options, "--"), targets...), nil
+}
+
+// Kill implements the kill builtin.
+func Kill(args []string) error {
+	kargs, err := killArgs(args)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("kill", kargs...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// setCurrentJob makes the job with the process group pg the current job.
+func setCurrentJob(pg uint32) {
+	order := make([]uint32, 0, len(jobOrder)+1)
+	for _, job := range jobOrder {
+		if job == pg {
+			continue
+		}
+		for _, running := range processGroups {
+			if job == running {
+				// Only keep the jobs which haven't ended.
+				order = append(order, job)
+				break
+			}
+		}
+	}
+	jobOrder = append(order, pg)
+}
+
+// currentJobs returns the job numbers of the current and previous jobs, or
+// -1 if there isn't one.
+func currentJobs() (current, previous int) {
+	var found []int
+	seen := make(map[int]bool)
+	add := func(i int) {
+		if !seen[i] && len(found) < 2 {
+			seen[i] = true
+			found = append(found, i)
+		}
+	}
+	for j := len(jobOrder) - 1; j >= 0; j-- {
+		for i, pg := range processGroups {
+			if pg == jobOrder[j] {
+				add(i)
+			}
+		}
+	}
+	for i := len(processGroups) - 1; i >= 0; i-- {
+		add(i)
+	}
+	for len(found) < 2 {
+		found = append(found, -1)
+	}
+	return found[0], found[1]
+}
+
+// redirectBackground sends the output of cmds that would go to the terminal
+// to the file named by $BACKGROUND_OUTPUT, if it's set, and returns the file.
+func redirectBackground(cmds []*exec.Cmd) (*os.File, error) {
+	name := os.Getenv("BACKGROUND_OUTPUT")
+	if name == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(replaceTilde(name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cmds {
+		if c.Stdout == os.Stdout {
+			c.Stdout = f
+		}
+		if c.Stderr == os.Stderr {
+			c.Stderr = f
+		}
+	}
+	return f, nil
+}
+
+// notifyJob tells the user about a change in the state of a job.
+func notifyJob(msg string) {
+	flushScreen()
+	fmt.Fprintf(os.Stderr, "%s\n", msg)
+	promptDirty = true
+}
+
+// checkJobs tells the user about any background jobs that finished while
+// they were editing a line.
+func checkJobs(child chan os.Signal) {
+	select {
+	case <-child:
+	default:
+		return
+	}
+	var notices []string
+	processGroups, notices = reapJobs(processGroups, syscall.Wait4)
+	if len(notices) > 0 {
+		// Start on the line after what the user typed.
+		fmt.Fprintf(screen, "\n")
+	}
+	for _, n := range notices {
+		notifyJob(n)
+	}
+}
+
+// redrawAfterJobs draws the prompt and the line being edited, c, again if
+// we've told the user about a job since the prompt was drawn, and returns
+// true if it did.
+func redrawAfterJobs(c Command) bool {
+	if !promptDirty {
+		return false
+	}
+	redrawLine(c)
+	promptDirty = false
+	return true
+}
+
+// addJob adds a job with the process group pg to processGroups, and returns
+// its job number.
+func addJob(pg uint32) int {
+	id := 0
+	ids := make(map[uint32]int, len(processGroups)+1)
+	for _, running := range processGroups {
+		if n, ok := jobIDs[running]; ok {
+			ids[running] = n
+			if n >= id {
+				id = n + 1
+			}
+		}
+	}
+	// Only keep the numbers of jobs that haven't ended, since their
+	// process groups can be reused.
+	ids[pg] = id
+	jobIDs = ids
+	processGroups = append(processGroups, pg)
+	return id
+}
+
+// WaitJobs implements the wait builtin.
+func WaitJobs(args []string) error {
+	if len(args) > 0 && args[0] == "-n" {
+		return waitNextJob()
+	}
+	groups := append([]uint32(nil), processGroups...)
+	if len(args) > 0 {
+		groups = nil
+		for _, spec := range args {
+			_, pg, err := parseJob(spec)
+			if err != nil {
+				return fmt.Errorf("wait: %v", err)
+			}
+			groups = append(groups, pg)
+		}
+	}
+	for _, pg := range groups {
+		var status syscall.WaitStatus
+		_, err := syscall.Wait4(int(pg), &status, 0, nil)
+		for err == syscall.EINTR {
+			_, err = syscall.Wait4(int(pg), &status, 0, nil)
+		}
+		waitProcessGroup(pg)
+		removeJob(pg)
+		if err == nil {
+			// Otherwise, something else waited for it and
+			// already told the user how it ended.
+			os.Setenv("?", strconv.Itoa(exitStatus(status)))
+		}
+	}
+	return nil
+}
+
+// waitNextJob waits for the first of the running jobs to finish.
+func waitNextJob() error {
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	for {
+		var running []uint32
+		for _, pg := range processGroups {
+			if !stoppedJobs[pg] {
+				running = append(running, pg)
+			}
+		}
+		if len(running) == 0 {
+			return builtinError(ErrNoSuchJob, "wait: no running jobs")
+		}
+		for _, pg := range running {
+			var status syscall.WaitStatus
+			pid, err := syscall.Wait4(int(pg), &status, syscall.WNOHANG, nil)
+			switch {
+			case err == syscall.ECHILD:
+				// Something else already waited for it.
+				removeJob(pg)
+			case err == nil && pid == int(pg):
+				waitProcessGroup(pg)
+				removeJob(pg)
+				os.Setenv("?", strconv.Itoa(exitStatus(status)))
+				return nil
+			}
+		}
+		<-child
+	}
+}
+
+// removeJob removes the job with the process group pg from processGroups.
+func removeJob(pg uint32) {
+	running := make([]uint32, 0, len(processGroups))
+	for _, job := range processGroups {
+		if job != pg {
+			running = append(running, job)
+		}
+	}
+	processGroups = running
+	continueJob(pg)
+}
+
+// exitStatus returns the exit status for $? of a process that ended with
+// status.
+func exitStatus(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// signalByName returns the signal called name, which can be a name like
+// SIGINT or INT, or a number, and whether there is one.
+func signalByName(name string) (syscall.Signal, bool) {
+	if n, err := strconv.Atoi(name); err == nil {
+		for _, sig := range signals {
+			if sig == syscall.Signal(n) {
+				return sig, true
+			}
+		}
+		// 0 isn't a signal, but kill uses it to check for a process.
+		return 0, n == 0
+	}
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	return sig, ok
+}
+
+// signalName returns the name of sig, like SIGINT, or its number if we don't
+// know its name.
+func signalName(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return strconv.Itoa(int(sig))
+}
+
+// stopStarted kills the commands in cmds, which have all been started, and
+// waits for them to exit.
+func stopStarted(cmds []*exec.Cmd) {
+	for _, c := range cmds {
+		c.Process.Kill()
+	}
+	for _, c := range cmds {
+		c.Wait()
+	}
+}
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReapJobs(t *testing.T) {
+	type result struct {
+		pid    int
+		status syscall.WaitStatus
+		err    error
+	}
+	results := map[int]result{
+		// Still running
+		100: {0, 0, nil},
+		// Exited with status 0
+		200: {200, 0, nil},
+		// Exited with status 3
+		300: {300, 3 << 8, nil},
+		// Killed with SIGKILL
+		400: {400, syscall.WaitStatus(syscall.SIGKILL), nil},
+		// Already reaped
+		500: {-1, 0, syscall.ECHILD},
+		// Some other error
+		600: {-1, 0, syscall.EINTR},
+	}
+	fakeWait := func(pid int, status *syscall.WaitStatus, options int, rusage *syscall.Rusage) (int, error) {
+		if options&syscall.WNOHANG == 0 {
+			t.Errorf("wait for %d would block", pid)
+		}
+		r := results[pid]
+		*status = r.status
+		return r.pid, r.err
+	}
+
+	running, notices := reapJobs([]uint32{100, 200, 300, 400, 500, 600}, fakeWait)
+
+	expectedRunning := []uint32{100, 600}
+	if len(running) != len(expectedRunning) {
+		t.Fatalf("Unexpected running jobs: got %v want %v", running, expectedRunning)
+	}
+	for i := range running {
+		if running[i] != expectedRunning[i] {
+			t.Errorf("Unexpected running job %d: got %v want %v", i, running[i], expectedRunning[i])
+		}
+	}
+
+	expectedNotices := []string{
+		"200 exited (exit status: 0)",
+		"300 exited (exit status: 3)",
+		"400 terminated by signal SIGKILL",
+	}
+	if len(notices) != len(expectedNotices) {
+		t.Fatalf("Unexpected notices: got %v want %v", notices, expectedNotices)
+	}
+	for i := range notices {
+		if notices[i] != expectedNotices[i] {
+			t.Errorf("Unexpected notice %d: got %v want %v", i, notices[i], expectedNotices[i])
+		}
+	}
+}
+
+func TestStopJob(t *testing.T) {
+	oldstopped := stoppedJobs
+	defer func() { stoppedJobs = oldstopped }()
+	stoppedJobs = make(map[uint32]bool)
+
+	if notice := stopJob(2, 1234); notice != "Job 2 (1234) stopped" {
+		t.Errorf("Unexpected notice: got %q", notice)
+	}
+	if !stoppedJobs[1234] {
+		t.Error("Job was not recorded as stopped")
+	}
+	continueJob(1234)
+	if stoppedJobs[1234] {
+		t.Error("Job was still recorded as stopped after continuing")
+	}
+}
+
+func TestStoppedForegroundJob(t *testing.T) {
+	oldgroups, oldstopped := processGroups, stoppedJobs
+	defer func() { processGroups, stoppedJobs = oldgroups, oldstopped }()
+	processGroups, stoppedJobs = nil, make(map[uint32]bool)
+
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	// The shell would expand the $$ if it was on the command line.
+	script, err := ioutil.TempFile("", "goshstop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(script.Name())
+	fmt.Fprintf(script, "kill -STOP $$\n")
+	script.Close()
+
+	if err := Command("sh " + script.Name()).Run(child); err != nil {
+		t.Fatal(err)
+	}
+	if len(processGroups) != 1 {
+		t.Fatalf("Unexpected jobs: %v", processGroups)
+	}
+	pg := processGroups[0]
+	defer waitProcessGroup(pg)
+	defer syscall.Kill(-int(pg), syscall.SIGKILL)
+	if !stoppedJobs[pg] {
+		t.Errorf("Job %d was not recorded as stopped", pg)
+	}
+	if ForegroundPid != 0 {
+		t.Errorf("Shell did not take back the foreground from %d", ForegroundPid)
+	}
+
+	if out, expected := runBuiltin(t, "jobs"), fmt.Sprintf("Job 0 (%d) stopped\n", pg); !strings.Contains(out, expected) {
+		t.Errorf("Unexpected job listing: got %q want %q", out, expected)
+	}
+}
+
+func TestBg(t *testing.T) {
+	oldgroups, oldids, oldstopped, oldcommands, oldsignal := processGroups, jobIDs, stoppedJobs, jobCommands, signalGroup
+	defer func() {
+		processGroups, jobIDs, stoppedJobs, jobCommands, signalGroup = oldgroups, oldids, oldstopped, oldcommands, oldsignal
+	}()
+	processGroups = []uint32{100, 200}
+	jobIDs = map[uint32]int{100: 0, 200: 1}
+	stoppedJobs = map[uint32]bool{200: true}
+	jobCommands = map[uint32]string{100: "make", 200: "sleep 10 | cat"}
+
+	var signalled []uint32
+	signalGroup = func(pg uint32, sig syscall.Signal) error {
+		if sig != syscall.SIGCONT {
+			t.Errorf("Unexpected signal %v", sig)
+		}
+		signalled = append(signalled, pg)
+		return nil
+	}
+
+	var out bytes.Buffer
+	if err := Bg(&out, []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "[1] sleep 10 | cat &\n" {
+		t.Errorf("Unexpected output: got %q", out.String())
+	}
+	if len(signalled) != 1 || signalled[0] != 200 {
+		t.Errorf("Unexpected process groups signalled: %v", signalled)
+	}
+	if stoppedJobs[200] {
+		t.Error("Job was still recorded as stopped")
+	}
+	if ForegroundPid != 0 {
+		t.Errorf("Job was made the foreground job")
+	}
+
+	for _, args := range [][]string{nil, {"2"}, {"-1"}, {"x"}} {
+		if err := Bg(&out, args); err == nil {
+			t.Errorf("Expected error for bg %v", args)
+		}
+	}
+}
+
+func TestJobCommand(t *testing.T) {
+	cases := []struct {
+		Cmd      Command
+		Expected string
+	}{
+		{"sleep 10", "sleep 10"},
+		{"sleep 10 &", "sleep 10"},
+		{"  sleep 10&\n", "sleep 10"},
+		{"ls | wc -l", "ls | wc -l"},
+	}
+	for i, tc := range cases {
+		if got := jobCommand(tc.Cmd); got != tc.Expected {
+			t.Errorf("Unexpected command for case %d: got %q want %q", i, got, tc.Expected)
+		}
+	}
+}
+
+// setJobs replaces the job table with jobs, numbered from 0, which have
+// process groups starting at 100, and returns a function to put it back.
+func setJobs(jobs ...string) func() {
+	oldgroups, oldids, oldcommands := processGroups, jobIDs, jobCommands
+	processGroups, jobIDs, jobCommands = nil, make(map[uint32]int), make(map[uint32]string)
+	for i, cmd := range jobs {
+		pg := uint32(100 * (i + 1))
+		processGroups = append(processGroups, pg)
+		jobIDs[pg] = i
+		jobCommands[pg] = cmd
+	}
+	return func() {
+		processGroups, jobIDs, jobCommands = oldgroups, oldids, oldcommands
+	}
+}
+
+func TestResolveJobSpec(t *testing.T) {
+	defer setJobs("sleep 10", "vi foo.go", "sleep 20 | cat", "make")()
+
+	cases := []struct {
+		Spec     string
+		Expected int
+		Err      bool
+	}{
+		{"1", 1, false},
+		{"%1", 1, false},
+		{"%3", 3, false},
+		{"%4", 0, true},
+		{"%sleep", 2, false},
+		{"%sleep 10", 0, false},
+		{"%vi", 1, false},
+		{"%?foo", 1, false},
+		{"%?cat", 2, false},
+		{"%?", 0, true},
+		{"%emacs", 0, true},
+		{"%?bar", 0, true},
+		{"sleep", 0, true},
+	}
+	for i, tc := range cases {
+		got, err := resolveJobSpec(tc.Spec)
+		if tc.Err {
+			if err == nil {
+				t.Errorf("Expected error for case %d (%v), got %v", i, tc.Spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for case %d (%v): %v", i, tc.Spec, err)
+		} else if got != tc.Expected {
+			t.Errorf("Unexpected job for case %d (%v): got %v want %v", i, tc.Spec, got, tc.Expected)
+		}
+	}
+}
+
+func TestKillArgs(t *testing.T) {
+	defer setJobs("sleep 10", "vi foo.go")()
+
+	cases := []struct {
+		Args     []string
+		Expected []string
+	}{
+		{[]string{"1234"}, []string{"1234"}},
+		{[]string{"-9", "1234"}, []string{"-9", "1234"}},
+		{[]string{"%1"}, []string{"--", "-200"}},
+		{[]string{"-9", "%sleep", "1234"}, []string{"-9", "--", "-100", "1234"}},
+		{[]string{"-s", "HUP", "%?foo"}, []string{"-s", "HUP", "--", "-200"}},
+		{[]string{"--", "%0"}, []string{"--", "-100"}},
+	}
+	for i, tc := range cases {
+		got, err := killArgs(tc.Args)
+		if err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+		} else if strings.Join(got, " ") != strings.Join(tc.Expected, " ") {
+			t.Errorf("Unexpected args for case %d: got %q want %q", i, got, tc.Expected)
+		}
+	}
+	if _, err := killArgs([]string{"%emacs"}); err == nil {
+		t.Error("Expected error for a job that doesn't exist")
+	}
+}
+
+func TestCurrentJobs(t *testing.T) {
+	defer setJobs()()
+	oldorder := jobOrder
+	defer func() { jobOrder = oldorder }()
+	jobOrder = nil
+
+	start := func(pg uint32) {
+		processGroups = append(processGroups, pg)
+		setCurrentJob(pg)
+	}
+	end := func(pg uint32) {
+		for i, job := range processGroups {
+			if job == pg {
+				processGroups = append(processGroups[:i:i], processGroups[i+1:]...)
+				return
+			}
+		}
+	}
+
+	steps := []struct {
+		Event             func()
+		Current, Previous int
+	}{
+		{func() {}, -1, -1},
+		{func() { start(100) }, 0, -1},
+		{func() { start(200) }, 1, 0},
+		{func() { start(300) }, 2, 1},
+		// Stopping job 0 makes it current.
+		{func() { setCurrentJob(100) }, 0, 2},
+		// A foreground job that finishes doesn't change anything.
+		{func() { start(400); end(400) }, 0, 2},
+		// When the current job ends, the previous one is current.
+		{func() { end(100) }, 1, 0},
+		// When the previous job ends, the most recent job fills in.
+		{func() { start(500); end(200) }, 1, 0},
+	}
+	for i, step := range steps {
+		step.Event()
+		current, previous := currentJobs()
+		if current != step.Current || previous != step.Previous {
+			t.Errorf("Unexpected jobs after step %d: got %d, %d want %d, %d", i, current, previous, step.Current, step.Previous)
+		}
+	}
+
+	for spec, expected := range map[string]int{"%%": 1, "%+": 1, "%-": 0} {
+		if got, err := resolveJobSpec(spec); err != nil || got != expected {
+			t.Errorf("Unexpected job for %v: got %v (%v) want %v", spec, got, err, expected)
+		}
+	}
+}
+
+func TestRedrawAfterJobs(t *testing.T) {
+	oldgroups, olddirty := processGroups, promptDirty
+	defer func() { processGroups, promptDirty = oldgroups, olddirty }()
+
+	promptDirty = false
+	if redrawAfterJobs("ls") {
+		t.Error("Redrew the line without any job notices")
+	}
+	notifyJob("1234 exited (exit status: 0)")
+	if !promptDirty {
+		t.Error("Telling the user about a job did not mark the prompt dirty")
+	}
+	if !redrawAfterJobs("ls") {
+		t.Error("Did not redraw the line after a job notice")
+	}
+	if redrawAfterJobs("ls") {
+		t.Error("Redrew the line twice for the same notice")
+	}
+
+	cmd := exec.Command("true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	processGroups = []uint32{uint32(cmd.Process.Pid)}
+	child := make(chan os.Signal, 1)
+	for deadline := time.Now().Add(5 * time.Second); !promptDirty; {
+		if time.Now().After(deadline) {
+			t.Fatal("Background job did not finish")
+		}
+		// Send the SIGCHLD ourselves, since the job may have finished
+		// before we could be notified.
+		child <- syscall.SIGCHLD
+		checkJobs(child)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(processGroups) != 0 {
+		t.Errorf("Finished job was not removed: %v", processGroups)
+	}
+	if !redrawAfterJobs("ls") {
+		t.Error("Did not redraw the line after a background job finished")
+	}
+}
+
+func TestRedirectBackground(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshbackground")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv("BACKGROUND_OUTPUT")
+
+	os.Unsetenv("BACKGROUND_OUTPUT")
+	cmd := exec.Command("echo", "one")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if f, err := redirectBackground([]*exec.Cmd{cmd}); f != nil || err != nil || cmd.Stdout != os.Stdout {
+		t.Errorf("Redirected output without $BACKGROUND_OUTPUT: %v %v", f, err)
+	}
+
+	out := filepath.Join(dir, "out")
+	os.Setenv("BACKGROUND_OUTPUT", out)
+	var buf bytes.Buffer
+	redirected := exec.Command("echo", "ignored")
+	redirected.Stdout = &buf
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command("sh", "-c", "echo out; echo err >&2")
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		f, err := redirectBackground([]*exec.Cmd{cmd, redirected})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Run(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	if redirected.Stdout != &buf {
+		t.Error("Output that was already redirected was sent to $BACKGROUND_OUTPUT")
+	}
+	if got, _ := ioutil.ReadFile(out); string(got) != "out\nerr\nout\nerr\n" {
+		t.Errorf("Unexpected background output: got %q", got)
+	}
+}
+
+func TestStableJobIDs(t *testing.T) {
+	defer setJobs()()
+
+	for i, pg := range []uint32{100, 200, 300} {
+		jobCommands[pg] = fmt.Sprintf("sleep %d", i)
+		if id := addJob(pg); id != i {
+			t.Errorf("Unexpected job number for %d: got %d want %d", pg, id, i)
+		}
+	}
+	// Job 0 ends.
+	processGroups = processGroups[1:]
+
+	cases := []struct {
+		Spec string
+		ID   int
+		Pg   uint32
+		Err  bool
+	}{
+		{"%0", 0, 0, true},
+		{"%1", 1, 200, false},
+		{"%2", 2, 300, false},
+		{"%3", 0, 0, true},
+		{"%sleep 2", 2, 300, false},
+	}
+	for i, tc := range cases {
+		id, pg, err := parseJob(tc.Spec)
+		if tc.Err {
+			if err == nil {
+				t.Errorf("Expected error for case %d (%v), got job %d", i, tc.Spec, id)
+			}
+			continue
+		}
+		if err != nil || id != tc.ID || pg != tc.Pg {
+			t.Errorf("Unexpected job for case %d (%v): got %d, %d (%v) want %d, %d", i, tc.Spec, id, pg, err, tc.ID, tc.Pg)
+		}
+	}
+
+	if id := addJob(400); id != 3 {
+		t.Errorf("Unexpected job number after a job ended: got %d want 3", id)
+	}
+	if id, _, _ := parseJob("%2"); id != 2 {
+		t.Errorf("Job was renumbered: got %d want 2", id)
+	}
+	processGroups = nil
+	if id := addJob(500); id != 0 {
+		t.Errorf("Job numbers did not start over: got %d want 0", id)
+	}
+}
+
+func TestWaitNext(t *testing.T) {
+	defer setJobs()()
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	defer os.Unsetenv("?")
+
+	for _, c := range []Command{"sleep 10 &", "sh -c 'sleep 0.1; exit 3' &"} {
+		if err := c.Run(child); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(processGroups) != 2 {
+		t.Fatalf("Unexpected jobs: %v", processGroups)
+	}
+	slow := processGroups[0]
+	defer waitProcessGroup(slow)
+	defer syscall.Kill(-int(slow), syscall.SIGKILL)
+
+	start := time.Now()
+	if err := WaitJobs([]string{"-n"}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("wait -n waited for the slow job (%v)", elapsed)
+	}
+	if status := os.Getenv("?"); status != "3" {
+		t.Errorf("Unexpected status: got %v want 3", status)
+	}
+	if len(processGroups) != 1 || processGroups[0] != slow {
+		t.Errorf("Unexpected jobs after wait -n: got %v want [%d]", processGroups, slow)
+	}
+
+	syscall.Kill(-int(slow), syscall.SIGKILL)
+	if err := WaitJobs(nil); err != nil {
+		t.Fatal(err)
+	}
+	if status := os.Getenv("?"); status != "137" {
+		t.Errorf("Unexpected status for a killed job: got %v want 137", status)
+	}
+	if len(processGroups) != 0 {
+		t.Errorf("Unexpected jobs after wait: %v", processGroups)
+	}
+	if err := WaitJobs([]string{"-n"}); err == nil {
+		t.Error("Expected an error for wait -n with no jobs")
+	}
+}
+
+func TestWaitNextOnlyJobs(t *testing.T) {
+	defer setJobs()()
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	defer os.Unsetenv("?")
+
+	// A child that isn't a job, like part of a foreground pipeline,
+	// which finishes first.
+	other := exec.Command("sh", "-c", "exit 5")
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Command("sh -c 'sleep 0.2; exit 3' &").Run(child); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitJobs([]string{"-n"}); err != nil {
+		t.Fatal(err)
+	}
+	if status := os.Getenv("?"); status != "3" {
+		t.Errorf("Unexpected status: got %v want 3", status)
+	}
+	if err := other.Wait(); err == nil || other.ProcessState == nil || other.ProcessState.ExitCode() != 5 {
+		t.Errorf("The other child was waited for by wait -n: %v", err)
+	}
+
+	// A stopped job won't finish, so there's nothing to wait for.
+	if err := Command("sleep 10 &").Run(child); err != nil {
+		t.Fatal(err)
+	}
+	stopped := processGroups[0]
+	defer waitProcessGroup(stopped)
+	defer syscall.Kill(-int(stopped), syscall.SIGKILL)
+	stopJob(0, stopped)
+	done := make(chan error, 1)
+	go func() { done <- WaitJobs([]string{"-n"}) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrNoSuchJob) {
+			t.Errorf("Unexpected error with only a stopped job: got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait -n blocked on a stopped job")
+	}
+}
+
+func TestSignalNames(t *testing.T) {
+	for name, sig := range signals {
+		if got := signalName(sig); got != "SIG"+name {
+			t.Errorf("Unexpected name for %d: got %v want %v", sig, got, "SIG"+name)
+		}
+		for _, alias := range []string{name, "SIG" + name, strings.ToLower(name), strconv.Itoa(int(sig))} {
+			if s, ok := signalByName(alias); !ok || s != sig {
+				t.Errorf("Unexpected signal for %v: got %v (%v) want %v", alias, s, ok, sig)
+			}
+		}
+	}
+	for _, name := range []string{"INT", "SIGINT", "2"} {
+		if s, ok := signalByName(name); !ok || s != syscall.SIGINT {
+			t.Errorf("Unexpected signal for %v: got %v want SIGINT", name, s)
+		}
+	}
+	for _, name := range []string{"", "SIG", "NOTASIGNAL", "-1", "1000"} {
+		if s, ok := signalByName(name); ok {
+			t.Errorf("Unexpected signal for %q: %v", name, s)
+		}
+	}
+	if name := signalName(syscall.Signal(1000)); name != "1000" {
+		t.Errorf("Unexpected name for an unknown signal: got %v", name)
+	}
+
+	defer setJobs("sleep 10")()
+	if _, err := killArgs([]string{"-s", "NOTASIGNAL", "%0"}); err == nil {
+		t.Error("Expected error for an invalid signal")
+	}
+	if got, err := killArgs([]string{"-s", "SIGTERM", "%0"}); err != nil || strings.Join(got, " ") != "-s SIGTERM -- -100" {
+		t.Errorf("Unexpected args: got %q (%v)", got, err)
+	}
+}
+
+func TestExitMessages(t *testing.T) {
+	defer setJobs()()
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	stderr, err := ioutil.TempFile("", "goshstderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+	oldstderr := os.Stderr
+	defer func() { os.Stderr = oldstderr }()
+	os.Stderr = stderr
+
+	if err := Command("sh -c 'exit 4' &").Run(child); err != nil {
+		t.Fatal(err)
+	}
+	background := processGroups[0]
+	if err := Command("sh -c 'sleep 0.5; exit 2'").Run(child); err != nil {
+		t.Fatal(err)
+	}
+	os.Stderr = oldstderr
+
+	out, _ := ioutil.ReadFile(stderr.Name())
+	if expected := fmt.Sprintf("%d exited (exit status: 4)\n", background); string(out) != expected {
+		t.Errorf("Unexpected exit messages: got %q want %q", out, expected)
+	}
+	if status := os.Getenv("?"); status != "2" {
+		t.Errorf("Unexpected $?: got %v want 2", status)
+	}
+	if len(processGroups) != 0 {
+		t.Errorf("Unexpected jobs: %v", processGroups)
+	}
+}
+
+func TestForegroundSignaled(t *testing.T) {
+	defer setJobs()()
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	defer os.Unsetenv("?")
+
+	stderr, err := ioutil.TempFile("", "goshstderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+	oldstderr := os.Stderr
+	defer func() { os.Stderr = oldstderr }()
+	os.Stderr = stderr
+
+	go func() {
+		for {
+			if pg := atomic.LoadUint32(&ForegroundPid); pg != 0 {
+				syscall.Kill(-int(pg), syscall.SIGKILL)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	if err := Command("sleep 10").Run(child); err != nil {
+		t.Fatal(err)
+	}
+	os.Stderr = oldstderr
+
+	if out, _ := ioutil.ReadFile(stderr.Name()); len(out) != 0 {
+		t.Errorf("Unexpected notice for the foreground job: %q", out)
+	}
+	if status := os.Getenv("?"); status != "137" {
+		t.Errorf("Unexpected $?: got %v want 137", status)
+	}
+}
+
+func TestPipelineStartFailure(t *testing.T) {
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	defer setJobs()()
+
+	start := time.Now()
+	err := Command("sleep 31.7 | /nonexistent/gosh | cat").Run(child)
+	if err == nil || err.Error() != "gosh: /nonexistent/gosh: No such file or directory" {
+		t.Errorf("Unexpected error: got %v", err)
+	}
+	if status := os.Getenv("?"); status != "127" {
+		t.Errorf("Unexpected $?: got %v want 127", status)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Took too long to fail: %v", d)
+	}
+	if len(processGroups) != 0 {
+		t.Errorf("Unexpected jobs: %v", processGroups)
+	}
+
+	// The sleep shouldn't still be around, running or as a zombie.
+	procs, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, p := range procs {
+		stat, _ := ioutil.ReadFile(p)
+		if fields := strings.Fields(string(stat)); len(fields) > 3 && fields[1] == "(sleep)" && fields[3] == strconv.Itoa(os.Getpid()) {
+			t.Errorf("First command in the pipeline is still around: %s", stat)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// parseKey parses a key description from a variable such as $COMPLETION_KEY.
+// It accepts caret notation (^I), "tab", or a single literal character, and
+// returns def if s is empty or can't be parsed.
+func parseKey(s string, def rune) rune {
+	if strings.ToLower(s) == "tab" {
+		return '\t'
+	}
+	if len(s) == 2 && s[0] == '^' {
+		if s[1] == '?' {
+			return '\u007f'
+		}
+		return rune(strings.ToUpper(s)[1]) & 0x1f
+	}
+	if utf8.RuneCountInString(s) == 1 {
+		r, _ := utf8.DecodeRuneInString(s)
+		return r
+	}
+	return def
+}
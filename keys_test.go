@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	cases := []struct {
+		Val      string
+		Expected rune
+	}{
+		// Empty uses the default
+		{"", 'x'},
+		{"tab", '\t'},
+		{"^I", '\t'},
+		{"^d", '\u0004'},
+		{"^?", '\u007f'},
+		{"?", '?'},
+		// Invalid values use the default
+		{"abc", 'x'},
+		{"^", '^'},
+	}
+	for i, tc := range cases {
+		if got := parseKey(tc.Val, 'x'); got != tc.Expected {
+			t.Errorf("Unexpected key for case %d: got %q want %q", i, got, tc.Expected)
+		}
+	}
+}
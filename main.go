@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/pkg/term"
 	"io"
+	"math/rand"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -14,8 +15,9 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
-	"unsafe"
+	"time"
 )
 
 type Command string
@@ -23,6 +25,20 @@ type ParsedCommand struct {
 	Args   []string
 	Stdin  string
 	Stdout string
+	// Redirects are the redirections other than the plain < and > that
+	// are in Stdin and Stdout, in the order that they appeared.
+	Redirects []Redirect
+}
+
+// Redirect is a redirection of a file descriptor for a command.
+type Redirect struct {
+	// Fd is the file descriptor being redirected.
+	Fd int
+	// Op is the redirection operator, either "<", ">", or ">&".
+	Op string
+	// Target is the file name, or the file descriptor being copied for
+	// ">&".
+	Target string
 }
 
 var terminal *term.Term
@@ -31,239 +47,553 @@ var processGroups []uint32
 var ForegroundPid uint32
 var ForegroundProcess error = errors.New("Process is a foreground process")
 var homedirRe *regexp.Regexp = regexp.MustCompile("^~([a-zA-Z]*)?(/*)?")
+var input *bufio.Reader
+
+// currentUser looks up the user that's running the shell.
+var currentUser = user.Current
+
+// random generates the values of $RANDOM.
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// secondsStart is when $SECONDS was 0.
+var secondsStart = time.Now()
+
+// lineNumber is the line number of the command that's running in the script
+// that it's from.
+var lineNumber int
 
 func main() {
-	// Initialize the terminal
-	t, err := term.Open("/dev/tty")
-	if err != nil {
-		panic(err)
+	login := isLoginShell(os.Args)
+	if len(os.Args) > 1 && os.Args[1] == "-l" {
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
+	}
+	// Where we read commands from when we're not editing a line.
+	var script io.Reader = os.Stdin
+	commandOption := len(os.Args) > 2 && os.Args[1] == "-c"
+	if commandOption {
+		script = strings.NewReader(os.Args[2])
+	} else if len(os.Args) > 1 {
+		f, err := os.Open(os.Args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
+			os.Exit(127)
+		}
+		script = f
+	}
+	caps = detectCapabilities(os.Getenv("TERM"), script == os.Stdin && isTerminal(syscall.Stdin), isTerminal(syscall.Stdout))
+	if caps.JobControl {
+		// Initialize the terminal
+		t, err := term.Open("/dev/tty")
+		if err != nil {
+			panic(err)
+		}
+		// Restore the previous terminal settings at the end of the program
+		defer t.Restore()
+		terminal = t
+		cbreak()
 	}
-	// Restore the previous terminal settings at the end of the program
-	defer t.Restore()
-	t.SetCbreak()
-	terminal = t
 
-	child := make(chan os.Signal)
+	child := make(chan os.Signal, 1)
 	signal.Notify(child, syscall.SIGCHLD)
 	signal.Ignore(
 		syscall.SIGTTOU,
 		syscall.SIGINT,
 	)
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGTSTP)
 	os.Setenv("$", "$")
 	os.Setenv("SHELL", os.Args[0])
-	if u, err := user.Current(); err == nil {
-		SourceFile(u.HomeDir + "/.goshrc")
+	os.Setenv("0", shellName(os.Args))
+	if home, ok := homeDir(""); ok {
+		for _, f := range startupFiles(home, login, caps.Interactive) {
+			if err := SourceFile(f); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "%v\n", sourceFailed(err))
+			}
+		}
+	}
+	if caps.Interactive {
+		loadHistory()
 	}
 	PrintPrompt()
-	r := bufio.NewReader(t)
+	if !caps.LineEditing {
+		input = bufio.NewReader(script)
+		lineno := 1
+		for {
+			line, err := readCommand(input)
+			if line != "" {
+				addHistory(line)
+				cmd := Command(strings.TrimSpace(line))
+				lineNumber = lineno
+				if status, ok := exitCommand(cmd); ok {
+					exitShell(status)
+				} else if cmd != "" {
+					if err := cmd.Run(child); err != nil {
+						fmt.Fprintf(os.Stderr, "%v\n", err)
+					}
+				}
+				runTraps()
+				ReapJobs()
+				PrintPrompt()
+				lineno += strings.Count(line, "\n")
+			}
+			if err != nil {
+				if err != io.EOF {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+				}
+				exitShell(lastStatus())
+			}
+		}
+	}
+	input = bufio.NewReader(terminal)
 	var cmd Command
+	// The position of the cursor in cmd, in runes.
+	var cursor int
 	for {
-		c, _, err := r.ReadRune()
+		c, _, err := input.ReadRune()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "%v\n", err)
-			continue
+			switch {
+			case retryRead(err):
+				continue
+			case terminalClosed(err):
+				exitShell(0)
+			default:
+				fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
+				exitShell(1)
+			}
+		}
+		checkJobs(child)
+		if runTraps() {
+			promptDirty = true
+		}
+		if redrawAfterJobs(cmd) {
+			moveCursor(cmd, len([]rune(string(cmd))), cursor)
+		}
+		if c == '\u0004' && len(cmd) == 0 {
+			exitShell(0)
+		}
+		completeKey := parseKey(os.Getenv("COMPLETION_KEY"), '\t')
+		listKey := parseKey(os.Getenv("COMPLETION_LIST_KEY"), '\u0004')
+		kills.NextCommand()
+		if c != completeKey {
+			completionPending = false
+		}
+		if c != completeKey && c != '\u001b' {
+			menu = nil
 		}
 		switch c {
 		case '\n':
 			// The terminal doesn't echo in raw mode,
 			// so print the newline itself to the terminal.
-			fmt.Printf("\n")
+			fmt.Fprintf(screen, "\n")
+			if _, err := cmd.Parse(); err == ErrIncomplete {
+				cmd += "\n"
+				cursor = len([]rune(string(cmd)))
+				PrintContinuationPrompt()
+				break
+			}
+			flushScreen()
 
-			if cmd == "exit" || cmd == "quit" {
-				t.Restore()
-				os.Exit(0)
-			} else if cmd == "" {
-				PrintPrompt()
-			} else {
-				err := cmd.HandleCmd()
-				if err == ForegroundProcess {
-					Wait(child)
-				} else if err != nil {
+			addHistory(string(cmd))
+			if status, ok := exitCommand(cmd); ok {
+				exitShell(status)
+			} else if cmd != "" {
+				if err := cmd.Run(child); err != nil {
 					fmt.Fprintf(os.Stderr, "%v\n", err)
 				}
-				PrintPrompt()
 			}
-			cmd = ""
-		case '\u0004':
-			if len(cmd) == 0 {
-				os.Exit(0)
+			runTraps()
+			ReapJobs()
+			PrintPrompt()
+			// The prompt was just drawn after telling the user about
+			// any jobs, so it doesn't need to be drawn again.
+			promptDirty = false
+			cmd, cursor = "", 0
+		case completeKey:
+			// Completion is always at the end of the line.
+			cursor = moveCursor(cmd, cursor, len([]rune(string(cmd))))
+			err := cmd.CompleteInsert()
+			cursor = len([]rune(string(cmd)))
+			if err != nil {
+				fmt.Fprintf(screen, "%v\n", err)
 			}
-			err := cmd.Complete()
+		case listKey:
+			cursor = moveCursor(cmd, cursor, len([]rune(string(cmd))))
+			err := cmd.CompleteList()
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "%v\n", err)
+				fmt.Fprintf(screen, "%v\n", err)
 			}
-
 		case '\u007f', '\u0008':
-			if len(cmd) > 0 {
-				cmd = cmd[:len(cmd)-1]
-				fmt.Printf("\u0008 \u0008")
-			}
-		case '\t':
-			err := cmd.Complete()
+			cmd, cursor = deleteBackward(cmd, cursor)
+		case '\u001b':
+			seq, err := readEscape(input)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "%v\n", err)
+				break
+			}
+			runes := []rune(string(cmd))
+			if seq != "[Z" {
+				menu = nil
+			}
+			switch seq {
+			case "b":
+				if to := wordBackward(runes, cursor); to >= lineStart(cmd) {
+					cursor = moveCursor(cmd, cursor, to)
+				} else {
+					cursor = moveCursor(cmd, cursor, lineStart(cmd))
+				}
+			case "f":
+				cursor = moveCursor(cmd, cursor, wordForward(runes, cursor))
+			case "[D", "OD":
+				if cursor > lineStart(cmd) {
+					cursor = moveCursor(cmd, cursor, cursor-1)
+				}
+			case "[C", "OC":
+				if cursor < len(runes) {
+					cursor = moveCursor(cmd, cursor, cursor+1)
+				}
+			case "u":
+				cmd, cursor = applyEdit(cmd, cursor, upcaseWord)
+			case "l":
+				cmd, cursor = applyEdit(cmd, cursor, downcaseWord)
+			case "c":
+				cmd, cursor = applyEdit(cmd, cursor, capitalizeWord)
+			case "y":
+				if old, text, ok := kills.YankPop(); ok {
+					cmd, cursor = applyEdit(cmd, cursor, yank(text, len([]rune(old))))
+				}
+			case "[Z":
+				if menu != nil && cmd == menu.shown {
+					cmd, cursor = applyEdit(cmd, cursor, replaceLine(menu.Next(-1)))
+				}
+			}
+		case '\u0014':
+			cmd, cursor = applyEdit(cmd, cursor, transposeChars)
+		case '\u000b':
+			cmd, cursor = killText(cmd, cursor, len([]rune(string(cmd))))
+		case '\u0015':
+			cmd, cursor = killText(cmd, cursor, lineStart(cmd))
+		case '\u0017':
+			to := wordBackward([]rune(string(cmd)), cursor)
+			if start := lineStart(cmd); to < start {
+				to = start
+			}
+			cmd, cursor = killText(cmd, cursor, to)
+		case '\u0019':
+			if text, ok := kills.Yank(); ok {
+				cmd, cursor = applyEdit(cmd, cursor, yank(text, 0))
 			}
 		default:
-			fmt.Printf("%c", c)
-			cmd += Command(c)
+			cmd, cursor = insertRune(cmd, cursor, c)
 		}
+		flushScreen()
 	}
 }
 func (c Command) HandleCmd() error {
 	parsed := c.Tokenize()
-	if len(parsed) == 0 {
+	if len(parsed) == 0 || isComment(c) {
 		// There was no command, it's not an error, the user just hit
-		// enter.
-		PrintPrompt()
+		// enter or wrote a comment.
+		return nil
+	}
+	noexpand := parsed[0] == "noexpand"
+	if noexpand {
+		parsed = parsed[1:]
+		if len(parsed) == 0 {
+			return nil
+		}
+		for i, token := range parsed {
+			parsed[i] = strings.Replace(token, "$$", "$", -1)
+		}
+	} else {
+		var err error
+		if parsed, err = substituteCommands(parsed); err != nil {
+			return err
+		}
+		if ok, err := assignVariables(parsed); ok {
+			return err
+		}
+	}
+	var from []int
+	parsed, from = expandAliases(parsed)
+	if len(parsed) == 0 {
 		return nil
 	}
+	// Whether each word in parsed was quoted, so that it isn't globbed.
+	quoted := make([]bool, len(parsed))
+	if !noexpand {
+		words := c.quotedWords()
+		for i, f := range from {
+			quoted[i] = words[f]
+		}
+	}
 	args := make([]string, 0, len(parsed))
 	for _, val := range parsed[1:] {
-		args = append(args, os.ExpandEnv(val))
-	}
-	// newargs will be at least len(parsed in size, so start by allocating a slice
-	// of that capacity
-	newargs := make([]string, 0, len(args))
-	for _, token := range args {
-		token = replaceTilde(token)
-		expanded, err := filepath.Glob(token)
-		if err != nil || len(expanded) == 0 {
-			newargs = append(newargs, token)
+		if noexpand {
+			args = append(args, val)
 			continue
 		}
-		newargs = append(newargs, expanded...)
+		args = append(args, expandVariables(val))
+	}
+	if !noexpand {
+		// newargs will be at least len(parsed in size, so start by allocating a slice
+		// of that capacity
+		newargs := make([]string, 0, len(args))
+		for i, token := range args {
+			token = replaceTilde(token)
+			if quoted[i+1] {
+				newargs = append(newargs, token)
+				continue
+			}
+			expanded, err := globFiles(token)
+			if err != nil || len(expanded) == 0 {
+				newargs = append(newargs, token)
+				continue
+			}
+			if i > 0 && len(expanded) > 1 {
+				if _, _, redirect := Token(args[i-1]).Redirection(); redirect {
+					return fmt.Errorf("%s: ambiguous redirect", token)
+				}
+			}
+			newargs = append(newargs, expanded...)
 
+		}
+		args = newargs
 	}
-	args = newargs
 	var backgroundProcess bool
 	if parsed[len(parsed)-1] == "&" {
-		// Strip off the &, it's not part of the command.
+		// Strip off the &, it's not part of the command. args was
+		// already built from parsed, so it needs to come off of both.
 		parsed = parsed[:len(parsed)-1]
-		backgroundProcess = true
-	}
-	switch parsed[0] {
-	case "cd":
-		if len(args) == 0 {
-			return fmt.Errorf("Must provide an argument to cd")
+		if len(args) > 0 {
+			args = args[:len(args)-1]
 		}
-		old, _ := os.Getwd()
-		err := os.Chdir(args[0])
-		if err == nil {
-			new, _ := os.Getwd()
-			os.Setenv("PWD", new)
-			os.Setenv("OLDPWD", old)
+		backgroundProcess = true
+		if len(parsed) == 0 {
+			return SyntaxError("&")
 		}
+	}
+	// Convert parsed from []string to []Token. We should refactor all the code
+	// to use tokens, but for now just do this instead of going back and changing
+	// all the references/declarations in every other section of code.
+	var parsedtokens []Token = []Token{Token(parsed[0])}
+	for _, t := range args {
+		parsedtokens = append(parsedtokens, Token(t))
+	}
+	commands, err := ParseCommands(parsedtokens)
+	if err != nil {
 		return err
-	case "set":
-		if len(args) != 2 {
-			return fmt.Errorf("Usage: set var value")
-		}
-		return os.Setenv(args[0], args[1])
-	case "source":
-		if len(args) < 1 {
-			return fmt.Errorf("Usage: source file [...other files]")
-		}
-
-		for _, f := range args {
-			SourceFile(f)
-		}
-		return nil
-	case "jobs":
-		fmt.Printf("Job listing:\n\n")
-		for i, leader := range processGroups {
-			fmt.Printf("Job %d (%d)\n", i, leader)
-		}
-		return nil
-	case "bg":
-		if len(args) < 1 {
-			return fmt.Errorf("Must specify job to background.")
+	}
+	builtin := commands[0]
+	if len(builtin.Args) > 0 && IsBuiltin(builtin.Args[0]) {
+		files := &exec.Cmd{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
+		opened, err := applyRedirects(files, builtin.shellRedirects())
+		for _, f := range opened {
+			defer f.Close()
 		}
-		i, err := strconv.Atoi(args[0])
 		if err != nil {
 			return err
 		}
+		stdin, stdout, stderr := files.Stdin, files.Stdout, files.Stderr
+		args = builtin.Args[1:]
+		os.Setenv("?", "0")
+		handled := true
+		err = func() error {
+			switch builtin.Args[0] {
+			case "cd":
+				if len(args) == 0 {
+					return builtinError(ErrUsage, "Must provide an argument to cd")
+				}
+				for _, name := range []string{"PWD", "OLDPWD"} {
+					if err := checkWritable(name); err != nil {
+						return err
+					}
+				}
+				dir, found := resolveCd(args[0])
+				old, _ := os.Getwd()
+				err := os.Chdir(dir)
+				if err != nil && os.Getenv("CD_FILE") == "on" {
+					if fi, serr := os.Stat(dir); serr == nil && fi.Mode().IsRegular() {
+						err = os.Chdir(filepath.Dir(dir))
+					}
+				}
+				if os.IsNotExist(err) {
+					return builtinError(ErrNoSuchFile, "cd: %s: no such file or directory", args[0])
+				}
+				if err == nil {
+					new, _ := os.Getwd()
+					setVariable("PWD", new)
+					setVariable("OLDPWD", old)
+					if found {
+						fmt.Fprintln(stdout, new)
+					}
+				}
+				return err
+			case "set":
+				if len(args) != 2 {
+					return builtinError(ErrUsage, "Usage: set var value")
+				}
+				return setVariable(args[0], args[1])
+			case "source":
+				if len(args) < 1 {
+					return builtinError(ErrUsage, "Usage: source file [...other files]")
+				}
 
-		if i >= len(processGroups) || i < 0 {
-			return fmt.Errorf("Invalid job id %d", i)
-		}
-		p, err := os.FindProcess(int(processGroups[i]))
-		if err != nil {
-			return err
-		}
-		if err := p.Signal(syscall.SIGCONT); err != nil {
-			return err
-		}
-		return nil
-	case "fg":
-		if len(args) < 1 {
-			return fmt.Errorf("Must specify job to foreground.")
-		}
-		i, err := strconv.Atoi(args[0])
-		if err != nil {
-			return err
-		}
+				for _, f := range args {
+					var err error
+					if f == "-" {
+						if stdin == os.Stdin {
+							restore()
+						}
+						err = sourceReader(stdin, "stdin")
+						if stdin == os.Stdin {
+							cbreak()
+						}
+					} else if err = SourceFile(f); os.IsNotExist(err) {
+						return builtinError(ErrNoSuchFile, "source: %s: no such file or directory", f)
+					}
+					if err != nil {
+						return sourceFailed(err)
+					}
+				}
+				return nil
+			case "jobs":
+				fmt.Fprintf(stdout, "Job listing:\n\n")
+				for _, leader := range processGroups {
+					if stoppedJobs[leader] {
+						fmt.Fprintf(stdout, "Job %d (%d) stopped\n", jobIDs[leader], leader)
+					} else {
+						fmt.Fprintf(stdout, "Job %d (%d)\n", jobIDs[leader], leader)
+					}
+				}
+				return nil
+			case "bg":
+				if len(args) == 0 {
+					args = []string{"%%"}
+				}
+				return Bg(stdout, args)
+			case "fg":
+				spec := "%%"
+				if len(args) > 0 {
+					spec = args[0]
+				}
+				_, pg, err := parseJob(spec)
+				if err != nil {
+					return err
+				}
+				if err := signalGroup(pg, syscall.SIGCONT); err != nil {
+					return err
+				}
+				continueJob(pg)
+				setCurrentJob(pg)
+				restore()
+				if err := setForeground(pg); err != nil {
+					panic(fmt.Sprintf("Err: %v", err))
+				}
+				atomic.StoreUint32(&ForegroundPid, pg)
+				return ForegroundProcess
+			case "autocomplete":
+				if len(args) > 0 && (args[0] == "-d" || args[0] == "-c") {
+					return removeAutocompletions(args)
+				}
+				position := -1
+				if len(args) > 0 && args[0] == "-n" {
+					if len(args) < 2 {
+						return builtinError(ErrUsage, "Usage: autocomplete [-n position] regex value [more values...]")
+					}
+					n, err := strconv.Atoi(args[1])
+					if err != nil || n < 0 {
+						return builtinError(ErrInvalidArgument, "autocomplete: invalid position %v", args[1])
+					}
+					position = n
+					args = args[2:]
+				}
+				if len(args) < 2 {
+					return builtinError(ErrUsage, "Usage: autocomplete [-n position] regex value [more values...]")
+				}
+				re, err := regexp.Compile(args[0])
+				if err != nil {
+					return err
+				}
+				var rule *autocompletion
+				for _, existing := range autocompletions {
+					if existing.Regexp.String() == re.String() && existing.Position == position {
+						rule = existing
+						break
+					}
+				}
+				if rule == nil {
+					rule = &autocompletion{Regexp: re, Position: position}
+					autocompletions = append(autocompletions, rule)
+				}
 
-		if i >= len(processGroups) || i < 0 {
-			return fmt.Errorf("Invalid job id %d", i)
-		}
-		p, err := os.FindProcess(int(processGroups[i]))
-		if err != nil {
-			return err
-		}
-		if err := p.Signal(syscall.SIGCONT); err != nil {
-			return err
-		}
-		terminal.Restore()
-		var pid uint32 = processGroups[i]
-		_, _, err3 := syscall.RawSyscall(
-			syscall.SYS_IOCTL,
-			uintptr(0),
-			uintptr(syscall.TIOCSPGRP),
-			uintptr(unsafe.Pointer(&pid)),
-		)
-		if err3 != syscall.Errno(0) {
-			panic(fmt.Sprintf("Err: %v", err3))
-		} else {
-			ForegroundPid = pid
-			return ForegroundProcess
-		}
+				for _, t := range args[1:] {
+					if !containsToken(rule.Suggestions, Token(t)) {
+						rule.Suggestions = append(rule.Suggestions, Token(t))
+					}
+				}
 
-	case "autocomplete":
-		if len(args) < 2 {
-			return fmt.Errorf("Usage: autocomplete regex value [more values...]")
-		}
-		if autocompletions == nil {
-			autocompletions = make(map[*regexp.Regexp][]Token)
-		}
-		re, err := regexp.Compile(args[0])
-		if err != nil {
+				return nil
+			case "read":
+				return Read(stdin, args)
+			case "alias":
+				return Alias(stdout, args)
+			case "help":
+				return Help(stdout, args)
+			case "clear":
+				return Clear(stdout)
+			case "reset":
+				return Reset(stdout)
+			case "exec":
+				return Exec(builtin)
+			case "getopts":
+				return Getopts(args)
+			case "unalias":
+				return Unalias(args)
+			case "compgen":
+				return Compgen(stdout, args)
+			case "readarray", "mapfile":
+				return Readarray(stdin, args)
+			case "history":
+				return History(stdout)
+			case "kill":
+				return Kill(args)
+			case "wait":
+				return WaitJobs(args)
+			case "trap":
+				return Trap(stdout, args)
+			case "readonly":
+				return Readonly(stdout, args)
+			case "redo-as":
+				return RedoAs(args)
+			}
+			handled = false
+			return nil
+		}()
+		if handled {
+			if err != nil && err != ForegroundProcess && stderr != os.Stderr {
+				fmt.Fprintf(stderr, "%v\n", err)
+				setBuiltinStatus(err)
+				return nil
+			}
 			return err
 		}
-
-		for _, t := range args[1:] {
-			autocompletions[re] = append(autocompletions[re], Token(t))
-		}
-
-		return nil
-	}
-	// Convert parsed from []string to []Token. We should refactor all the code
-	// to use tokens, but for now just do this instead of going back and changing
-	// all the references/declarations in every other section of code.
-	var parsedtokens []Token = []Token{Token(parsed[0])}
-	for _, t := range args {
-		parsedtokens = append(parsedtokens, Token(t))
 	}
-	commands := ParseCommands(parsedtokens)
 	var cmds []*exec.Cmd
+	// The extra redirections for each command in cmds.
+	var redirects [][]Redirect
 	for i, c := range commands {
 		if len(c.Args) == 0 {
 			// This should have never happened, there is
 			// no command, but let's avoid panicing.
 			continue
 		}
-		newCmd := exec.Command(c.Args[0], c.Args[1:]...)
+		path, err := resolveCommand(c.Args[0])
+		if err != nil {
+			return commandFailed(c.Args[0], err)
+		}
+		newCmd := exec.Command(path, c.Args[1:]...)
+		newCmd.Args[0] = c.Args[0]
 		newCmd.Stderr = os.Stderr
 		cmds = append(cmds, newCmd)
+		redirects = append(redirects, c.Redirects)
 
 		// If there was an Stdin specified, use it.
 		if c.Stdin != "" {
@@ -278,22 +608,28 @@ func (c Command) HandleCmd() error {
 			// pipeline if there is one, the first process
 			// still uses os.Stdin
 			if i > 0 {
-				pipe, err := cmds[i-1].StdoutPipe()
-				if err != nil {
-					continue
+				if cmds[i-1].Stdout == nil {
+					r, w, err := os.Pipe()
+					if err != nil {
+						return err
+					}
+					defer r.Close()
+					defer w.Close()
+					cmds[i-1].Stdout = w
+					newCmd.Stdin = r
 				}
-				newCmd.Stdin = pipe
 			} else {
 				newCmd.Stdin = os.Stdin
 			}
 		}
 		// If there was a Stdout specified, use it.
 		if c.Stdout != "" {
-			// Create the file to convert it to an io.Reader
-			if f, err := os.Create(c.Stdout); err == nil {
-				newCmd.Stdout = f
-				defer f.Close()
+			f, err := createFile(c.Stdout, false)
+			if err != nil {
+				return err
 			}
+			newCmd.Stdout = f
+			defer f.Close()
 		} else {
 			// There was no Stdout specified, so
 			// connect it to the previous process in the
@@ -305,113 +641,138 @@ func (c Command) HandleCmd() error {
 		}
 	}
 
+	if backgroundProcess {
+		f, err := redirectBackground(cmds)
+		if err != nil {
+			return err
+		}
+		if f != nil {
+			defer f.Close()
+		}
+	}
+	for i, c := range cmds {
+		files, err := applyRedirects(c, redirects[i])
+		for _, f := range files {
+			defer f.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	flushScreen()
 	var pgrp uint32
 	sysProcAttr := &syscall.SysProcAttr{
 		Setpgid: true,
 	}
-	for _, c := range cmds {
+	for i, c := range cmds {
 		c.SysProcAttr = sysProcAttr
-		if err := c.Start(); err != nil {
-			return err
+		err := c.Start()
+		if errors.Is(err, syscall.ENOEXEC) {
+			if c, err = scriptCommand(c); err == nil {
+				cmds[i] = c
+				err = c.Start()
+			}
+		}
+		if err != nil {
+			stopStarted(cmds[:i])
+			if pgrp != 0 {
+				removeJob(pgrp)
+			}
+			return commandFailed(c.Args[0], err)
 		}
 		if sysProcAttr.Pgid == 0 {
 			sysProcAttr.Pgid, _ = syscall.Getpgid(c.Process.Pid)
 			pgrp = uint32(sysProcAttr.Pgid)
-			processGroups = append(processGroups, uint32(c.Process.Pid))
+			addJob(uint32(c.Process.Pid))
+			continueJob(pgrp)
 		}
 	}
+	jobCommands[pgrp] = jobCommand(c)
+	setCurrentJob(pgrp)
 	if backgroundProcess {
 		// We can't tell if a background process returns an error
 		// or not, so we just claim it didn't.
 		return nil
 	}
-	ForegroundPid = pgrp
-	terminal.Restore()
-	_, _, err1 := syscall.RawSyscall(
-		syscall.SYS_IOCTL,
-		uintptr(0),
-		uintptr(syscall.TIOCSPGRP),
-		uintptr(unsafe.Pointer(&pgrp)),
-	)
-	// RawSyscall returns an int for the error, we need to compare
-	// to syscall.Errno(0) instead of nil
-	if err1 != syscall.Errno(0) {
-		return err1
+	atomic.StoreUint32(&ForegroundPid, pgrp)
+	restore()
+	if err := setForeground(pgrp); err != nil {
+		return err
 	}
 	return ForegroundProcess
 }
 func PrintPrompt() {
+	if !interactive() {
+		return
+	}
+	defer flushScreen()
 	if p := os.Getenv("PROMPT"); p != "" {
 		if len(p) > 1 && p[0] == '!' {
-			input := os.ExpandEnv(p[1:])
+			flushScreen()
+			input := expandVariables(p[1:])
 			split := strings.Fields(input)
 			cmd := exec.Command(split[0], split[1:]...)
 			cmd.Stdout = os.Stderr
 			if err := cmd.Run(); err != nil {
 				if _, ok := err.(*exec.ExitError); !ok {
 					// Fall back on our standard prompt, with a warning.
-					fmt.Fprintf(os.Stderr, "\nInvalid prompt command\n> ")
+					fmt.Fprintf(screen, "\nInvalid prompt command\n> ")
 				}
 			}
 		} else {
-			fmt.Fprintf(os.Stderr, "\n%s", os.ExpandEnv(p))
+			fmt.Fprintf(screen, "\n%s", expandVariables(expandPromptEscapes(p)))
 		}
 	} else {
-		fmt.Fprintf(os.Stderr, "\n> ")
+		fmt.Fprintf(screen, "\n> ")
 	}
 }
-func ParseCommands(tokens []Token) []ParsedCommand {
+func ParseCommands(tokens []Token) ([]ParsedCommand, error) {
+	for i, t := range tokens {
+		if !t.IsSpecial() {
+			continue
+		}
+		if i == 0 && t.IsPipe() {
+			return nil, SyntaxError(t)
+		}
+		if i == len(tokens)-1 {
+			return nil, SyntaxError("newline")
+		}
+		if next := tokens[i+1]; next.IsSpecial() {
+			return nil, SyntaxError(next)
+		}
+	}
 	// Keep track of the current command being built
 	var currentCmd ParsedCommand
 	// Keep array of all commands that have been built, so we can create the
 	// pipeline
 	var allCommands []ParsedCommand
-	// Keep track of where this command started in parsed, so that we can build
-	// currentCommand.Args when we find a special token.
-	var lastCommandStart = 0
-	// Keep track of if we've found a special token such as < or >, so that
-	// we know if currentCmd.Args has already been populated.
-	var foundSpecial bool
-	var nextStdin, nextStdout bool
-	for i, t := range tokens {
-		if nextStdin {
-			currentCmd.Stdin = string(t)
-			nextStdin = false
-		}
-		if nextStdout {
-			currentCmd.Stdout = string(t)
-			nextStdout = false
-		}
-		if t.IsSpecial() || i == len(tokens)-1 {
-			if foundSpecial == false {
-				// Convert from Token to string
-				var slice []Token
-				if i == len(tokens)-1 {
-					slice = tokens[lastCommandStart:]
-				} else {
-					slice = tokens[lastCommandStart:i]
-				}
-
-				for _, t := range slice {
-					currentCmd.Args = append(currentCmd.Args, string(t))
-				}
+	// The redirection that the next token is the target of, if any.
+	var redirect *Redirect
+	for _, t := range tokens {
+		if redirect != nil {
+			redirect.Target = string(t)
+			if err := currentCmd.addRedirect(redirect.resolveDevice()); err != nil {
+				return nil, err
 			}
-			foundSpecial = true
-		}
-		if t.IsStdinRedirect() {
-			nextStdin = true
-		}
-		if t.IsStdoutRedirect() {
-			nextStdout = true
+			redirect = nil
+			continue
 		}
-		if t.IsPipe() || i == len(tokens)-1 {
+		if t.IsPipe() {
 			allCommands = append(allCommands, currentCmd)
-			lastCommandStart = i + 1
-			foundSpecial = false
 			currentCmd = ParsedCommand{}
+			continue
+		}
+		if fd, op, ok := t.Redirection(); ok {
+			redirect = &Redirect{Fd: fd, Op: op}
+			continue
 		}
+		currentCmd.Args = append(currentCmd.Args, string(t))
 	}
-	return allCommands
+	if len(tokens) > 0 {
+		allCommands = append(allCommands, currentCmd)
+	}
+	return allCommands, nil
 }
 func SourceFile(filename string) error {
 	f, err := os.Open(filename)
@@ -419,22 +780,7 @@ func SourceFile(filename string) error {
 		return err
 	}
 	defer f.Close()
-	scanner := bufio.NewReader(f)
-	for {
-		line, err := scanner.ReadString('\n')
-		switch err {
-		case io.EOF:
-			return nil
-		case nil:
-			// Nothing special
-		default:
-			return err
-		}
-		c := Command(line)
-		if err := c.HandleCmd(); err != nil {
-			return err
-		}
-	}
+	return sourceReader(f, filename)
 }
 func Wait(ch chan os.Signal) {
 	for {
@@ -453,73 +799,42 @@ func Wait(ch chan os.Signal) {
 				switch {
 				case status.Continued():
 					newPg = append(newPg, pg)
-
-					if ForegroundPid == 0 {
-						terminal.Restore()
-						var pid uint32 = pg
-						_, _, err3 := syscall.RawSyscall(
-							syscall.SYS_IOCTL,
-							uintptr(0),
-							uintptr(syscall.TIOCSPGRP),
-							uintptr(unsafe.Pointer(&pid)),
-						)
-						if err3 != syscall.Errno(0) {
-							panic(fmt.Sprintf("Err: %v", err3))
-						}
-						ForegroundPid = pid
-					}
+					continueJob(pg)
 				case status.Stopped():
 					newPg = append(newPg, pg)
 					if pg == ForegroundPid && ForegroundPid != 0 {
-						terminal.SetCbreak()
-						var mypid uint32 = uint32(syscall.Getpid())
-						_, _, err3 := syscall.RawSyscall(
-							syscall.SYS_IOCTL,
-							uintptr(0),
-							uintptr(syscall.TIOCSPGRP),
-							uintptr(unsafe.Pointer(&mypid)),
-						)
-						if err3 != syscall.Errno(0) {
-							panic(fmt.Sprintf("Err: %v", err3))
+						if err := setForeground(uint32(syscall.Getpid())); err != nil {
+							panic(fmt.Sprintf("Err: %v", err))
 						}
-						ForegroundPid = 0
+						resetTerminal()
+						atomic.StoreUint32(&ForegroundPid, 0)
 					}
-					fmt.Fprintf(os.Stderr, "%v is stopped\n", pid1)
+					setCurrentJob(pg)
+					notifyJob(stopJob(jobIDs[pg], pg))
 				case status.Signaled():
 					if pg == ForegroundPid && ForegroundPid != 0 {
-						terminal.SetCbreak()
-						var mypid uint32 = uint32(syscall.Getpid())
-						_, _, err3 := syscall.RawSyscall(
-							syscall.SYS_IOCTL,
-							uintptr(0),
-							uintptr(syscall.TIOCSPGRP),
-							uintptr(unsafe.Pointer(&mypid)),
-						)
-						if err3 != syscall.Errno(0) {
-							panic(fmt.Sprintf("Err: %v", err3))
+						waitProcessGroup(pg)
+						if err := setForeground(uint32(syscall.Getpid())); err != nil {
+							panic(fmt.Sprintf("Err: %v", err))
 						}
-						ForegroundPid = 0
+						resetTerminal()
+						atomic.StoreUint32(&ForegroundPid, 0)
+						os.Setenv("?", strconv.Itoa(exitStatus(status)))
+					} else {
+						notifyJob(fmt.Sprintf("%v terminated by signal %v", pg, signalName(status.Signal())))
 					}
-
-					fmt.Fprintf(os.Stderr, "%v terminated by signal %v\n", pg, status.StopSignal())
 				case status.Exited():
 					if pg == ForegroundPid && ForegroundPid != 0 {
-						terminal.SetCbreak()
-						var mypid uint32 = uint32(syscall.Getpid())
-						_, _, err3 := syscall.RawSyscall(
-							syscall.SYS_IOCTL,
-							uintptr(0),
-							uintptr(syscall.TIOCSPGRP),
-							uintptr(unsafe.Pointer(&mypid)),
-						)
-						if err3 != syscall.Errno(0) {
-							panic(fmt.Sprintf("Err: %v", err3))
+						waitProcessGroup(pg)
+						if err := setForeground(uint32(syscall.Getpid())); err != nil {
+							panic(fmt.Sprintf("Err: %v", err))
 						}
-						ForegroundPid = 0
+						resetTerminal()
+						atomic.StoreUint32(&ForegroundPid, 0)
+						os.Setenv("?", strconv.Itoa(status.ExitStatus()))
 					} else {
-						fmt.Fprintf(os.Stderr, "%v exited (exit status: %v)\n", pid1, status.ExitStatus())
+						notifyJob(exitNotice(pg, status))
 					}
-					os.Setenv("?", strconv.Itoa(status.ExitStatus()))
 				default:
 					newPg = append(newPg, pg)
 					fmt.Fprintf(os.Stderr, "Still running: %v: %v\n", pid1, status)
@@ -535,16 +850,110 @@ func Wait(ch chan os.Signal) {
 }
 func replaceTilde(s string) string {
 	if match := homedirRe.FindStringSubmatch(s); match != nil {
-		var u *user.User
-		var err error
-		if match[1] != "" {
-			u, err = user.Lookup(match[1])
-		} else {
-			u, err = user.Current()
-		}
-		if err == nil {
-			return strings.Replace(s, match[0], u.HomeDir, 1)
+		if home, ok := homeDir(match[1]); ok {
+			return strings.Replace(s, match[0], home+match[2], 1)
 		}
 	}
 	return s
 }
+
+// homeDir returns the home directory of the user name, or of the current
+// user if name is empty, and whether it could be found.
+func homeDir(name string) (string, bool) {
+	if name != "" {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", false
+		}
+		return u.HomeDir, true
+	}
+	if u, err := currentUser(); err == nil {
+		return u.HomeDir, true
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return home, true
+	}
+	return "", false
+}
+
+// globFiles returns the files matching pattern, without hidden files unless
+// the last component of pattern starts with a ".".
+func globFiles(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil || strings.HasPrefix(filepath.Base(pattern), ".") {
+		return matches, err
+	}
+	visible := matches[:0]
+	for _, m := range matches {
+		if !strings.HasPrefix(filepath.Base(m), ".") {
+			visible = append(visible, m)
+		}
+	}
+	return visible, nil
+}
+
+// shellName returns the name that the shell was run as with the arguments
+// args, for $0.
+func shellName(args []string) string {
+	switch {
+	case len(args) > 3 && args[1] == "-c":
+		return args[3]
+	case len(args) > 1 && args[1] != "-c":
+		return args[1]
+	default:
+		return "gosh"
+	}
+}
+
+// quotedWords returns whether each of the words in c, as returned by
+// Tokenize, was quoted in any part.
+func (c Command) quotedWords() []bool {
+	runes := []rune(string(c))
+	var quoted []bool
+	for _, span := range c.TokenizePositions() {
+		quoted = append(quoted, strings.ContainsAny(string(runes[span.Start:span.End]), `'"`))
+	}
+	return quoted
+}
+
+// expandVariables replaces the variables in s with their values.
+func expandVariables(s string) string {
+	return os.Expand(s, lookupVariable)
+}
+
+// lookupVariable returns the value of the variable name.
+func lookupVariable(name string) string {
+	switch name {
+	case "RANDOM":
+		return strconv.Itoa(random.Intn(32768))
+	case "SECONDS":
+		return strconv.Itoa(int(time.Since(secondsStart) / time.Second))
+	case "LINENO":
+		return strconv.Itoa(lineNumber)
+	case "PWD":
+		return syncPwd()
+	}
+	return os.Getenv(name)
+}
+
+// syncPwd updates $PWD if it isn't the working directory, and returns it.
+func syncPwd() string {
+	pwd := os.Getenv("PWD")
+	wd, err := os.Getwd()
+	if err != nil {
+		return pwd
+	}
+	if pwdInfo, err := os.Stat(pwd); err == nil {
+		if wdInfo, err := os.Stat(wd); err == nil && os.SameFile(pwdInfo, wdInfo) {
+			return pwd
+		}
+	}
+	if err := setVariable("PWD", wd); err != nil {
+		// It's read-only, so it stays out of date.
+		return pwd
+	}
+	if pwd != "" {
+		setVariable("OLDPWD", pwd)
+	}
+	return wd
+}
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrIncomplete is returned by Parse when the command needs more input
+// before it can be run.
+var ErrIncomplete = errors.New("incomplete command")
+
+// Parse returns the tokens of the command c, or ErrIncomplete if c can't be
+// finished without reading more input.
+func (c Command) Parse() ([]string, error) {
+	if _, err := parseStatements(c); err != nil {
+		return nil, err
+	}
+	return c.Tokenize(), nil
+}
+
+// PrintContinuationPrompt prints the prompt for the next line of an
+// incomplete command.
+func PrintContinuationPrompt() {
+	if !interactive() {
+		return
+	}
+	defer flushScreen()
+	if p := os.Getenv("PS2"); p != "" {
+		fmt.Fprintf(screen, "%s", expandVariables(expandPromptEscapes(p)))
+	} else {
+		fmt.Fprintf(screen, "> ")
+	}
+}
+
+// isComment returns true if the command c is only a comment.
+func isComment(c Command) bool {
+	return strings.HasPrefix(strings.TrimSpace(string(c)), "#")
+}
+
+// parseAssignment returns the name and value of word if it's a NAME=value
+// or NAME+=value assignment, and whether it appends to the variable.
+func parseAssignment(word string) (name, value string, appending, ok bool) {
+	eq := strings.Index(word, "=")
+	if eq < 1 {
+		return "", "", false, false
+	}
+	name, value = word[:eq], word[eq+1:]
+	if strings.HasSuffix(name, "+") {
+		name, appending = name[:len(name)-1], true
+	}
+	if !isName(name) {
+		return "", "", false, false
+	}
+	return name, value, appending, true
+}
+
+// isName returns true if s is a valid variable name.
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// assignVariables sets the variables from the assignment words in tokens,
+// and returns false without setting any if they aren't all assignments.
+func assignVariables(tokens []string) (bool, error) {
+	for _, token := range tokens {
+		if _, _, _, ok := parseAssignment(token); !ok {
+			return false, nil
+		}
+	}
+	for _, token := range tokens {
+		name, value, appending, _ := parseAssignment(token)
+		value = replaceTilde(expandVariables(value))
+		if appending {
+			value = os.Getenv(name) + value
+		}
+		if err := setVariable(name, value); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// negated returns the command that c negates, if it starts with a !.
+func (c Command) negated() (Command, bool) {
+	s := strings.TrimSpace(string(c))
+	if len(s) < 2 || s[0] != '!' || (s[1] != ' ' && s[1] != '\t') {
+		return c, false
+	}
+	return Command(strings.TrimSpace(s[1:])), true
+}
+
+// Statement is a command in a list of them, or a group of statements.
+type Statement struct {
+	// Cmd is the command, or the body of the group if this is a group.
+	Cmd Command
+	// Group is the statements in a ( ... ) or { ...; } group.
+	Group []Statement
+	// Subshell is true if the group runs in a child process.
+	Subshell bool
+	// Redirects are the redirections that apply to every command in a group.
+	Redirects []Redirect
+	// Heredoc is the here document that is the command's standard input.
+	Heredoc *Heredoc
+}
+
+// parseStatements returns the statements in c, which are separated by
+// semicolons or newlines.
+func parseStatements(c Command) ([]Statement, error) {
+	p := &statementParser{runes: []rune(string(c))}
+	return p.list(0)
+}
+
+// statementParser parses the statements in a command.
+type statementParser struct {
+	runes []rune
+	pos   int
+	// subshells is the number of ( ... ) groups that we're in.
+	subshells int
+	// heredocs are the here documents whose bodies start after the next
+	// newline.
+	heredocs []*Heredoc
+	// heredoc is the here document of the last command that was parsed.
+	heredoc *Heredoc
+}
+
+// list parses statements until the end of the command, or the end of the
+// group that was started with open.
+func (p *statementParser) list(open rune) ([]Statement, error) {
+	var stmts []Statement
+	for {
+		for p.pos < len(p.runes) && strings.ContainsRune(" \t\n;", p.runes[p.pos]) {
+			if p.runes[p.pos] == '\n' && len(p.heredocs) > 0 {
+				p.pos++
+				if err := p.readHeredocs(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			p.pos++
+		}
+		if p.pos == len(p.runes) {
+			if open != 0 || len(p.heredocs) > 0 {
+				return nil, ErrIncomplete
+			}
+			return stmts, nil
+		}
+		start := p.pos
+		switch chr := p.runes[p.pos]; {
+		case chr == '#':
+			for p.pos < len(p.runes) && p.runes[p.pos] != '\n' {
+				p.pos++
+			}
+		case chr == ')' || (chr == '}' && p.wordEnds(p.pos+1)):
+			if (chr == ')' && open != '(') || (chr == '}' && open != '{') {
+				return nil, SyntaxError(Token(string(chr)))
+			}
+			p.pos++
+			return stmts, nil
+		case chr == '(' || (chr == '{' && p.wordEnds(p.pos+1)):
+			p.pos++
+			if chr == '(' {
+				p.subshells++
+			}
+			group, err := p.list(chr)
+			if chr == '(' {
+				p.subshells--
+			}
+			if err != nil {
+				return nil, err
+			}
+			body := Command(strings.TrimSpace(string(p.runes[start+1 : p.pos-1])))
+			stmts = append(stmts, Statement{Cmd: body, Group: group, Subshell: chr == '('})
+			rest, err := p.command()
+			if err != nil {
+				return nil, err
+			}
+			redirects, err := parseGroupRedirects(rest)
+			if err != nil {
+				return nil, err
+			}
+			stmts[len(stmts)-1].Redirects = redirects
+		default:
+			cmd, err := p.command()
+			if err != nil {
+				return nil, err
+			}
+			stmts = append(stmts, Statement{Cmd: cmd, Heredoc: p.heredoc})
+		}
+	}
+}
+
+// wordEnds returns true if a word in the command ends before position i.
+func (p *statementParser) wordEnds(i int) bool {
+	return i >= len(p.runes) || strings.ContainsRune(" \t\n;|&<>()", p.runes[i])
+}
+
+// command parses a command up to the end of the statement that it's in.
+func (p *statementParser) command() (Command, error) {
+	start := p.pos
+	p.heredoc = nil
+	var quote rune
+	// The start and end of each here document operator and its delimiter.
+	var cut [][2]int
+	text := func(end int) Command {
+		var s strings.Builder
+		from := start
+		for _, c := range cut {
+			s.WriteString(string(p.runes[from:c[0]]))
+			s.WriteString(" ")
+			from = c[1]
+		}
+		s.WriteString(string(p.runes[from:end]))
+		return Command(strings.TrimSpace(s.String()))
+	}
+	for ; p.pos < len(p.runes); p.pos++ {
+		chr := p.runes[p.pos]
+		if chr == '$' && quote != '\'' && p.pos+1 < len(p.runes) && p.runes[p.pos+1] == '(' {
+			end, ok := substitutionEnd(p.runes, p.pos)
+			if !ok {
+				return "", ErrIncomplete
+			}
+			p.pos = end
+			continue
+		}
+		if quote != 0 {
+			switch {
+			case chr == quote:
+				quote = 0
+			case chr == '\\' && p.pos+1 < len(p.runes):
+				next := p.runes[p.pos+1]
+				if (quote == '\'' && next == '\'') || (quote == '"' && strings.ContainsRune("$`\"\\\n", next)) {
+					p.pos++
+				}
+			}
+			continue
+		}
+		switch {
+		case chr == '\'' || chr == '"':
+			quote = chr
+		case chr == '<' && p.pos+1 < len(p.runes) && p.runes[p.pos+1] == '<':
+			opStart := p.pos
+			h, err := p.hereDocument()
+			if err != nil {
+				return "", err
+			}
+			cut = append(cut, [2]int{opStart, p.pos})
+			p.heredoc = h
+			p.heredocs = append(p.heredocs, h)
+			// The loop moves past the last rune of the delimiter.
+			p.pos--
+		case chr == ';', chr == ')' && p.subshells > 0:
+			return text(p.pos), nil
+		case chr == '\n' && !endsWithPipe(string(p.runes[start:p.pos])):
+			return text(p.pos), nil
+		}
+	}
+	if quote != 0 || endsWithPipe(string(p.runes[start:])) {
+		return "", ErrIncomplete
+	}
+	return text(len(p.runes)), nil
+}
+
+// endsWithPipe returns true if s ends with a pipe that doesn't have a
+// command after it yet.
+func endsWithPipe(s string) bool {
+	s = strings.TrimSpace(s)
+	return strings.HasSuffix(s, "|") && !strings.HasSuffix(s, ">|")
+}
+
+// runStatements runs each of stmts in order.
+func runStatements(stmts []Statement, child chan os.Signal) error {
+	for i, s := range stmts {
+		var err error
+		switch {
+		case s.Group == nil && s.Heredoc != nil:
+			err = withHeredoc(s.Heredoc, func() error {
+				return s.Cmd.Run(child)
+			})
+		case s.Group == nil:
+			err = s.Cmd.Run(child)
+		case s.Subshell:
+			err = withRedirects(s.Redirects, func() error {
+				return runSubshell(s.Cmd)
+			})
+		default:
+			err = withRedirects(s.Redirects, func() error {
+				return runStatements(s.Group, child)
+			})
+		}
+		if err != nil {
+			if i == len(stmts)-1 {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+	return nil
+}
+
+// runSubshell runs body in a new shell, and sets $? to its exit status.
+func runSubshell(body Command) error {
+	shell, err := scriptShell()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(shell, "-c", string(body))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	restore()
+	defer cbreak()
+	status := 0
+	if err := cmd.Run(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return err
+		}
+		status = exitErr.ExitCode()
+	}
+	return os.Setenv("?", strconv.Itoa(status))
+}
+
+// exitCommand returns the status that cmd exits the shell with, and whether
+// it's an exit command at all.
+func exitCommand(cmd Command) (int, bool) {
+	args := strings.Fields(string(cmd))
+	if len(args) == 0 || len(args) > 2 || (args[0] != "exit" && args[0] != "quit") {
+		return 0, false
+	}
+	if len(args) == 1 {
+		return lastStatus(), true
+	}
+	status, err := strconv.Atoi(args[1])
+	if err != nil {
+		return 0, false
+	}
+	return status, true
+}
+
+// lastStatus returns the exit status of the last command, from $?.
+func lastStatus() int {
+	status, _ := strconv.Atoi(os.Getenv("?"))
+	return status
+}
+
+// parseGroupRedirects returns the redirections in rest, which comes after
+// a group.
+func parseGroupRedirects(rest Command) ([]Redirect, error) {
+	var redirects []Redirect
+	tokens := rest.Tokenize()
+	for i := 0; i < len(tokens); i += 2 {
+		fd, op, ok := Token(tokens[i]).Redirection()
+		if !ok {
+			return nil, SyntaxError(Token(tokens[i]))
+		}
+		if i+1 == len(tokens) {
+			return nil, fmt.Errorf("syntax error: no target for '%s'", tokens[i])
+		}
+		target := replaceTilde(expandVariables(tokens[i+1]))
+		r := Redirect{Fd: fd, Op: op, Target: target}.resolveDevice()
+		switch {
+		case r.Op == "&>" || r.Op == "&>>":
+			redirects = append(redirects, r.splitBoth()...)
+		case r.Op == ">&" && !isFd(r.Target):
+			split, err := r.splitCopy()
+			if err != nil {
+				return nil, err
+			}
+			redirects = append(redirects, split...)
+		default:
+			redirects = append(redirects, r)
+		}
+	}
+	return redirects, nil
+}
+
+// withRedirects runs run with our own file descriptors redirected by
+// redirects, and restores them afterwards.
+func withRedirects(redirects []Redirect, run func() error) error {
+	flushScreen()
+	var saved []int
+	defer func() {
+		for i := len(saved) - 1; i >= 0; i-- {
+			fd := redirects[i].Fd
+			if saved[i] < 0 {
+				syscall.Close(fd)
+				continue
+			}
+			syscall.Dup2(saved[i], fd)
+			syscall.Close(saved[i])
+		}
+	}()
+	for _, r := range redirects {
+		var src int
+		var f *os.File
+		var err error
+		switch r.Op {
+		case "<":
+			f, err = os.Open(r.Target)
+		case ">", ">|":
+			f, err = createFile(r.Target, r.Op == ">|")
+		case ">>":
+			f, err = appendFile(r.Target)
+		case ">&":
+			src, err = strconv.Atoi(r.Target)
+		}
+		if err != nil {
+			return err
+		}
+		if f != nil {
+			src = int(f.Fd())
+		}
+		old, err := syscall.Dup(r.Fd)
+		if err != nil {
+			old = -1
+		}
+		err = syscall.Dup2(src, r.Fd)
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			if old >= 0 {
+				syscall.Close(old)
+			}
+			return fmt.Errorf("%d: bad file descriptor", src)
+		}
+		saved = append(saved, old)
+	}
+	return run()
+}
+
+// Heredoc is a here document, which is the standard input of a command.
+type Heredoc struct {
+	// Delim is the line that ends the document.
+	Delim string
+	// Quoted is true if the delimiter was quoted, which means that the
+	// document isn't expanded.
+	Quoted bool
+	// StripTabs is true for <<-, which strips the leading tabs from each
+	// line.
+	StripTabs bool
+	// Body is the text of the document.
+	Body string
+}
+
+// Text returns the text that the command reads from the document.
+func (h *Heredoc) Text() string {
+	if h.Quoted {
+		return h.Body
+	}
+	return expandVariables(h.Body)
+}
+
+// hereDocument parses the here document operator at the current position,
+// and the delimiter after it.
+func (p *statementParser) hereDocument() (*Heredoc, error) {
+	h := &Heredoc{}
+	p.pos += 2
+	if p.pos < len(p.runes) && p.runes[p.pos] == '-' {
+		h.StripTabs = true
+		p.pos++
+	}
+	for p.pos < len(p.runes) && (p.runes[p.pos] == ' ' || p.runes[p.pos] == '\t') {
+		p.pos++
+	}
+	var delim strings.Builder
+	for !p.wordEnds(p.pos) {
+		switch chr := p.runes[p.pos]; chr {
+		case '\'', '"':
+			h.Quoted = true
+			end := p.pos + 1
+			for end < len(p.runes) && p.runes[end] != chr {
+				end++
+			}
+			if end == len(p.runes) {
+				return nil, ErrIncomplete
+			}
+			delim.WriteString(string(p.runes[p.pos+1 : end]))
+			p.pos = end + 1
+		case '\\':
+			h.Quoted = true
+			p.pos++
+			if p.pos < len(p.runes) {
+				delim.WriteRune(p.runes[p.pos])
+				p.pos++
+			}
+		default:
+			delim.WriteRune(chr)
+			p.pos++
+		}
+	}
+	if delim.Len() == 0 {
+		if p.pos == len(p.runes) {
+			return nil, SyntaxError("newline")
+		}
+		return nil, SyntaxError(Token(string(p.runes[p.pos])))
+	}
+	h.Delim = delim.String()
+	return h, nil
+}
+
+// readHeredocs reads the bodies of the pending here documents, which start
+// at the current position.
+func (p *statementParser) readHeredocs() error {
+	for _, h := range p.heredocs {
+		var body strings.Builder
+		for {
+			if p.pos == len(p.runes) {
+				return ErrIncomplete
+			}
+			end := p.pos
+			for end < len(p.runes) && p.runes[end] != '\n' {
+				end++
+			}
+			line := string(p.runes[p.pos:end])
+			if h.StripTabs {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if end < len(p.runes) {
+				// Move past the newline too.
+				end++
+			}
+			p.pos = end
+			if line == h.Delim {
+				break
+			}
+			body.WriteString(line + "\n")
+		}
+		h.Body = body.String()
+	}
+	p.heredocs = nil
+	return nil
+}
+
+// withHeredoc calls run with the text of the here document h as our
+// standard input.
+func withHeredoc(h *Heredoc, run func() error) error {
+	f, err := ioutil.TempFile("", "goshheredoc")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.WriteString(f, h.Text())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return withRedirects([]Redirect{{Fd: 0, Op: "<", Target: f.Name()}}, run)
+}
+
+// substitutionEnd returns the position of the ) that ends the $( that starts
+// at position i of runes, and false if it doesn't end.
+func substitutionEnd(runes []rune, i int) (int, bool) {
+	depth := 0
+	var quote rune
+	for i += 2; i < len(runes); i++ {
+		chr := runes[i]
+		switch {
+		case quote == '\'' && chr == '\'':
+			quote = 0
+		case quote == '\'':
+		case chr == '\\' && i+1 < len(runes):
+			i++
+		case quote == '"' && chr == '"':
+			quote = 0
+		case quote == 0 && (chr == '\'' || chr == '"'):
+			quote = chr
+		case quote == 0 && chr == '(':
+			depth++
+		case quote == 0 && chr == ')':
+			if depth == 0 {
+				return i, true
+			}
+			depth--
+		case chr == '$' && i+1 < len(runes) && runes[i+1] == '(':
+			end, ok := substitutionEnd(runes, i)
+			if !ok {
+				return 0, false
+			}
+			i = end
+		}
+	}
+	return 0, false
+}
+
+// substituteCommands returns words with each $(...) in them replaced by the
+// output of the command in it.
+func substituteCommands(words []string) ([]string, error) {
+	substituted := make([]string, 0, len(words))
+	for _, word := range words {
+		runes := []rune(word)
+		var s strings.Builder
+		for i := 0; i < len(runes); i++ {
+			switch {
+			case runes[i] == '$' && i+1 < len(runes) && runes[i+1] == '$':
+				s.WriteString("$$")
+				i++
+			case runes[i] == '$' && i+1 < len(runes) && runes[i+1] == '(':
+				end, ok := substitutionEnd(runes, i)
+				if !ok {
+					return nil, ErrIncomplete
+				}
+				out, err := commandOutput(Command(runes[i+2 : end]))
+				if err != nil {
+					return nil, err
+				}
+				s.WriteString(strings.Replace(out, "$", "$$", -1))
+				i = end
+			default:
+				s.WriteRune(runes[i])
+			}
+		}
+		substituted = append(substituted, s.String())
+	}
+	return substituted, nil
+}
+
+// commandOutput runs c and returns what it printed to standard output,
+// without the trailing newlines.
+func commandOutput(c Command) (string, error) {
+	f, err := ioutil.TempFile("", "goshsubstitution")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	err = withRedirects([]Redirect{{Fd: 1, Op: ">|", Target: f.Name()}}, func() error {
+		return c.Run(child)
+	})
+	if err != nil {
+		return "", err
+	}
+	out, err := ioutil.ReadFile(f.Name())
+	return strings.TrimRight(string(out), "\n"), err
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseIncomplete(t *testing.T) {
+	cases := []struct {
+		Cmd        Command
+		Incomplete bool
+		Tokens     []string
+	}{
+		{"ls -l", false, []string{"ls", "-l"}},
+		{"", false, nil},
+		{"echo 'one", true, nil},
+		{"echo 'one\ntwo'", false, []string{"echo", "one\ntwo"}},
+		{`echo "it's`, true, nil},
+		{`echo "it's"`, false, []string{"echo", "it's"}},
+		{`echo "a \" b`, true, nil},
+		{"ls |", true, nil},
+		{"ls | ", true, nil},
+		{"ls |\nwc -l", false, []string{"ls", "|", "wc", "-l"}},
+		{"echo '|'", false, []string{"echo", "|"}},
+		{"ls >| out", false, []string{"ls", ">|", "out"}},
+	}
+	for i, tc := range cases {
+		tokens, err := tc.Cmd.Parse()
+		if (err == ErrIncomplete) != tc.Incomplete {
+			t.Errorf("Unexpected incomplete for case %d (%q): got %v want %v", i, tc.Cmd, err, tc.Incomplete)
+			continue
+		}
+		if strings.Join(tokens, ",") != strings.Join(tc.Tokens, ",") {
+			t.Errorf("Unexpected tokens for case %d (%q): got %q want %q", i, tc.Cmd, tokens, tc.Tokens)
+		}
+	}
+}
+
+func TestReadCommandPipeline(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("ls |\nwc -l\npwd\n"))
+	for i, expected := range []string{"ls |\nwc -l\n", "pwd\n"} {
+		if got, err := readCommand(r); got != expected || err != nil {
+			t.Errorf("Unexpected command %d: got %q, %v want %q", i, got, err, expected)
+		}
+	}
+}
+
+func TestSourceCommentsAndBlankLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshcomments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker, rc := filepath.Join(dir, "prompted"), filepath.Join(dir, "goshrc")
+	source := "# Set up the environment\n" +
+		"\n" +
+		"   \n" +
+		"set GOSHCOMMENTS on\n" +
+		"\t# An indented comment\n" +
+		"#set GOSHCOMMENTS off\n" +
+		"\n"
+	if err := ioutil.WriteFile(rc, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("GOSHCOMMENTS")
+
+	oldprompt, oldcaps := os.Getenv("PROMPT"), caps
+	defer func() {
+		os.Setenv("PROMPT", oldprompt)
+		caps = oldcaps
+	}()
+	os.Setenv("PROMPT", "!touch "+marker)
+	caps.Interactive = true
+
+	if err := SourceFile(rc); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := os.Getenv("GOSHCOMMENTS"); got != "on" {
+		t.Errorf("Unexpected value: got %q want on", got)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("Prompt printed while sourcing")
+	}
+	for i, c := range []Command{"# comment", "  # comment", "#"} {
+		if err := c.HandleCmd(); err != nil {
+			t.Errorf("Unexpected error for comment %d: %v", i, err)
+		}
+	}
+}
+
+func TestAssignments(t *testing.T) {
+	defer os.Unsetenv("GOSHASSIGN")
+	cases := []struct {
+		Initial  string
+		Set      bool
+		Cmd      Command
+		Expected string
+	}{
+		{"", false, "GOSHASSIGN=foo", "foo"},
+		{"foo", true, "GOSHASSIGN+=bar", "foobar"},
+		{"", true, "GOSHASSIGN+=bar", "bar"},
+		{"", false, "GOSHASSIGN+=bar", "bar"},
+		{"/bin", true, "GOSHASSIGN+=:/usr/bin", "/bin:/usr/bin"},
+		{"a", true, "GOSHASSIGN+=$GOSHASSIGN", "aa"},
+		{"a", true, "GOSHASSIGN+='b c'", "ab c"},
+		{"a", true, "GOSHASSIGN=", ""},
+	}
+	for i, tc := range cases {
+		if tc.Set {
+			os.Setenv("GOSHASSIGN", tc.Initial)
+		} else {
+			os.Unsetenv("GOSHASSIGN")
+		}
+		if err := tc.Cmd.HandleCmd(); err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+		}
+		if got := os.Getenv("GOSHASSIGN"); got != tc.Expected {
+			t.Errorf("Unexpected value for case %d (%v): got %q want %q", i, tc.Cmd, got, tc.Expected)
+		}
+	}
+}
+
+func TestParseAssignment(t *testing.T) {
+	cases := []struct {
+		Word            string
+		Name, Value     string
+		Appending, IsOk bool
+	}{
+		{"FOO=bar", "FOO", "bar", false, true},
+		{"FOO+=bar", "FOO", "bar", true, true},
+		{"_x1=a=b", "_x1", "a=b", false, true},
+		{"FOO=", "FOO", "", false, true},
+		{"=bar", "", "", false, false},
+		{"+=bar", "", "", false, false},
+		{"1FOO=bar", "", "", false, false},
+		{"--opt=bar", "", "", false, false},
+		{"ls", "", "", false, false},
+	}
+	for i, tc := range cases {
+		name, value, appending, ok := parseAssignment(tc.Word)
+		if name != tc.Name || value != tc.Value || appending != tc.Appending || ok != tc.IsOk {
+			t.Errorf("Unexpected assignment for case %d (%v): got %q %q %v %v", i, tc.Word, name, value, appending, ok)
+		}
+	}
+}
+
+func TestNegation(t *testing.T) {
+	oldstatus := os.Getenv("?")
+	defer os.Setenv("?", oldstatus)
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	cases := []struct {
+		Cmd      Command
+		Expected string
+	}{
+		{"true", "0"},
+		{"false", "1"},
+		{"! true", "1"},
+		{"! false", "0"},
+		{"!\tfalse", "0"},
+		{"! ! false", "1"},
+		{"! sh -c 'exit 3'", "0"},
+		{"! set GOSHNEGATE on", "1"},
+		{"! goshnotacommand", "0"},
+	}
+	for i, tc := range cases {
+		os.Setenv("?", "42")
+		tc.Cmd.Run(child)
+		if got := os.Getenv("?"); got != tc.Expected {
+			t.Errorf("Unexpected $? for case %d (%v): got %v want %v", i, tc.Cmd, got, tc.Expected)
+		}
+	}
+	os.Unsetenv("GOSHNEGATE")
+
+	for i, c := range []Command{"!true", "echo !", "'!' true", ""} {
+		if _, ok := c.negated(); ok {
+			t.Errorf("Unexpected negation for case %d (%v)", i, c)
+		}
+	}
+}
+
+// formatStatements formats stmts with their groups, to compare them in
+// tests.
+func formatStatements(stmts []Statement) string {
+	var parts []string
+	for _, s := range stmts {
+		switch {
+		case s.Group == nil:
+			parts = append(parts, string(s.Cmd))
+		case s.Subshell:
+			parts = append(parts, "("+formatStatements(s.Group)+")")
+		default:
+			parts = append(parts, "{"+formatStatements(s.Group)+"}")
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+func TestParseStatements(t *testing.T) {
+	cases := []struct {
+		Cmd      Command
+		Expected string
+		Err      error
+	}{
+		{"ls", "ls", nil},
+		{"ls; pwd", "ls;pwd", nil},
+		{"ls;pwd;", "ls;pwd", nil},
+		{"ls\npwd", "ls;pwd", nil},
+		{"echo 'a;b'; pwd", "echo 'a;b';pwd", nil},
+		{"ls |\nwc -l; pwd", "ls |\nwc -l;pwd", nil},
+		{"(cd /tmp; ls)", "(cd /tmp;ls)", nil},
+		{"{ cd /tmp; ls; }", "{cd /tmp;ls}", nil},
+		{"( a; (b; c); { d; } ); e", "(a;(b;c);{d});e", nil},
+		{"{ a; ( b ); { c; }; }", "{a;(b);{c}}", nil},
+		{"(a)(b)", "", SyntaxError("(b)")},
+		{"echo {a,b} }", "echo {a,b} }", nil},
+		{"autocomplete ^(git|hg) foo", "autocomplete ^(git|hg) foo", nil},
+		{"# comment; ls\npwd", "pwd", nil},
+		{"(a; b", "", ErrIncomplete},
+		{"{ a; b }", "", ErrIncomplete},
+		{"{ a; b;\n", "", ErrIncomplete},
+		{"( a; 'b )", "", ErrIncomplete},
+		{"a; )", "", SyntaxError(")")},
+		{"}", "", SyntaxError("}")},
+		{"( a ) b", "", SyntaxError("b")},
+	}
+	for i, tc := range cases {
+		stmts, err := parseStatements(tc.Cmd)
+		if fmt.Sprint(err) != fmt.Sprint(tc.Err) {
+			t.Errorf("Unexpected error for case %d (%q): got %v want %v", i, tc.Cmd, err, tc.Err)
+			continue
+		}
+		if got := formatStatements(stmts); err == nil && got != tc.Expected {
+			t.Errorf("Unexpected statements for case %d (%q): got %q want %q", i, tc.Cmd, got, tc.Expected)
+		}
+	}
+}
+
+// TestMain runs the shell instead of the tests when $GOSHTESTSHELL is set,
+// so that the tests can run subshells with the real shell, which is the test
+// binary.
+func TestMain(m *testing.M) {
+	if os.Getenv("GOSHTESTSHELL") != "" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+func TestSubshell(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshsubshell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+
+	os.Setenv("GOSHTESTSHELL", "1")
+	defer os.Unsetenv("GOSHTESTSHELL")
+	oldwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(oldwd)
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	if err := Command("(cd " + dir + "; pwd > out); set GOSHSUBSHELL ran").Run(child); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("GOSHSUBSHELL")
+	if wd, _ := os.Getwd(); wd != oldwd {
+		t.Errorf("Subshell changed our directory to %v", wd)
+	}
+	if got, _ := ioutil.ReadFile(out); string(got) != dir+"\n" {
+		t.Errorf("Unexpected directory in subshell: got %q want %q", got, dir+"\n")
+	}
+	if os.Getenv("GOSHSUBSHELL") != "ran" {
+		t.Error("Statement after subshell didn't run")
+	}
+
+	if err := Command("(exit 3)").Run(child); err != nil {
+		t.Fatal(err)
+	}
+	if status := os.Getenv("?"); status != "3" {
+		t.Errorf("Unexpected subshell status: got %v want 3", status)
+	}
+	if err := Command("(false); echo $? > " + out).Run(child); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(out); string(got) != "1\n" {
+		t.Errorf("Unexpected status of (false): got %q want %q", got, "1\n")
+	}
+
+	if err := Command("{ cd " + dir + "; }").Run(child); err != nil {
+		t.Fatal(err)
+	}
+	if wd, _ := os.Getwd(); wd != dir {
+		t.Errorf("Group didn't change our directory: got %v want %v", wd, dir)
+	}
+}
+
+func TestGroupRedirects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshgroupredirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out, in := filepath.Join(dir, "out"), filepath.Join(dir, "in")
+	if err := ioutil.WriteFile(in, []byte("first line\nsecond line\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldshell := scriptShell
+	defer func() { scriptShell = oldshell }()
+	scriptShell = func() (string, error) {
+		return "/bin/sh", nil
+	}
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	defer os.Unsetenv("GOSHGROUPLINE")
+
+	cases := []struct {
+		Cmd      string
+		Expected string
+	}{
+		{"{ echo one; echo two; } > " + out, "one\ntwo\n"},
+		{"( echo three; echo four ) > " + out, "three\nfour\n"},
+		{"{ read GOSHGROUPLINE; echo $GOSHGROUPLINE; } < " + in + " > " + out, "first line\n"},
+		{"{ ls " + filepath.Join(dir, "nonexistent") + "; } 2> " + out + " > /dev/null", ""},
+	}
+	for i, tc := range cases {
+		if err := Command(tc.Cmd).Run(child); err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+			continue
+		}
+		got, _ := ioutil.ReadFile(out)
+		if tc.Expected == "" {
+			if len(got) == 0 {
+				t.Errorf("Expected error output for case %d", i)
+			}
+		} else if string(got) != tc.Expected {
+			t.Errorf("Unexpected output for case %d: got %q want %q", i, got, tc.Expected)
+		}
+	}
+
+	for i, c := range []Command{"{ a; } foo", "{ a; } >"} {
+		if _, err := parseStatements(c); err == nil {
+			t.Errorf("Expected syntax error for case %d (%v)", i, c)
+		}
+	}
+}
+
+func TestHeredocs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshheredoc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	os.Setenv("GOSHHEREDOC", "expanded")
+	defer os.Unsetenv("GOSHHEREDOC")
+
+	cases := []struct {
+		Cmd      string
+		Expected string
+	}{
+		{"cat << EOF > " + out + "\nvalue: $GOSHHEREDOC\nEOF", "value: expanded\n"},
+		{"cat << 'EOF' > " + out + "\nvalue: $GOSHHEREDOC\nEOF", "value: $GOSHHEREDOC\n"},
+		{"cat << \"EOF\" > " + out + "\nvalue: ${GOSHHEREDOC}\nEOF", "value: ${GOSHHEREDOC}\n"},
+		{"cat << \\EOF > " + out + "\n$GOSHHEREDOC\nEOF\n", "$GOSHHEREDOC\n"},
+		{"cat <<- EOF > " + out + "\n\tindented $GOSHHEREDOC\n\tEOF\n", "indented expanded\n"},
+		{"{ cat <<EOF; cat <<END; } > " + out + "\none\n\nEOF\ntwo\nEND\n", "one\n\ntwo\n"},
+		{"{ cat << EOF; } > " + out + "\nin a group\nEOF\n", "in a group\n"},
+	}
+	for i, tc := range cases {
+		if err := Command(tc.Cmd).Run(child); err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+			continue
+		}
+		got, _ := ioutil.ReadFile(out)
+		if string(got) != tc.Expected {
+			t.Errorf("Unexpected output for case %d: got %q want %q", i, got, tc.Expected)
+		}
+	}
+
+	parsed := []struct {
+		Cmd      Command
+		Expected Heredoc
+	}{
+		{"cat << EOF\n$A\nEOF", Heredoc{Delim: "EOF", Body: "$A\n"}},
+		{"cat << 'E O F'\n$A\nE O F", Heredoc{Delim: "E O F", Quoted: true, Body: "$A\n"}},
+		{"cat << E\"OF\"\n\n$A\nEOF\n", Heredoc{Delim: "EOF", Quoted: true, Body: "\n$A\n"}},
+		{"cat <<-EOF\n\t\t$A\n\tEOF", Heredoc{Delim: "EOF", StripTabs: true, Body: "$A\n"}},
+	}
+	for i, tc := range parsed {
+		stmts, err := parseStatements(tc.Cmd)
+		if err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+			continue
+		}
+		if len(stmts) != 1 || stmts[0].Heredoc == nil {
+			t.Errorf("Expected one command with a here document for case %d", i)
+			continue
+		}
+		if got := *stmts[0].Heredoc; got != tc.Expected {
+			t.Errorf("Unexpected here document for case %d: got %+v want %+v", i, got, tc.Expected)
+		}
+		if stmts[0].Cmd != "cat" {
+			t.Errorf("Unexpected command for case %d: got %q want %q", i, stmts[0].Cmd, "cat")
+		}
+	}
+
+	for i, c := range []Command{"cat << EOF", "cat << EOF\nline", "cat << EOF\nEOFX\n", "cat << 'EOF"} {
+		if _, err := parseStatements(c); err != ErrIncomplete {
+			t.Errorf("Expected incomplete command for case %d (%q), got %v", i, c, err)
+		}
+	}
+	for i, c := range []Command{"cat <<", "cat << ;"} {
+		if _, err := parseStatements(c); err == nil || err == ErrIncomplete {
+			t.Errorf("Expected syntax error for case %d (%q), got %v", i, c, err)
+		}
+	}
+}
+
+func TestCommandSubstitution(t *testing.T) {
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	defer os.Unsetenv("GOSHSUBST")
+	// $$ expands to $, the same as when we start.
+	os.Setenv("$", "$")
+
+	cases := []struct {
+		Cmd      Command
+		Expected string
+	}{
+		{"GOSHSUBST=$(echo hello world | tr a-z A-Z)", "HELLO WORLD"},
+		{"GOSHSUBST=$(printf 'one\\ntwo\\n\\n' | sort -r)", "two\none"},
+		{"GOSHSUBST=$(echo a; echo 'b)')", "a\nb)"},
+		{"GOSHSUBST=x$(echo $(echo nested))y", "xnestedy"},
+		{`GOSHSUBST=$(printf "%s" "\$HOME")`, "$HOME"},
+		{`GOSHSUBST="\$(echo literal)"`, "$(echo literal)"},
+		{`GOSHSUBST='$(echo quoted)'`, "$(echo quoted)"},
+		{`GOSHSUBST='$HOME'$(echo x)`, "$HOMEx"},
+	}
+	for i, tc := range cases {
+		if err := tc.Cmd.Run(child); err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+			continue
+		}
+		if got := os.Getenv("GOSHSUBST"); got != tc.Expected {
+			t.Errorf("Unexpected value for case %d: got %q want %q", i, got, tc.Expected)
+		}
+	}
+
+	for i, c := range []Command{"echo $(ls", "echo $(ls | wc -l", "echo $(echo ')')"} {
+		_, err := c.Parse()
+		if want := i < 2; (err == ErrIncomplete) != want {
+			t.Errorf("Unexpected result for case %d (%q): %v", i, c, err)
+		}
+	}
+}
@@ -10,7 +10,7 @@ func LongestPrefix(strs []string) string {
 	prefix := strs[0]
 	for _, cmp := range strs[1:] {
 		for i := range prefix {
-			if i > len(cmp) || prefix[i] != cmp[i] {
+			if i >= len(cmp) || prefix[i] != cmp[i] {
 				prefix = cmp[:i]
 				break
 			}
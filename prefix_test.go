@@ -24,6 +24,9 @@ func TestLongestPrefix(t *testing.T) {
 
 		// multiple elements
 		{[]string{"aaaa", "aabb", "aaac"}, "aa"},
+
+		// A later element is a prefix of the first
+		{[]string{"foo1", "foo"}, "foo"},
 	}
 	for i, tc := range cases {
 		if got := LongestPrefix(tc.Val); got != tc.Expected {
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// expandPromptEscapes returns the prompt p with its backslash escapes
+// replaced by the state of the shell that they refer to.
+func expandPromptEscapes(p string) string {
+	var expanded strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] != '\\' || i+1 == len(p) {
+			expanded.WriteByte(p[i])
+			continue
+		}
+		switch p[i+1] {
+		case '?':
+			status := os.Getenv("?")
+			if status == "" {
+				status = "0"
+			}
+			expanded.WriteString(status)
+		case 'j':
+			expanded.WriteString(strconv.Itoa(len(processGroups)))
+		case '\\':
+			expanded.WriteByte('\\')
+		default:
+			expanded.WriteString(p[i : i+2])
+		}
+		i++
+	}
+	return expanded.String()
+}
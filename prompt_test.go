@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExpandPromptEscapes(t *testing.T) {
+	oldstatus := os.Getenv("?")
+	defer os.Setenv("?", oldstatus)
+
+	cases := []struct {
+		Prompt   string
+		Status   string
+		Jobs     []string
+		Expected string
+	}{
+		{`[\?] > `, "0", nil, "[0] > "},
+		{`[\?] > `, "127", nil, "[127] > "},
+		{`[\?] > `, "", nil, "[0] > "},
+		{`\j jobs> `, "0", nil, "0 jobs> "},
+		{`\j jobs> `, "0", []string{"sleep 10", "vi"}, "2 jobs> "},
+		{`\?:\j\\ `, "1", []string{"make"}, `1:1\ `},
+		{`\w\`, "0", nil, `\w\`},
+	}
+	for i, tc := range cases {
+		os.Setenv("?", tc.Status)
+		restore := setJobs(tc.Jobs...)
+		if got := expandPromptEscapes(tc.Prompt); got != tc.Expected {
+			t.Errorf("Unexpected prompt for case %d: got %q want %q", i, got, tc.Expected)
+		}
+		restore()
+	}
+}
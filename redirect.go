@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// addRedirect adds the redirection r to p.
+func (p *ParsedCommand) addRedirect(r Redirect) error {
+	switch {
+	case r.Op == ">&" && !isFd(r.Target):
+		redirects, err := r.splitCopy()
+		if err != nil {
+			return err
+		}
+		for _, r := range redirects {
+			p.addRedirect(r)
+		}
+	case r.Op == "&>" || r.Op == "&>>":
+		for _, r := range r.splitBoth() {
+			p.addRedirect(r)
+		}
+	case r.Op == ">&":
+		p.Redirects = append(p.Redirects, r)
+	case r.Fd == 0 && r.Op == "<":
+		p.Stdin = r.Target
+	case r.Fd == 1 && r.Op == ">":
+		p.Stdout = r.Target
+	default:
+		p.Redirects = append(p.Redirects, r)
+	}
+	return nil
+}
+
+// applyRedirects sets up the file descriptors of cmd for redirects. It
+// returns the files that it opened, so that they can be closed once cmd has
+// been started.
+func applyRedirects(cmd *exec.Cmd, redirects []Redirect) ([]*os.File, error) {
+	var opened []*os.File
+	for _, r := range redirects {
+		var f *os.File
+		var err error
+		switch r.Op {
+		case "<":
+			f, err = os.Open(r.Target)
+		case ">", ">|":
+			f, err = createFile(r.Target, r.Op == ">|")
+		case ">>":
+			f, err = appendFile(r.Target)
+		case ">&":
+			n, _ := strconv.Atoi(r.Target)
+			if f = fdFile(cmd, n); f == nil {
+				err = fmt.Errorf("%d: bad file descriptor", n)
+			}
+		}
+		if err != nil {
+			return opened, err
+		}
+		if r.Op != ">&" {
+			opened = append(opened, f)
+		}
+		setFdFile(cmd, r.Fd, f)
+	}
+	return opened, nil
+}
+
+// fdFile returns the file that will be file descriptor fd when cmd is
+// started, or nil if there isn't one.
+func fdFile(cmd *exec.Cmd, fd int) *os.File {
+	var v interface{}
+	switch fd {
+	case 0:
+		v = cmd.Stdin
+	case 1:
+		v = cmd.Stdout
+	case 2:
+		v = cmd.Stderr
+	default:
+		if fd-3 < len(cmd.ExtraFiles) {
+			return cmd.ExtraFiles[fd-3]
+		}
+		return nil
+	}
+	f, _ := v.(*os.File)
+	return f
+}
+
+// setFdFile makes f be file descriptor fd when cmd is started.
+func setFdFile(cmd *exec.Cmd, fd int, f *os.File) {
+	switch fd {
+	case 0:
+		cmd.Stdin = f
+	case 1:
+		cmd.Stdout = f
+	case 2:
+		cmd.Stderr = f
+	default:
+		for len(cmd.ExtraFiles) <= fd-3 {
+			cmd.ExtraFiles = append(cmd.ExtraFiles, nil)
+		}
+		cmd.ExtraFiles[fd-3] = f
+	}
+}
+
+// devFd returns the file descriptor that path refers to, if it's one of
+// /dev/stdin, /dev/stdout, /dev/stderr or /dev/fd/N.
+func devFd(path string) (int, bool) {
+	switch path {
+	case "/dev/stdin":
+		return 0, true
+	case "/dev/stdout":
+		return 1, true
+	case "/dev/stderr":
+		return 2, true
+	}
+	if n := strings.TrimPrefix(path, "/dev/fd/"); n != path && isFd(n) {
+		fd, err := strconv.Atoi(n)
+		return fd, err == nil
+	}
+	return 0, false
+}
+
+// resolveDevice returns r with targets like /dev/stdin turned into a copy of
+// the file descriptor that they refer to.
+func (r Redirect) resolveDevice() Redirect {
+	if r.Op == ">&" {
+		return r
+	}
+	if fd, ok := devFd(r.Target); ok {
+		r.Op, r.Target = ">&", strconv.Itoa(fd)
+	}
+	return r
+}
+
+// createFile creates the file name for output redirection. If $NOCLOBBER
+// is "on", it won't overwrite an existing regular file unless force is true.
+func createFile(name string, force bool) (*os.File, error) {
+	if force || os.Getenv("NOCLOBBER") != "on" {
+		return os.Create(name)
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		if fi, err := os.Stat(name); err == nil && !fi.Mode().IsRegular() {
+			return os.OpenFile(name, os.O_WRONLY, 0)
+		}
+		return nil, fmt.Errorf("%s: cannot overwrite existing file", name)
+	}
+	return f, err
+}
+
+// splitCopy returns the redirections that the copy r to something that isn't
+// a file descriptor stands for.
+func (r Redirect) splitCopy() ([]Redirect, error) {
+	if r.Fd != 1 {
+		return nil, fmt.Errorf("%s: ambiguous redirect", r.Target)
+	}
+	return []Redirect{{1, ">", r.Target}, {2, ">&", "1"}}, nil
+}
+
+// appendFile opens the file name for appending output to it, creating it
+// if it doesn't exist.
+func appendFile(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+}
+
+// splitBoth returns the redirections that the redirection r of both standard
+// out and standard error stands for.
+func (r Redirect) splitBoth() []Redirect {
+	op := ">"
+	if r.Op == "&>>" {
+		op = ">>"
+	}
+	return []Redirect{{1, op, r.Target}, {2, ">&", "1"}}
+}
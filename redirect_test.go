@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestNumberedRedirects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshredirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	cmd := Command("sh -c 'echo hello >&3; echo world >&2' 3> " + out + " 2>&3")
+	if err := cmd.Run(child); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello\nworld\n" {
+		t.Errorf("Unexpected output: got %q want %q", got, "hello\nworld\n")
+	}
+}
+
+func TestDevStdinRedirect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshredirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	cmd := Command("echo hello | cat < /dev/stdin > " + out)
+	if err := cmd.Run(child); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello\n" {
+		t.Errorf("Unexpected output: got %q want %q", got, "hello\n")
+	}
+}
+
+func TestNoclobber(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshnoclobber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldnoclobber := os.Getenv("NOCLOBBER")
+	defer os.Setenv("NOCLOBBER", oldnoclobber)
+
+	cases := []struct {
+		Noclobber string
+		Exists    bool
+		Force     bool
+		Succeeds  bool
+	}{
+		{"", false, false, true},
+		{"", true, false, true},
+		{"", false, true, true},
+		{"", true, true, true},
+		{"on", false, false, true},
+		{"on", true, false, false},
+		{"on", false, true, true},
+		{"on", true, true, true},
+	}
+	for i, tc := range cases {
+		os.Setenv("NOCLOBBER", tc.Noclobber)
+		name := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		if tc.Exists {
+			if err := ioutil.WriteFile(name, []byte("original"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f, err := createFile(name, tc.Force)
+		if (err == nil) != tc.Succeeds {
+			t.Errorf("Unexpected result for case %d: got error %v", i, err)
+		}
+		if err != nil {
+			contents, _ := ioutil.ReadFile(name)
+			if string(contents) != "original" {
+				t.Errorf("File was modified for case %d: %q", i, contents)
+			}
+			continue
+		}
+		f.Close()
+		if contents, _ := ioutil.ReadFile(name); len(contents) != 0 {
+			t.Errorf("File was not truncated for case %d: %q", i, contents)
+		}
+	}
+
+	// Things that aren't regular files can always be written to.
+	os.Setenv("NOCLOBBER", "on")
+	f, err := createFile(os.DevNull, false)
+	if err != nil {
+		t.Errorf("Unexpected error opening %v with noclobber: %v", os.DevNull, err)
+	} else {
+		f.Close()
+	}
+
+	// And it's used for redirections.
+	name := filepath.Join(dir, "file0")
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	if err := Command("echo hello > " + name).Run(child); err == nil {
+		t.Errorf("Expected error overwriting %v with noclobber", name)
+	}
+	if err := Command("echo hello >| " + name).Run(child); err != nil {
+		t.Errorf("Unexpected error forcing overwrite of %v: %v", name, err)
+	}
+	if contents, _ := ioutil.ReadFile(name); string(contents) != "hello\n" {
+		t.Errorf("Unexpected contents after >|: got %q", contents)
+	}
+	// Including the ones for builtins.
+	if err := Command("help cd > " + name).HandleCmd(); err == nil {
+		t.Errorf("Expected error overwriting %v with noclobber from a builtin", name)
+	}
+	if err := Command("help cd >| " + name).HandleCmd(); err != nil {
+		t.Errorf("Unexpected error forcing overwrite of %v from a builtin: %v", name, err)
+	}
+	if contents, _ := ioutil.ReadFile(name); !strings.HasPrefix(string(contents), "Usage: cd") {
+		t.Errorf("Unexpected contents after >| from a builtin: got %q", contents)
+	}
+}
+
+func TestRedirectBothOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshredirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	for i, cmd := range []Command{
+		"sh -c 'echo out; echo err >&2' >& " + Command(out),
+		"{ sh -c 'echo out'; sh -c 'echo err >&2'; } >& " + Command(out),
+		"sh -c 'echo out; echo err >&2' 2>/dev/null >&" + Command(out),
+	} {
+		if err := cmd.Run(child); err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+			continue
+		}
+		if got, _ := ioutil.ReadFile(out); string(got) != "out\nerr\n" {
+			t.Errorf("Unexpected output for case %d: got %q want %q", i, got, "out\nerr\n")
+		}
+		os.Remove(out)
+	}
+
+	for _, tokens := range [][]Token{{"cat", "<&", "foo"}, {"ls", "2>&", "foo"}} {
+		if _, err := ParseCommands(tokens); err == nil || err.Error() != "foo: ambiguous redirect" {
+			t.Errorf("Unexpected error for %v: got %v", tokens, err)
+		}
+	}
+}
+
+func TestBuiltinRedirects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshredirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	defer os.Setenv("?", os.Getenv("?"))
+
+	cdError := "cd: /nonexistent/gosh: no such file or directory\n"
+	for i, tc := range []struct {
+		Cmd      Command
+		Expected string
+		Status   string
+	}{
+		{"cd /nonexistent/gosh 2> " + Command(out), cdError, "1"},
+		{"cd /nonexistent/gosh >& " + Command(out), cdError, "1"},
+		{"help cd >& " + Command(out), "Usage: cd dir\n\n", "0"},
+		{"help cd >/dev/null 2> " + Command(out), "", "0"},
+		{"help cd 2>/dev/null >&2 2> " + Command(out), "", "0"},
+	} {
+		os.Setenv("?", "0")
+		if err := tc.Cmd.Run(child); err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+			continue
+		}
+		got, _ := ioutil.ReadFile(out)
+		if !strings.HasPrefix(string(got), tc.Expected) || (tc.Expected == "") != (len(got) == 0) {
+			t.Errorf("Unexpected output for case %d: got %q want %q", i, got, tc.Expected)
+		}
+		if status := os.Getenv("?"); status != tc.Status {
+			t.Errorf("Unexpected $? for case %d: got %q want %q", i, status, tc.Status)
+		}
+		os.Remove(out)
+	}
+}
+
+func TestRedirectAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshredirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "log")
+
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	oldnoclobber := os.Getenv("NOCLOBBER")
+	defer os.Setenv("NOCLOBBER", oldnoclobber)
+	os.Setenv("NOCLOBBER", "on")
+
+	expected := ""
+	for i, tc := range []struct {
+		Cmd      Command
+		Expected string
+	}{
+		{"sh -c 'echo one' >> " + Command(log), "one\n"},
+		{"sh -c 'echo out; echo err >&2' &>> " + Command(log), "out\nerr\n"},
+		{"sh -c 'echo err >&2' 2>>" + Command(log), "err\n"},
+		{"{ sh -c 'echo out'; sh -c 'echo err >&2'; } &>> " + Command(log), "out\nerr\n"},
+	} {
+		if err := tc.Cmd.Run(child); err != nil {
+			t.Fatalf("Unexpected error for case %d: %v", i, err)
+		}
+		expected += tc.Expected
+		if got, _ := ioutil.ReadFile(log); string(got) != expected {
+			t.Errorf("Unexpected log after case %d: got %q want %q", i, got, expected)
+		}
+	}
+
+	if err := Command("help cd >> " + Command(log)).HandleCmd(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(log); len(got) <= len(expected) || string(got[:len(expected)]) != expected {
+		t.Errorf("Unexpected log after appending from a builtin: got %q", got)
+	}
+
+	os.Setenv("NOCLOBBER", "")
+	if err := Command("sh -c 'echo out; echo err >&2' &> " + Command(log)).Run(child); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(log); string(got) != "out\nerr\n" {
+		t.Errorf("Unexpected log after &>: got %q want %q", got, "out\nerr\n")
+	}
+
+	// Both halves of &> and &>> go to the file for builtins too.
+	for i, cmd := range []Command{"help cd &> ", "cd /nonexistent/gosh &>> ", "help cd &>> "} {
+		if err := (cmd + Command(log)).Run(child); err != nil {
+			t.Fatalf("Unexpected error for builtin case %d: %v", i, err)
+		}
+	}
+	help := "Usage: cd dir\n\nChange the current directory to dir, looking for it in $CDPATH if it's relative, and update $PWD and $OLDPWD.\n"
+	expected = help + "cd: /nonexistent/gosh: no such file or directory\n" + help
+	if got, _ := ioutil.ReadFile(log); string(got) != expected {
+		t.Errorf("Unexpected log after builtins: got %q want %q", got, expected)
+	}
+}
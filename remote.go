@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// isRemotePath returns true if base looks like an scp style host:path.
+func isRemotePath(base string) bool {
+	colon := strings.Index(base, ":")
+	if colon <= 0 || strings.HasPrefix(base, "-") {
+		return false
+	}
+	slash := strings.Index(base, "/")
+	return slash < 0 || colon < slash
+}
+
+// RemoteSuggestions returns the suggestions for the remote host:path base,
+// by listing the directory on host with ssh.
+func RemoteSuggestions(base string) []string {
+	colon := strings.Index(base, ":")
+	host, path := base[:colon], base[colon+1:]
+	dir, prefix := "", path
+	if slash := strings.LastIndex(path, "/"); slash >= 0 {
+		dir, prefix = path[:slash+1], path[slash+1:]
+	}
+
+	timeout, err := time.ParseDuration(os.Getenv("COMPLETION_REMOTE_TIMEOUT"))
+	if err != nil {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	args := []string{"-o", "BatchMode=yes", "--", host, "ls", "-1ap"}
+	if dir != "" {
+		args = append(args, remoteQuote(dir))
+	}
+	out, err := exec.CommandContext(ctx, "ssh", args...).Output()
+	if err != nil {
+		return nil
+	}
+
+	var matches []string
+	for _, name := range strings.Split(string(out), "\n") {
+		if name == "" || name == "./" || name == "../" {
+			continue
+		}
+		if strings.HasPrefix(name, prefix) {
+			matches = append(matches, host+":"+dir+name)
+		}
+	}
+	return matches
+}
+
+// remoteQuote quotes dir for the shell on the remote host, leaving a ~/ at
+// the start of it unquoted so that it's expanded there.
+func remoteQuote(dir string) string {
+	home := ""
+	if strings.HasPrefix(dir, "~/") {
+		home, dir = "~/", dir[2:]
+	}
+	if dir == "" {
+		return home
+	}
+	return home + "'" + strings.Replace(dir, "'", `'\''`, -1) + "'"
+}
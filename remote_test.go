@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIsRemotePath(t *testing.T) {
+	cases := []struct {
+		Path     string
+		Expected bool
+	}{
+		{"host:", true},
+		{"host:foo/bar", true},
+		{"user@host:/tmp", true},
+		{"foo", false},
+		{":foo", false},
+		{"./foo:bar", false},
+		{"/tmp/foo:bar", false},
+		{"-oProxyCommand=touch${IFS}/tmp/x:", false},
+	}
+	for i, tc := range cases {
+		if got := isRemotePath(tc.Path); got != tc.Expected {
+			t.Errorf("Unexpected result for case %d (%v): got %v want %v", i, tc.Path, got, tc.Expected)
+		}
+	}
+}
+
+// fakeSSH creates a directory with an ssh script in it, and puts it at the
+// start of $PATH. It returns a function to undo it.
+func fakeSSH(t *testing.T, script string) func() {
+	dir, err := ioutil.TempDir("", "goshssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ssh"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	oldpath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+oldpath)
+	return func() {
+		os.Setenv("PATH", oldpath)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRemoteSuggestions(t *testing.T) {
+	defer fakeSSH(t, "printf './\\n../\\nfoo1\\nfoo2\\nbar/\\n.hidden\\n'\n")()
+
+	cases := []struct {
+		Base     string
+		Expected []string
+	}{
+		{"host:", []string{"host:foo1", "host:foo2", "host:bar/", "host:.hidden"}},
+		{"host:f", []string{"host:foo1", "host:foo2"}},
+		{"host:b", []string{"host:bar/"}},
+		{"host:dir/foo1", []string{"host:dir/foo1"}},
+		{"host:x", nil},
+	}
+	for i, tc := range cases {
+		got := RemoteSuggestions(tc.Base)
+		if len(got) != len(tc.Expected) {
+			t.Errorf("Unexpected suggestions for case %d: got %v want %v", i, got, tc.Expected)
+			continue
+		}
+		for j := range got {
+			if got[j] != tc.Expected[j] {
+				t.Errorf("Unexpected suggestion %d for case %d: got %v want %v", j, i, got[j], tc.Expected[j])
+			}
+		}
+	}
+
+	oldremote := os.Getenv("COMPLETION_REMOTE")
+	defer os.Setenv("COMPLETION_REMOTE", oldremote)
+	os.Setenv("COMPLETION_REMOTE", "on")
+	psuggestions, _, _ := Command("scp host:b").Suggestions()
+	if len(psuggestions) != 1 || psuggestions[0] != "host:bar/" {
+		t.Errorf("Unexpected suggestions for scp host:b: got %v", psuggestions)
+	}
+}
+
+func TestRemoteSuggestionsArgs(t *testing.T) {
+	argsfile, err := ioutil.TempFile("", "goshsshargs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argsfile.Close()
+	defer os.Remove(argsfile.Name())
+	defer fakeSSH(t, "printf '%s\\n' \"$@\" > "+argsfile.Name()+"\n")()
+
+	cases := []struct {
+		Base     string
+		Expected string
+	}{
+		{"host:", "-o\nBatchMode=yes\n--\nhost\nls\n-1ap\n"},
+		{"host:~/", "-o\nBatchMode=yes\n--\nhost\nls\n-1ap\n~/\n"},
+		{"host:~/My Documents/f", "-o\nBatchMode=yes\n--\nhost\nls\n-1ap\n~/'My Documents/'\n"},
+		{"host:/tmp/it's/", "-o\nBatchMode=yes\n--\nhost\nls\n-1ap\n'/tmp/it'\\''s/'\n"},
+		{"host:a~/", "-o\nBatchMode=yes\n--\nhost\nls\n-1ap\n'a~/'\n"},
+	}
+	for i, tc := range cases {
+		RemoteSuggestions(tc.Base)
+		args, err := ioutil.ReadFile(argsfile.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(args) != tc.Expected {
+			t.Errorf("Unexpected ssh arguments for case %d (%v): got %q want %q", i, tc.Base, args, tc.Expected)
+		}
+	}
+}
+
+func TestRemoteSuggestionsTimeout(t *testing.T) {
+	defer fakeSSH(t, "exec sleep 10\n")()
+	oldtimeout := os.Getenv("COMPLETION_REMOTE_TIMEOUT")
+	defer os.Setenv("COMPLETION_REMOTE_TIMEOUT", oldtimeout)
+	os.Setenv("COMPLETION_REMOTE_TIMEOUT", "100ms")
+
+	start := time.Now()
+	if got := RemoteSuggestions("host:"); got != nil {
+		t.Errorf("Unexpected suggestions from a host that timed out: %v", got)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Remote completion did not time out: took %v", d)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// isLoginShell returns true if a shell started with the arguments args is a
+// login shell.
+func isLoginShell(args []string) bool {
+	return strings.HasPrefix(filepath.Base(args[0]), "-") || (len(args) > 1 && args[1] == "-l")
+}
+
+// startupFiles returns the startup scripts in the home directory home for a
+// shell that's a login shell if login is true, and interactive if
+// interactive is true.
+func startupFiles(home string, login, interactive bool) []string {
+	switch {
+	case login:
+		return []string{filepath.Join(home, ".gosh_profile")}
+	case interactive:
+		return []string{filepath.Join(home, ".goshrc")}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStartupFiles(t *testing.T) {
+	cases := []struct {
+		Args        []string
+		Interactive bool
+		Expected    []string
+	}{
+		{[]string{"gosh"}, true, []string{"/home/gosh/.goshrc"}},
+		{[]string{"gosh"}, false, nil},
+		{[]string{"/bin/gosh", "script.sh"}, false, nil},
+		{[]string{"gosh", "-c", "ls"}, false, nil},
+		{[]string{"-gosh"}, true, []string{"/home/gosh/.gosh_profile"}},
+		{[]string{"gosh", "-l"}, true, []string{"/home/gosh/.gosh_profile"}},
+		{[]string{"gosh", "-l", "-c", "ls"}, false, []string{"/home/gosh/.gosh_profile"}},
+		{[]string{"/bin/gosh", "-x"}, true, []string{"/home/gosh/.goshrc"}},
+	}
+	for i, tc := range cases {
+		got := startupFiles("/home/gosh", isLoginShell(tc.Args), tc.Interactive)
+		if !reflect.DeepEqual(got, tc.Expected) {
+			t.Errorf("Unexpected startup files for case %d (%v): got %v want %v", i, tc.Args, got, tc.Expected)
+		}
+	}
+}
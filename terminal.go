@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"unicode"
+	"unsafe"
+)
+
+// capabilities describes what the shell is able to do with the terminal
+// (if any) that it's running in.
+type capabilities struct {
+	// Interactive is true if a user is typing at a terminal, and should
+	// be prompted for input.
+	Interactive bool
+	// JobControl is true if the terminal can be handed to child process
+	// groups.
+	JobControl bool
+	// LineEditing is true if the terminal should be put into cbreak mode
+	// so that the shell can handle editing and tab completion itself.
+	LineEditing bool
+	// Color is true if escape sequences can be written to standard out.
+	Color bool
+}
+
+// caps are the capabilities of the terminal the shell is running in.
+var caps capabilities
+
+// screen is where the prompt, the echoed command line, and completions are
+// written. It needs to be flushed with flushScreen before anything else
+// writes to the terminal.
+var screen = bufio.NewWriter(os.Stderr)
+
+// wideRunes are the characters which take up two columns on the terminal,
+// from the Wide and Fullwidth East Asian Width properties.
+var wideRunes = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x1100, 0x115f, 1},
+		{0x231a, 0x231b, 1},
+		{0x2329, 0x232a, 1},
+		{0x2e80, 0x303e, 1},
+		{0x3041, 0x33ff, 1},
+		{0x3400, 0x4dbf, 1},
+		{0x4e00, 0x9fff, 1},
+		{0xa000, 0xa4cf, 1},
+		{0xa960, 0xa97f, 1},
+		{0xac00, 0xd7a3, 1},
+		{0xf900, 0xfaff, 1},
+		{0xfe10, 0xfe19, 1},
+		{0xfe30, 0xfe6f, 1},
+		{0xff00, 0xff60, 1},
+		{0xffe0, 0xffe6, 1},
+	},
+	R32: []unicode.Range32{
+		{0x16fe0, 0x16fe4, 1},
+		{0x17000, 0x18aff, 1},
+		{0x1b000, 0x1b2ff, 1},
+		{0x1f300, 0x1f64f, 1},
+		{0x1f680, 0x1f6ff, 1},
+		{0x1f900, 0x1f9ff, 1},
+		{0x1fa70, 0x1faff, 1},
+		{0x20000, 0x2fffd, 1},
+		{0x30000, 0x3fffd, 1},
+	},
+}
+
+// kills is the kill ring for editing the command line.
+var kills killRing
+
+// detectCapabilities determines what the shell is able to do, given the value
+// of $TERM and whether standard in and standard out are terminals.
+func detectCapabilities(termname string, stdin, stdout bool) capabilities {
+	dumb := termname == "" || termname == "dumb"
+	return capabilities{
+		Interactive: stdin,
+		JobControl:  stdin,
+		LineEditing: stdin && stdout && !dumb,
+		Color:       stdout && !dumb,
+	}
+}
+
+// isTerminal returns true if the file descriptor fd refers to a terminal.
+func isTerminal(fd int) bool {
+	var ws winsize
+	_, _, err := syscall.RawSyscall(
+		syscall.SYS_IOCTL,
+		uintptr(fd),
+		uintptr(syscall.TIOCGWINSZ),
+		uintptr(unsafe.Pointer(&ws)),
+	)
+	return err == syscall.Errno(0)
+}
+
+// cbreak puts the terminal into cbreak mode if the shell is doing its own
+// line editing.
+func cbreak() {
+	if terminal != nil && caps.LineEditing {
+		terminal.SetCbreak()
+	}
+}
+
+// restore restores the terminal to the mode that it was in when the shell
+// started.
+func restore() {
+	if terminal != nil {
+		terminal.Restore()
+	}
+}
+
+// setForeground makes pgrp the foreground process group of the terminal.
+// It does nothing if there's no job control.
+func setForeground(pgrp uint32) error {
+	if !caps.JobControl {
+		return nil
+	}
+	_, _, err := syscall.RawSyscall(
+		syscall.SYS_IOCTL,
+		uintptr(0),
+		uintptr(syscall.TIOCSPGRP),
+		uintptr(unsafe.Pointer(&pgrp)),
+	)
+	// RawSyscall returns an int for the error, we need to compare
+	// to syscall.Errno(0) instead of nil
+	if err != syscall.Errno(0) {
+		return err
+	}
+	return nil
+}
+
+// resetTerminal puts the terminal back into the mode that the shell expects,
+// regardless of what the last program that used it left it in.
+func resetTerminal() {
+	restore()
+	cbreak()
+}
+
+// retryRead returns true if err, from reading the terminal, is temporary
+// and the read should be tried again.
+func retryRead(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
+
+// terminalClosed returns true if err, from reading the terminal, means
+// that the terminal has gone away.
+func terminalClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.EIO)
+}
+
+// flushScreen writes anything that's been buffered for the screen.
+func flushScreen() {
+	screen.Flush()
+}
+
+// runeWidth returns the number of columns that r takes up on the terminal.
+func runeWidth(r rune) int {
+	switch {
+	case r == 0 || unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case unicode.Is(wideRunes, r):
+		return 2
+	}
+	return 1
+}
+
+// backspaces returns the backspaces that move the cursor back width columns.
+func backspaces(width int) string {
+	return strings.Repeat("\u0008", width)
+}
+
+// lineStart returns the position of the start of the last line of c, which
+// is the only one that can be edited.
+func lineStart(c Command) int {
+	runes := []rune(string(c))
+	for i := len(runes); i > 0; i-- {
+		if runes[i-1] == '\n' {
+			return i
+		}
+	}
+	return 0
+}
+
+// moveCursor moves the cursor on the screen from the position from in c to
+// the position to, and returns the new position.
+func moveCursor(c Command, from, to int) int {
+	runes := []rune(string(c))
+	if to < from {
+		fmt.Fprintf(screen, "%s", backspaces(displayWidth(string(runes[to:from]))))
+	} else {
+		fmt.Fprintf(screen, "%s", string(runes[from:to]))
+	}
+	return to
+}
+
+// insertRune inserts r into c at the cursor, and returns the new command
+// and cursor.
+func insertRune(c Command, cursor int, r rune) (Command, int) {
+	runes := []rune(string(c))
+	tail := string(runes[cursor:])
+	fmt.Fprintf(screen, "%c%s%s", r, tail, backspaces(displayWidth(tail)))
+	return Command(string(runes[:cursor]) + string(r) + tail), cursor + 1
+}
+
+// deleteBackward erases the rune before the cursor in c, and returns the
+// new command and cursor.
+func deleteBackward(c Command, cursor int) (Command, int) {
+	if cursor <= lineStart(c) {
+		return c, cursor
+	}
+	runes := []rune(string(c))
+	width := runeWidth(runes[cursor-1])
+	tail := string(runes[cursor:])
+	// Draw the rest of the line where it goes now, and erase what was at
+	// the end of it.
+	fmt.Fprintf(screen, "%s%s%s", backspaces(width), tail, strings.Repeat(" ", width))
+	fmt.Fprintf(screen, "%s", backspaces(displayWidth(tail)+width))
+	return Command(string(runes[:cursor-1]) + tail), cursor - 1
+}
+
+// readEscape reads the rest of an escape sequence after the escape from r,
+// and returns it.
+func readEscape(r io.RuneReader) (string, error) {
+	c, _, err := r.ReadRune()
+	if err != nil {
+		return "", err
+	}
+	seq := string(c)
+	if c != '[' && c != 'O' {
+		return seq, nil
+	}
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return seq, err
+		}
+		seq += string(c)
+		// The parameters are digits and punctuation, and the sequence
+		// ends with anything else.
+		if c >= '@' && c <= '~' {
+			return seq, nil
+		}
+	}
+}
+
+// isWordRune returns true if r is part of a word for moving by words.
+func isWordRune(r rune) bool {
+	wordchars, ok := os.LookupEnv("WORDCHARS")
+	if !ok {
+		return !unicode.IsSpace(r)
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(wordchars, r)
+}
+
+// wordBackward returns the position of the start of the word before pos in
+// runes.
+func wordBackward(runes []rune, pos int) int {
+	for pos > 0 && !isWordRune(runes[pos-1]) {
+		pos--
+	}
+	for pos > 0 && isWordRune(runes[pos-1]) {
+		pos--
+	}
+	return pos
+}
+
+// wordForward returns the position of the end of the word after pos in
+// runes.
+func wordForward(runes []rune, pos int) int {
+	for pos < len(runes) && !isWordRune(runes[pos]) {
+		pos++
+	}
+	for pos < len(runes) && isWordRune(runes[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// A lineEdit is an editing command that changes the command c with the
+// cursor at cursor, and returns the new command and cursor.
+type lineEdit func(c Command, cursor int) (Command, int)
+
+// transposeChars swaps the rune before the cursor with the one after it, and
+// moves the cursor forward. At the end of the line, it swaps the two runes
+// before the cursor instead, and at the start of it, it does nothing.
+func transposeChars(c Command, cursor int) (Command, int) {
+	runes := []rune(string(c))
+	if start := lineStart(c); cursor <= start || len(runes)-start < 2 {
+		return c, cursor
+	}
+	if cursor == len(runes) {
+		cursor--
+	}
+	runes[cursor-1], runes[cursor] = runes[cursor], runes[cursor-1]
+	return Command(string(runes)), cursor + 1
+}
+
+// caseWord returns an edit that changes the case of the word after the
+// cursor with change, and moves the cursor to the end of the word.
+func caseWord(change func(word []rune) []rune) lineEdit {
+	return func(c Command, cursor int) (Command, int) {
+		runes := []rune(string(c))
+		end := wordForward(runes, cursor)
+		start := wordBackward(runes, end)
+		if start < cursor {
+			// The cursor is in the middle of the word, so only the part
+			// after it changes.
+			start = cursor
+		}
+		word := change(append([]rune(nil), runes[start:end]...))
+		return Command(string(runes[:start]) + string(word) + string(runes[end:])), end
+	}
+}
+
+var (
+	upcaseWord = caseWord(func(word []rune) []rune {
+		return []rune(strings.ToUpper(string(word)))
+	})
+	downcaseWord = caseWord(func(word []rune) []rune {
+		return []rune(strings.ToLower(string(word)))
+	})
+	capitalizeWord = caseWord(func(word []rune) []rune {
+		for i, r := range word {
+			word[i] = unicode.ToLower(r)
+		}
+		if len(word) > 0 {
+			word[0] = unicode.ToUpper(word[0])
+		}
+		return word
+	})
+)
+
+// applyEdit runs edit on c and draws the change, and returns the new command
+// and cursor.
+func applyEdit(c Command, cursor int, edit lineEdit) (Command, int) {
+	newC, newCursor := edit(c, cursor)
+	old, runes := []rune(string(c)), []rune(string(newC))
+	changed := 0
+	for changed < len(old) && changed < len(runes) && old[changed] == runes[changed] {
+		changed++
+	}
+	moveCursor(c, cursor, changed)
+	tail := string(runes[changed:])
+	extra := displayWidth(string(old[changed:])) - displayWidth(tail)
+	if extra < 0 {
+		extra = 0
+	}
+	fmt.Fprintf(screen, "%s%s", tail, strings.Repeat(" ", extra))
+	fmt.Fprintf(screen, "%s", backspaces(extra+displayWidth(string(runes[newCursor:]))))
+	return newC, newCursor
+}
+
+// killRingSize is the number of kills that the kill ring remembers.
+const killRingSize = 10
+
+// A killAction is an editing command that the kill ring cares about.
+type killAction int
+
+const (
+	noKillAction killAction = iota
+	killAct
+	yankAct
+)
+
+// A killRing is the text killed while editing the command line.
+type killRing struct {
+	// kills are the kills that are remembered, oldest first.
+	kills []string
+	// yanked is the position in kills of what was yanked last.
+	yanked int
+	// last is what the previous editing command was, and current is what
+	// the current one is.
+	last, current killAction
+}
+
+// NextCommand starts a new editing command, which will be neither a kill
+// nor a yank unless it calls Kill or Yank.
+func (k *killRing) NextCommand() {
+	k.last, k.current = k.current, noKillAction
+}
+
+// Kill adds text that was killed to the ring. If the last editing command
+// was also a kill, the text is added to the start of its entry if backward
+// is true, and the end of it otherwise.
+func (k *killRing) Kill(text string, backward bool) {
+	if k.last == killAct && len(k.kills) > 0 {
+		k.current = killAct
+		last := &k.kills[len(k.kills)-1]
+		if backward {
+			*last = text + *last
+		} else {
+			*last += text
+		}
+		return
+	}
+	if text == "" {
+		// There's nothing to accumulate the next kill onto.
+		return
+	}
+	k.current = killAct
+	k.kills = append(k.kills, text)
+	if len(k.kills) > killRingSize {
+		k.kills = k.kills[1:]
+	}
+}
+
+// Yank returns the newest kill, or false if nothing has been killed.
+func (k *killRing) Yank() (string, bool) {
+	if len(k.kills) == 0 {
+		return "", false
+	}
+	k.current = yankAct
+	k.yanked = len(k.kills) - 1
+	return k.kills[k.yanked], true
+}
+
+// YankPop returns the text that was yanked last and the kill before it,
+// which replaces it. It returns false if the last editing command wasn't a
+// yank.
+func (k *killRing) YankPop() (old, new string, ok bool) {
+	if k.last != yankAct || len(k.kills) == 0 {
+		return "", "", false
+	}
+	k.current = yankAct
+	old = k.kills[k.yanked]
+	k.yanked = (k.yanked + len(k.kills) - 1) % len(k.kills)
+	return old, k.kills[k.yanked], true
+}
+
+// killText kills the text between the cursor and to in c, and returns the
+// new command and cursor.
+func killText(c Command, cursor, to int) (Command, int) {
+	from, backward := cursor, to < cursor
+	if backward {
+		from, to = to, cursor
+	}
+	kills.Kill(string([]rune(string(c))[from:to]), backward)
+	return applyEdit(c, cursor, func(c Command, cursor int) (Command, int) {
+		runes := []rune(string(c))
+		return Command(string(runes[:from]) + string(runes[to:])), from
+	})
+}
+
+// yank returns an edit that inserts text at the cursor in place of the
+// replaced runes before it, and moves the cursor to the end of it.
+func yank(text string, replaced int) lineEdit {
+	return func(c Command, cursor int) (Command, int) {
+		runes := []rune(string(c))
+		return Command(string(runes[:cursor-replaced]) + text + string(runes[cursor:])), cursor - replaced + len([]rune(text))
+	}
+}
+
+// replaceLine returns an edit that replaces the whole command with c, and
+// moves the cursor to the end of it.
+func replaceLine(c Command) lineEdit {
+	return func(Command, int) (Command, int) {
+		return c, len([]rune(string(c)))
+	}
+}
+
+// cursorPosition returns the row and column of the screen that the cursor
+// is on after printing a prompt that's prompt columns wide followed by c up
+// to the position cursor, on a terminal that's columns wide. Rows are
+// counted from the one that the prompt is on.
+func cursorPosition(prompt int, c Command, cursor, columns int) (row, col int) {
+	// The prompt can wrap too.
+	row, col = prompt/columns, prompt%columns
+	for _, r := range []rune(string(c))[:cursor] {
+		if r == '\n' {
+			row, col = row+1, 0
+			continue
+		}
+		w := runeWidth(r)
+		if col+w > columns {
+			// A wide rune that doesn't fit at the end of a row goes on
+			// the next one.
+			row, col = row+1, 0
+		}
+		col += w
+		if col >= columns {
+			row, col = row+1, col-columns
+		}
+	}
+	return row, col
+}
+
+// promptWidth returns the number of columns taken up by the last line of the
+// prompt, or false if it can't be known.
+func promptWidth() (int, bool) {
+	p := os.Getenv("PROMPT")
+	if p == "" {
+		return displayWidth("> "), true
+	}
+	if len(p) > 1 && p[0] == '!' {
+		return 0, false
+	}
+	p = expandVariables(expandPromptEscapes(p))
+	return displayWidth(p[strings.LastIndex(p, "\n")+1:]), true
+}
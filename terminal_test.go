@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/term"
+	"github.com/pkg/term/termios"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestDetectCapabilities(t *testing.T) {
+	cases := []struct {
+		Term          string
+		Stdin, Stdout bool
+		Expected      capabilities
+	}{
+		// A normal terminal can do everything.
+		{"xterm", true, true, capabilities{true, true, true, true}},
+
+		// A dumb terminal can still do job control, but nothing fancy.
+		{"dumb", true, true, capabilities{true, true, false, false}},
+		{"", true, true, capabilities{true, true, false, false}},
+
+		// Piped input can't do anything interactive, but can still
+		// colour the output.
+		{"xterm", false, true, capabilities{false, false, false, true}},
+
+		// Piped output can be interactive, but can't edit lines or
+		// colour.
+		{"xterm", true, false, capabilities{true, true, false, false}},
+
+		// No terminal at all.
+		{"xterm", false, false, capabilities{}},
+	}
+	for i, tc := range cases {
+		if got := detectCapabilities(tc.Term, tc.Stdin, tc.Stdout); got != tc.Expected {
+			t.Errorf("Unexpected capabilities for case %d: got %+v want %+v", i, got, tc.Expected)
+		}
+	}
+}
+
+func TestResetTerminal(t *testing.T) {
+	ptm, pts, err := termios.Pty()
+	if err != nil {
+		t.Skipf("Could not open pseudoterminal: %v", err)
+	}
+	defer ptm.Close()
+	defer pts.Close()
+
+	tty, err := term.Open(pts.Name())
+	if err != nil {
+		t.Skipf("Could not open pseudoterminal: %v", err)
+	}
+	defer tty.Close()
+
+	oldterminal, oldcaps := terminal, caps
+	defer func() { terminal, caps = oldterminal, oldcaps }()
+	terminal = tty
+	caps.LineEditing = true
+
+	if err := tty.SetRaw(); err != nil {
+		t.Fatal(err)
+	}
+	resetTerminal()
+
+	var attrs syscall.Termios
+	if _, _, err := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		pts.Fd(),
+		uintptr(syscall.TCGETS),
+		uintptr(unsafe.Pointer(&attrs)),
+	); err != 0 {
+		t.Fatal(err)
+	}
+	if attrs.Lflag&(syscall.ICANON|syscall.ECHO) != 0 {
+		t.Errorf("Terminal not in cbreak mode after reset")
+	}
+	if attrs.Oflag&syscall.OPOST == 0 {
+		t.Errorf("Terminal still in raw mode after reset")
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	cases := []struct {
+		Err           error
+		Retry, Closed bool
+	}{
+		{syscall.EINTR, true, false},
+		{syscall.EAGAIN, true, false},
+		{&os.PathError{Op: "read", Path: "/dev/tty", Err: syscall.EINTR}, true, false},
+		{io.EOF, false, true},
+		{&os.PathError{Op: "read", Path: "/dev/tty", Err: syscall.EIO}, false, true},
+		{syscall.EBADF, false, false},
+	}
+	for i, tc := range cases {
+		if got := retryRead(tc.Err); got != tc.Retry {
+			t.Errorf("Unexpected retry for case %d (%v): got %v want %v", i, tc.Err, got, tc.Retry)
+		}
+		if got := terminalClosed(tc.Err); got != tc.Closed {
+			t.Errorf("Unexpected closed for case %d (%v): got %v want %v", i, tc.Err, got, tc.Closed)
+		}
+	}
+}
+
+func TestScreenFlushedBeforeCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goshscreen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	screenFile, copied := filepath.Join(dir, "screen"), filepath.Join(dir, "copied")
+	f, err := os.Create(screenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	oldscreen, oldprompt, oldcaps := screen, os.Getenv("PROMPT"), caps
+	defer func() {
+		screen = oldscreen
+		os.Setenv("PROMPT", oldprompt)
+		caps = oldcaps
+	}()
+	screen = bufio.NewWriter(f)
+	os.Setenv("PROMPT", "gosh> ")
+	caps.Interactive = true
+
+	PrintPrompt()
+	if got, _ := ioutil.ReadFile(screenFile); string(got) != "\ngosh> " {
+		t.Errorf("Prompt not flushed: got %q", got)
+	}
+
+	// Echo the command without flushing it, and make sure that the
+	// command sees it when it runs.
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	fmt.Fprintf(screen, "cp\n")
+	if err := Command("cp " + screenFile + " " + copied).Run(child); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(copied); string(got) != "\ngosh> cp\n" {
+		t.Errorf("Screen not flushed before command: got %q", got)
+	}
+}
+
+func TestDisplayWidth(t *testing.T) {
+	cases := []struct {
+		S     string
+		Width int
+	}{
+		{"", 0},
+		{"ls -l", 5},
+		{"日本語", 6},
+		{"ｆｕｌｌ", 8},
+		{"한국어", 6},
+		{"e\u0301", 1},
+		{"cafe\u0301 ok", 7},
+		{"a\u200db", 2},
+		{"\U0001F600", 2},
+		{"\033[01;34m日本\033[0m", 4},
+	}
+	for i, tc := range cases {
+		if got := displayWidth(tc.S); got != tc.Width {
+			t.Errorf("Unexpected width for case %d (%q): got %v want %v", i, tc.S, got, tc.Width)
+		}
+	}
+}
+
+func TestWordMovement(t *testing.T) {
+	cases := []struct {
+		Line              string
+		Cursor            int
+		Backward, Forward int
+	}{
+		{"git commit -m foo", 17, 14, 17},
+		{"git commit -m foo", 14, 11, 17},
+		{"git commit -m foo", 12, 11, 13},
+		{"git commit -m foo", 4, 0, 10},
+		{"git commit -m foo", 3, 0, 10},
+		{"git commit -m foo", 0, 0, 3},
+		{"ls   -l  ", 9, 5, 9},
+		{"ls   -l  ", 3, 0, 7},
+		{"echo 日本 x", 7, 5, 9},
+		{"", 0, 0, 0},
+	}
+	for i, tc := range cases {
+		runes := []rune(tc.Line)
+		if got := wordBackward(runes, tc.Cursor); got != tc.Backward {
+			t.Errorf("Unexpected backward position for case %d (%q at %d): got %d want %d", i, tc.Line, tc.Cursor, got, tc.Backward)
+		}
+		if got := wordForward(runes, tc.Cursor); got != tc.Forward {
+			t.Errorf("Unexpected forward position for case %d (%q at %d): got %d want %d", i, tc.Line, tc.Cursor, got, tc.Forward)
+		}
+	}
+}
+
+func TestLineEditing(t *testing.T) {
+	c, cursor := Command("ehlo"), 1
+	c, cursor = insertRune(c, cursor, 'c')
+	if c != "echlo" || cursor != 2 {
+		t.Errorf("Unexpected insert: got %q, %d", c, cursor)
+	}
+	c, cursor = deleteBackward(c, cursor)
+	c, cursor = insertRune(c, cursor+1, 'l')
+	if c != "ehllo" || cursor != 3 {
+		t.Errorf("Unexpected edit: got %q, %d", c, cursor)
+	}
+	c, cursor = deleteBackward(c, 0)
+	if c != "ehllo" || cursor != 0 {
+		t.Errorf("Erased before the start of the line: got %q, %d", c, cursor)
+	}
+	c, cursor = deleteBackward("echo 'a\nb", 8)
+	if c != "echo 'a\nb" || cursor != 8 {
+		t.Errorf("Erased a line that was already entered: got %q, %d", c, cursor)
+	}
+	if start := lineStart("for x\ndo y"); start != 6 {
+		t.Errorf("Unexpected line start: got %d want 6", start)
+	}
+}
+
+func TestReadEscape(t *testing.T) {
+	cases := []struct {
+		Input    string
+		Expected string
+		Rest     string
+	}{
+		{"fls", "f", "ls"},
+		{"b", "b", ""},
+		{"[Dx", "[D", "x"},
+		{"OC", "OC", ""},
+		{"[1;5Cx", "[1;5C", "x"},
+		{"[3~", "[3~", ""},
+	}
+	for i, tc := range cases {
+		r := bufio.NewReader(strings.NewReader(tc.Input))
+		seq, err := readEscape(r)
+		if err != nil || seq != tc.Expected {
+			t.Errorf("Unexpected sequence for case %d: got %q (%v) want %q", i, seq, err, tc.Expected)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != tc.Rest {
+			t.Errorf("Unexpected input left for case %d: got %q want %q", i, rest, tc.Rest)
+		}
+	}
+}
+
+func TestLineEdits(t *testing.T) {
+	cases := []struct {
+		Edit           lineEdit
+		Line           Command
+		Cursor         int
+		Expected       Command
+		ExpectedCursor int
+	}{
+		{transposeChars, "ecoh", 3, "echo", 4},
+		{transposeChars, "ecoh", 4, "echo", 4},
+		{transposeChars, "ehco", 0, "ehco", 0},
+		{transposeChars, "x\nab", 2, "x\nab", 2},
+		{transposeChars, "x\nab", 4, "x\nba", 4},
+		{transposeChars, "a", 1, "a", 1},
+		{upcaseWord, "echo hello world", 4, "echo HELLO world", 10},
+		{upcaseWord, "echo hello world", 7, "echo heLLO world", 10},
+		{upcaseWord, "echo hello", 10, "echo hello", 10},
+		{downcaseWord, "ECHO Hello", 0, "echo Hello", 4},
+		{downcaseWord, "echo ÉCOLE", 5, "echo école", 10},
+		{capitalizeWord, "echo hELLO world", 5, "echo Hello world", 10},
+		{capitalizeWord, "echo hello world", 10, "echo hello World", 16},
+	}
+	for i, tc := range cases {
+		c, cursor := tc.Edit(tc.Line, tc.Cursor)
+		if c != tc.Expected || cursor != tc.ExpectedCursor {
+			t.Errorf("Unexpected edit for case %d: got %q, %d want %q, %d", i, c, cursor, tc.Expected, tc.ExpectedCursor)
+		}
+	}
+}
+
+func TestKillRing(t *testing.T) {
+	var k killRing
+	kill := func(text string, backward bool) {
+		k.NextCommand()
+		k.Kill(text, backward)
+	}
+	yank := func() string {
+		k.NextCommand()
+		text, _ := k.Yank()
+		return text
+	}
+	yankPop := func() string {
+		k.NextCommand()
+		_, text, ok := k.YankPop()
+		if !ok {
+			return "(none)"
+		}
+		return text
+	}
+
+	if _, ok := k.Yank(); ok {
+		t.Errorf("Yanked from an empty kill ring")
+	}
+	kill("world", true)
+	kill("hello ", true)
+	kill("!", false)
+	if got := yank(); got != "hello world!" {
+		t.Errorf("Consecutive kills not accumulated: got %q", got)
+	}
+	kill("foo", false)
+	kill(" bar", false)
+	k.NextCommand()
+	kill("baz", true)
+	if got := k.kills; len(got) != 3 || got[1] != "foo bar" || got[2] != "baz" {
+		t.Errorf("Unexpected kills: got %q", got)
+	}
+
+	if got := yank(); got != "baz" {
+		t.Errorf("Unexpected yank: got %q want %q", got, "baz")
+	}
+	for i, expected := range []string{"foo bar", "hello world!", "baz"} {
+		if got := yankPop(); got != expected {
+			t.Errorf("Unexpected yank-pop %d: got %q want %q", i, got, expected)
+		}
+	}
+	k.NextCommand()
+	if got := yankPop(); got != "(none)" {
+		t.Errorf("Yank-pop allowed after something other than a yank: got %q", got)
+	}
+
+	for i := 0; i < killRingSize+5; i++ {
+		k.NextCommand()
+		kill(strconv.Itoa(i), false)
+	}
+	if len(k.kills) != killRingSize || k.kills[0] != "5" {
+		t.Errorf("Kill ring not limited to %d kills: got %q", killRingSize, k.kills)
+	}
+}
+
+func TestYankPopEdit(t *testing.T) {
+	c, cursor := yank("foo", 0)("echo  bar", 5)
+	if c != "echo foo bar" || cursor != 8 {
+		t.Errorf("Unexpected yank: got %q, %d", c, cursor)
+	}
+	c, cursor = yank("hello", 3)(c, cursor)
+	if c != "echo hello bar" || cursor != 10 {
+		t.Errorf("Unexpected yank-pop: got %q, %d", c, cursor)
+	}
+}
+
+func TestCursorPosition(t *testing.T) {
+	cases := []struct {
+		Prompt   int
+		Cmd      Command
+		Cursor   int
+		Columns  int
+		Row, Col int
+	}{
+		{2, "ls", 2, 80, 0, 4},
+		{2, "ls -l", 2, 80, 0, 4},
+		{2, "", 0, 10, 0, 2},
+		{2, "12345678", 8, 10, 1, 0},
+		{2, "123456789", 9, 10, 1, 1},
+		{2, "12345678901234567", 17, 10, 1, 9},
+		{2, "123456789012345678", 18, 10, 2, 0},
+		{10, "", 0, 10, 1, 0},
+		{2, "echo \\\nfoo", 10, 10, 1, 3},
+		{2, "1234567世", 8, 10, 1, 2},
+		{2, "123456世", 7, 10, 1, 0},
+	}
+	for i, tc := range cases {
+		row, col := cursorPosition(tc.Prompt, tc.Cmd, tc.Cursor, tc.Columns)
+		if row != tc.Row || col != tc.Col {
+			t.Errorf("Unexpected position for case %d (%q): got %d,%d want %d,%d", i, tc.Cmd, row, col, tc.Row, tc.Col)
+		}
+	}
+}
+
+func TestWordChars(t *testing.T) {
+	oldwordchars, set := os.LookupEnv("WORDCHARS")
+	defer func() {
+		if set {
+			os.Setenv("WORDCHARS", oldwordchars)
+		} else {
+			os.Unsetenv("WORDCHARS")
+		}
+	}()
+
+	line := []rune("cd ~/src/gosh-master")
+	cases := []struct {
+		// The value of $WORDCHARS, or "unset" to leave it unset.
+		Wordchars         string
+		Backward, Forward []int
+	}{
+		{"unset", []int{3, 0}, []int{2, 20}},
+		{"", []int{14, 9, 5, 0}, []int{2, 8, 13, 20}},
+		{"/", []int{14, 4, 0}, []int{2, 13, 20}},
+		{"-", []int{9, 5, 0}, []int{2, 8, 20}},
+		{"~/-", []int{3, 0}, []int{2, 20}},
+	}
+	for i, tc := range cases {
+		if tc.Wordchars == "unset" {
+			os.Unsetenv("WORDCHARS")
+		} else {
+			os.Setenv("WORDCHARS", tc.Wordchars)
+		}
+		var backward []int
+		for pos := len(line); pos > 0; {
+			pos = wordBackward(line, pos)
+			backward = append(backward, pos)
+		}
+		var forward []int
+		for pos := 0; pos < len(line); {
+			pos = wordForward(line, pos)
+			forward = append(forward, pos)
+		}
+		if !reflect.DeepEqual(backward, tc.Backward) || !reflect.DeepEqual(forward, tc.Forward) {
+			t.Errorf("Unexpected word boundaries for case %d (%q): got %v %v want %v %v", i, tc.Wordchars, backward, forward, tc.Backward, tc.Forward)
+		}
+	}
+
+	// Ctrl-W only erases the last part of the path.
+	os.Setenv("WORDCHARS", "")
+	c, cursor := killText(Command(line), len(line), wordBackward(line, len(line)))
+	if c != "cd ~/src/gosh-" || cursor != 14 {
+		t.Errorf("Unexpected line after erasing a word: got %q %d", c, cursor)
+	}
+}
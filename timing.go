@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// cpuTimes describes the CPU time used by a command. It's implemented by
+// *os.ProcessState.
+type cpuTimes interface {
+	UserTime() time.Duration
+	SystemTime() time.Duration
+}
+
+// childTimes is the CPU time used by the shell's children.
+type childTimes struct {
+	user, sys time.Duration
+}
+
+func (c childTimes) UserTime() time.Duration   { return c.user }
+func (c childTimes) SystemTime() time.Duration { return c.sys }
+
+// commandTimer measures the time taken by a command.
+type commandTimer struct {
+	start time.Time
+	usage syscall.Rusage
+}
+
+// timeoutGrace is how long a command that took too long gets to exit after
+// being sent SIGTERM, before it's sent SIGKILL.
+var timeoutGrace = 2 * time.Second
+
+// timeoutRetry is how often a command that took too long is checked for a
+// foreground job to signal, if it didn't have one yet.
+var timeoutRetry = 10 * time.Millisecond
+
+// stripTime removes the time prefix from c, and returns whether there was
+// one.
+func (c Command) stripTime() (Command, bool) {
+	s := strings.TrimSpace(string(c))
+	if s == "time" {
+		return "", true
+	}
+	if strings.HasPrefix(s, "time ") || strings.HasPrefix(s, "time\t") {
+		return Command(strings.TrimSpace(s[len("time"):])), true
+	}
+	return c, false
+}
+
+// startTimer starts timing a command.
+func startTimer() *commandTimer {
+	t := &commandTimer{start: time.Now()}
+	syscall.Getrusage(syscall.RUSAGE_CHILDREN, &t.usage)
+	return t
+}
+
+// Stop returns the real time since the timer was started, and the CPU time
+// used by the children that finished since it was started.
+func (t *commandTimer) Stop() (time.Duration, cpuTimes) {
+	real := time.Since(t.start)
+	var usage syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_CHILDREN, &usage)
+	return real, childTimes{
+		user: time.Duration(usage.Utime.Nano() - t.usage.Utime.Nano()),
+		sys:  time.Duration(usage.Stime.Nano() - t.usage.Stime.Nano()),
+	}
+}
+
+// formatTimes formats the real and CPU times taken by a command for the time
+// prefix.
+func formatTimes(real time.Duration, cpu cpuTimes) string {
+	return fmt.Sprintf("\nreal\t%s\nuser\t%s\nsys\t%s\n",
+		formatDuration(real),
+		formatDuration(cpu.UserTime()),
+		formatDuration(cpu.SystemTime()),
+	)
+}
+
+// formatDuration formats d as minutes and seconds, like 1m2.345s.
+func formatDuration(d time.Duration) string {
+	minutes := int(d / time.Minute)
+	seconds := (d % time.Minute).Seconds()
+	return fmt.Sprintf("%dm%.3fs", minutes, seconds)
+}
+
+// Run runs c, waits for it to finish if it's in the foreground, and records
+// how long it took in $GOSH_DURATION.
+func (c Command) Run(child chan os.Signal) error {
+	stmts, err := parseStatements(c)
+	if err != nil {
+		return err
+	}
+	if len(stmts) != 1 || stmts[0].Group != nil || stmts[0].Heredoc != nil {
+		return runStatements(stmts, child)
+	}
+	c = stmts[0].Cmd
+	if timed, ok := c.stripTime(); ok {
+		timer := startTimer()
+		if timed != "" {
+			err = timed.Run(child)
+		}
+		fmt.Fprintf(os.Stderr, "%s", formatTimes(timer.Stop()))
+		return err
+	}
+	if negated, ok := c.negated(); ok {
+		os.Setenv("?", "0")
+		err := negated.Run(child)
+		if status := os.Getenv("?"); status == "0" && err == nil {
+			os.Setenv("?", "1")
+		} else {
+			os.Setenv("?", "0")
+		}
+		return err
+	}
+	if limited, limit, ok, err := c.stripTimeout(); ok {
+		if err != nil {
+			return setBuiltinStatus(err)
+		}
+		return limited.runWithTimeout(limit, child)
+	}
+	start := time.Now()
+	err = c.HandleCmd()
+	if err == ForegroundProcess {
+		Wait(child)
+		err = nil
+	}
+	os.Setenv("GOSH_DURATION", strconv.FormatInt(int64(time.Since(start)/time.Millisecond), 10))
+	return setBuiltinStatus(err)
+}
+
+// parseTimeout returns the duration s, which is a number of seconds or a
+// duration like "100ms".
+func parseTimeout(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil && secs >= 0 {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, builtinError(ErrInvalidArgument, "timeout: %s: invalid duration", s)
+	}
+	return d, nil
+}
+
+// stripTimeout returns the command that c runs with a time limit, and the
+// limit, if c starts with timeout.
+func (c Command) stripTimeout() (Command, time.Duration, bool, error) {
+	spans := c.TokenizePositions()
+	if len(spans) == 0 || spans[0].Token != "timeout" {
+		return c, 0, false, nil
+	}
+	if len(spans) < 3 {
+		return c, 0, true, builtinError(ErrUsage, "Usage: timeout duration command [args...]")
+	}
+	limit, err := parseTimeout(spans[1].Token)
+	if err != nil {
+		return c, 0, true, err
+	}
+	return Command(string([]rune(string(c))[spans[2].Start:])), limit, true, nil
+}
+
+// runWithTimeout runs c, and stops it if it's still running after limit.
+func (c Command) runWithTimeout(limit time.Duration, child chan os.Signal) error {
+	done := make(chan struct{})
+	var timedOut int32
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-time.After(limit):
+		}
+		atomic.StoreInt32(&timedOut, 1)
+		for !signalForeground(syscall.SIGTERM) {
+			select {
+			case <-done:
+				return
+			case <-time.After(timeoutRetry):
+			}
+		}
+		select {
+		case <-done:
+		case <-time.After(timeoutGrace):
+			signalForeground(syscall.SIGKILL)
+		}
+	}()
+	err := c.Run(child)
+	close(done)
+	if atomic.LoadInt32(&timedOut) == 1 {
+		os.Setenv("?", "124")
+	}
+	return err
+}
+
+// signalForeground sends sig to the foreground job, and returns whether
+// there was one.
+func signalForeground(sig syscall.Signal) bool {
+	pg := atomic.LoadUint32(&ForegroundPid)
+	if pg == 0 {
+		return false
+	}
+	syscall.Kill(-int(pg), sig)
+	return true
+}
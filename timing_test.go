@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type fakeProcessState struct {
+	user, sys time.Duration
+}
+
+func (f fakeProcessState) UserTime() time.Duration   { return f.user }
+func (f fakeProcessState) SystemTime() time.Duration { return f.sys }
+
+func TestFormatTimes(t *testing.T) {
+	cases := []struct {
+		Real      time.Duration
+		User, Sys time.Duration
+		Expected  string
+	}{
+		{0, 0, 0, "\nreal\t0m0.000s\nuser\t0m0.000s\nsys\t0m0.000s\n"},
+		{
+			1500 * time.Millisecond, 250 * time.Millisecond, 12 * time.Millisecond,
+			"\nreal\t0m1.500s\nuser\t0m0.250s\nsys\t0m0.012s\n",
+		},
+		{
+			2*time.Minute + 3*time.Second, time.Minute, 61 * time.Second,
+			"\nreal\t2m3.000s\nuser\t1m0.000s\nsys\t1m1.000s\n",
+		},
+	}
+	for i, tc := range cases {
+		if got := formatTimes(tc.Real, fakeProcessState{tc.User, tc.Sys}); got != tc.Expected {
+			t.Errorf("Unexpected times for case %d: got %q want %q", i, got, tc.Expected)
+		}
+	}
+}
+
+func TestStripTime(t *testing.T) {
+	cases := []struct {
+		Cmd      Command
+		Expected Command
+		Timed    bool
+	}{
+		{"time ls -l", "ls -l", true},
+		{"time\tls | wc", "ls | wc", true},
+		{"time", "", true},
+		{"timeout 1 ls", "timeout 1 ls", false},
+		{"ls time", "ls time", false},
+	}
+	for i, tc := range cases {
+		got, timed := tc.Cmd.stripTime()
+		if got != tc.Expected || timed != tc.Timed {
+			t.Errorf("Unexpected result for case %d: got (%q, %v) want (%q, %v)", i, got, timed, tc.Expected, tc.Timed)
+		}
+	}
+}
+
+func TestCommandDuration(t *testing.T) {
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	if err := Command("sleep 0.2").Run(child); err != nil {
+		t.Fatal(err)
+	}
+	ms, err := strconv.Atoi(os.Getenv("GOSH_DURATION"))
+	if err != nil {
+		t.Fatalf("Invalid $GOSH_DURATION %q: %v", os.Getenv("GOSH_DURATION"), err)
+	}
+	if ms < 200 || ms > 5000 {
+		t.Errorf("Implausible duration for sleep 0.2: %vms", ms)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	cases := []struct {
+		Cmd      Command
+		Status   string
+		Duration time.Duration
+	}{
+		{"timeout 0.2 sleep 10", "124", 200 * time.Millisecond},
+		{"timeout 200ms sh -c 'sleep 10'", "124", 200 * time.Millisecond},
+		{"timeout 5s sleep 0.1", "0", 100 * time.Millisecond},
+		{"timeout 5 sh -c 'exit 3'", "3", 0},
+		// The limit runs out before the command has started.
+		{"timeout 0 sleep 10", "124", 0},
+		// A command that ignores SIGTERM gets SIGKILL.
+		{"timeout 0.1 sh -c 'trap \"\" TERM; sleep 10'", "124", 100*time.Millisecond + timeoutGrace},
+	}
+	for i, tc := range cases {
+		start := time.Now()
+		if err := tc.Cmd.Run(child); err != nil {
+			t.Errorf("Unexpected error for case %d: %v", i, err)
+			continue
+		}
+		if elapsed := time.Since(start); elapsed < tc.Duration || elapsed > tc.Duration+3*time.Second {
+			t.Errorf("Unexpected run time for case %d (%v): %v", i, tc.Cmd, elapsed)
+		}
+		if got := os.Getenv("?"); got != tc.Status {
+			t.Errorf("Unexpected status for case %d (%v): got %v want %v", i, tc.Cmd, got, tc.Status)
+		}
+	}
+
+	for i, c := range []Command{"timeout", "timeout 5", "timeout soon ls", "timeout -1s ls"} {
+		if err := c.Run(child); !errors.Is(err, ErrUsage) && !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("Unexpected error for invalid case %d (%v): %v", i, c, err)
+		}
+	}
+}
+
+func TestTimeAnywhere(t *testing.T) {
+	f, err := ioutil.TempFile("", "goshtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	script, err := ioutil.TempFile("", "goshtimescript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(script.Name())
+	if _, err := script.WriteString("time true\n"); err != nil {
+		t.Fatal(err)
+	}
+	script.Close()
+
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+
+	for i, cmd := range []Command{
+		"time true",
+		"true; time true",
+		"{ time true; }",
+		"time",
+		"source " + Command(script.Name()),
+	} {
+		if err := (Command("{ ") + cmd + Command("; } 2> "+f.Name())).Run(child); err != nil {
+			t.Errorf("Unexpected error for case %d (%v): %v", i, cmd, err)
+			continue
+		}
+		if got, _ := ioutil.ReadFile(f.Name()); !strings.HasPrefix(string(got), "\nreal\t") {
+			t.Errorf("Unexpected times for case %d (%v): got %q", i, cmd, got)
+		}
+	}
+}
@@ -1,68 +1,16 @@
 package main
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
 	"unicode"
 )
 
 func (c Command) Tokenize() []string {
 	var parsed []string
-	tokenStart := -1
-	inStringLiteral := false
-	for i, chr := range c {
-		switch chr {
-		case '\'':
-			if inStringLiteral {
-				if i > 0 && c[i-1] == '\\' {
-					// The quote was escaped, so ignore it.
-					continue
-				}
-				inStringLiteral = false
-
-				token := string(c[tokenStart:i])
-
-				// Replace escaped quotes with just a single ' before appending
-				token = strings.Replace(token, `\'`, "'", -1)
-				parsed = append(parsed, token)
-
-				// Now that we've finished, reset the tokenStart for the next token.
-				tokenStart = -1
-			} else {
-				// This is the quote, which means the literal starts at the next
-				// character
-				tokenStart = i + 1
-				inStringLiteral = true
-			}
-		case '|', '<', '>', '&':
-			if inStringLiteral {
-				continue
-			}
-			if tokenStart >= 0 {
-				parsed = append(parsed, string(c[tokenStart:i]))
-			}
-			parsed = append(parsed, string(chr))
-			tokenStart = -1
-		default:
-			if inStringLiteral {
-				continue
-			}
-			if unicode.IsSpace(chr) {
-				if tokenStart == -1 {
-					continue
-				}
-				parsed = append(parsed, string(c[tokenStart:i]))
-				tokenStart = -1
-			} else if tokenStart == -1 {
-				tokenStart = i
-			}
-		}
-	}
-	if tokenStart >= 0 {
-		if inStringLiteral {
-			// Ignore the ' character
-			tokenStart += 1
-		}
-		parsed = append(parsed, string(c[tokenStart:]))
+	for _, span := range c.TokenizePositions() {
+		parsed = append(parsed, span.Token)
 	}
 	return parsed
 }
@@ -74,7 +22,8 @@ func (t Token) IsPipe() bool {
 }
 
 func (t Token) IsSpecial() bool {
-	return t == "<" || t == ">" || t == "|"
+	_, _, redirect := t.Redirection()
+	return t.IsPipe() || redirect
 }
 
 func (t Token) IsStdinRedirect() bool {
@@ -84,3 +33,178 @@ func (t Token) IsStdinRedirect() bool {
 func (t Token) IsStdoutRedirect() bool {
 	return t == ">"
 }
+
+// Redirection returns the file descriptor and operator of a redirection
+// token like "<", "2>" or "3>&", and whether t is one.
+func (t Token) Redirection() (fd int, op string, ok bool) {
+	s := string(t)
+	digits := len(s) - len(strings.TrimLeft(s, "0123456789"))
+	switch op = s[digits:]; op {
+	case "<":
+		fd = 0
+	case ">", ">&", ">|":
+		fd = 1
+	case "<&":
+		fd, op = 0, ">&"
+	case ">>", "&>", "&>>":
+		fd = 1
+	default:
+		return 0, "", false
+	}
+	if digits > 0 {
+		n, err := strconv.Atoi(s[:digits])
+		if err != nil {
+			return 0, "", false
+		}
+		fd = n
+	}
+	return fd, op, true
+}
+
+// SyntaxError returns an error describing an unexpected token t.
+func SyntaxError(t Token) error {
+	return fmt.Errorf("syntax error near unexpected token '%s'", t)
+}
+
+// isFd returns true if s is a file descriptor number.
+func isFd(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// TokenSpan is a token, and where it is in the command that it came from.
+type TokenSpan struct {
+	Token string
+	// Start is the position of the first rune of the token in the
+	// command, and End is the position after its last rune.
+	Start, End int
+}
+
+// TokenizePositions returns the tokens in c along with where they are in it.
+func (c Command) TokenizePositions() []TokenSpan {
+	var parsed []TokenSpan
+	// The token currently being built, and whether we're in one. A token
+	// can be empty if it came from an empty string literal like ''.
+	var token strings.Builder
+	inToken := false
+	// Where the current token started.
+	start := 0
+	// The quotation mark that started the string literal that we're in,
+	// or 0 if we're not in one.
+	var quote rune
+	runes := []rune(string(c))
+	i := 0
+	for ; i < len(runes); i++ {
+		chr := runes[i]
+		if !inToken {
+			start = i
+		}
+		if chr == '$' && quote != '\'' && i+1 < len(runes) && runes[i+1] == '(' {
+			if end, ok := substitutionEnd(runes, i); ok {
+				// The substitution is run when the token is expanded.
+				token.WriteString(string(runes[i : end+1]))
+				inToken = true
+				i = end
+				continue
+			}
+		}
+		switch quote {
+		case '\'':
+			switch {
+			case chr == '\\' && i+1 < len(runes) && runes[i+1] == '\'':
+				// The quote was escaped, so include it and skip over it.
+				token.WriteRune('\'')
+				i++
+			case chr == '\'':
+				quote = 0
+			case chr == '$':
+				// $$ expands to $ when we expand variables.
+				token.WriteString("$$")
+			default:
+				token.WriteRune(chr)
+			}
+			continue
+		case '"':
+			switch {
+			case chr == '\\' && i+1 < len(runes) && strings.ContainsRune("$`\"\\\n", runes[i+1]):
+				i++
+				switch runes[i] {
+				case '$':
+					// $$ expands to $ when we expand variables.
+					token.WriteString("$$")
+				case '\n':
+					// An escaped newline is a line continuation, so it
+					// disappears.
+				default:
+					token.WriteRune(runes[i])
+				}
+			case chr == '"':
+				quote = 0
+			default:
+				token.WriteRune(chr)
+			}
+			continue
+		}
+		switch {
+		case chr == '\'' || chr == '"':
+			quote = chr
+			inToken = true
+		case chr == '|' || chr == '<' || chr == '>' || chr == '&':
+			op := string(chr)
+			opStart := i
+			if (chr == '<' || chr == '>') && inToken && isFd(token.String()) {
+				// The number is the file descriptor being redirected, not
+				// an argument.
+				op = token.String() + op
+				opStart = start
+				token.Reset()
+				inToken = false
+			} else {
+				if inToken {
+					parsed = append(parsed, TokenSpan{token.String(), start, i})
+					token.Reset()
+					inToken = false
+				}
+			}
+			for i+1 < len(runes) && isOperator(strings.TrimLeft(op, "0123456789")+string(runes[i+1])) {
+				op += string(runes[i+1])
+				i++
+			}
+			parsed = append(parsed, TokenSpan{op, opStart, i + 1})
+		case unicode.IsSpace(chr):
+			if inToken {
+				parsed = append(parsed, TokenSpan{token.String(), start, i})
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(chr)
+			inToken = true
+		}
+	}
+	if inToken {
+		parsed = append(parsed, TokenSpan{token.String(), start, i})
+		token.Reset()
+		inToken = false
+	}
+	return parsed
+}
+
+// isOperator returns true if op is a redirection operator that's more than
+// one rune long, without the file descriptor in front of it.
+func isOperator(op string) bool {
+	switch op {
+	case ">&", ">|", "<&":
+		return true
+	case ">>", "&>", "&>>":
+		return true
+	}
+	return false
+}
@@ -15,6 +15,37 @@ func TestTokenization(t *testing.T) {
 		{"git commit -m 'I am message'", []string{"git", "commit", "-m", "I am message"}},
 		{"git commit -m 'I\\'m another message'", []string{"git", "commit", "-m", "I'm another message"}},
 		{"ls|cat", []string{"ls", "|", "cat"}},
+		{"foo'bar'", []string{"foobar"}},
+		{`a"b"c`, []string{"abc"}},
+		{"'x'y'z'", []string{"xyz"}},
+		{"foo'bar baz'qux", []string{"foobar bazqux"}},
+		{`git commit --message="I am message"`, []string{"git", "commit", "--message=I am message"}},
+		{"echo '' x", []string{"echo", "", "x"}},
+		{"echo 'a|b'>c", []string{"echo", "a|b", ">", "c"}},
+		{"cat 3< in", []string{"cat", "3<", "in"}},
+		{"ls 4>out", []string{"ls", "4>", "out"}},
+		{"ls 3>&1", []string{"ls", "3>&", "1"}},
+		{"ls >&2", []string{"ls", ">&", "2"}},
+		// Only a number right before the operator is a file descriptor.
+		{"echo 3 > x", []string{"echo", "3", ">", "x"}},
+		{"echo a3> x", []string{"echo", "a3", ">", "x"}},
+		{"ls >| out", []string{"ls", ">|", "out"}},
+		{"ls 2>|err", []string{"ls", "2>|", "err"}},
+		{"ls > | cat", []string{"ls", ">", "|", "cat"}},
+		{"echo '$(echo hi)' '$HOME'", []string{"echo", "$$(echo hi)", "$$HOME"}},
+		{"x=$(ls | wc -l)", []string{"x=$(ls | wc -l)"}},
+		{`echo "$(echo "a b")"c`, []string{"echo", `$(echo "a b")c`}},
+		{"echo $(echo $(pwd)) b", []string{"echo", "$(echo $(pwd))", "b"}},
+		{"cat <&3", []string{"cat", "<&", "3"}},
+		{"cat 0<&3 4<& 5", []string{"cat", "0<&", "3", "4<&", "5"}},
+		{"ls >& out.log", []string{"ls", ">&", "out.log"}},
+		{"ls <& &", []string{"ls", "<&", "&"}},
+		{"ls >> out.log", []string{"ls", ">>", "out.log"}},
+		{"ls 2>>err.log", []string{"ls", "2>>", "err.log"}},
+		{"ls &> out.log", []string{"ls", "&>", "out.log"}},
+		{"ls &>> out.log", []string{"ls", "&>>", "out.log"}},
+		{"ls&>>out.log &", []string{"ls", "&>>", "out.log", "&"}},
+		{"ls && ls", []string{"ls", "&", "&", "ls"}},
 	}
 	for i, tc := range tests {
 		val := tc.cmd.Tokenize()
@@ -29,6 +60,7 @@ func TestTokenization(t *testing.T) {
 		}
 	}
 }
+
 func TestParseCommands(t *testing.T) {
 	tests := []struct {
 		val      []Token
@@ -37,40 +69,149 @@ func TestParseCommands(t *testing.T) {
 		{
 			[]Token{"ls"},
 			[]ParsedCommand{
-				ParsedCommand{[]string{"ls"}, "", ""},
+				ParsedCommand{[]string{"ls"}, "", "", nil},
 			},
 		},
 		{
 			[]Token{"ls", "|", "cat"},
 			[]ParsedCommand{
-				ParsedCommand{[]string{"ls"}, "", ""},
-				ParsedCommand{[]string{"cat"}, "", ""},
+				ParsedCommand{[]string{"ls"}, "", "", nil},
+				ParsedCommand{[]string{"cat"}, "", "", nil},
 			},
 		},
 		{
 			[]Token{"ls", ">", "cat"},
 			[]ParsedCommand{
-				ParsedCommand{[]string{"ls"}, "", "cat"},
+				ParsedCommand{[]string{"ls"}, "", "cat", nil},
 			},
 		},
 		{
 			[]Token{"ls", "<", "cat"},
 			[]ParsedCommand{
-				ParsedCommand{[]string{"ls"}, "cat", ""},
+				ParsedCommand{[]string{"ls"}, "cat", "", nil},
 			},
 		},
 		{
 			[]Token{"ls", ">", "foo", "<", "bar", "|", "cat", "hello", ">", "x", "|", "tee"},
 			[]ParsedCommand{
-				ParsedCommand{[]string{"ls"}, "bar", "foo"},
-				ParsedCommand{[]string{"cat", "hello"}, "", "x"},
-				ParsedCommand{[]string{"tee"}, "", ""},
+				ParsedCommand{[]string{"ls"}, "bar", "foo", nil},
+				ParsedCommand{[]string{"cat", "hello"}, "", "x", nil},
+				ParsedCommand{[]string{"tee"}, "", "", nil},
+			},
+		},
+		{
+			[]Token{"cat", "3<", "in"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"cat"}, "", "", []Redirect{{3, "<", "in"}}},
+			},
+		},
+		{
+			[]Token{"ls", "4>", "out"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"ls"}, "", "", []Redirect{{4, ">", "out"}}},
+			},
+		},
+		{
+			[]Token{"ls", "3>&", "1"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"ls"}, "", "", []Redirect{{3, ">&", "1"}}},
+			},
+		},
+		{
+			// Explicitly numbering standard in and out is the same as not.
+			[]Token{"cat", "0<", "in", "1>", "out"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"cat"}, "in", "out", nil},
+			},
+		},
+		{
+			// Arguments can come after redirections.
+			[]Token{"cat", "3<", "in", "/dev/fd/3", "-"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"cat", "/dev/fd/3", "-"}, "", "", []Redirect{{3, "<", "in"}}},
+			},
+		},
+		{
+			[]Token{"ls", "2>", "err", ">&", "2", "|", "cat", "3<", "in"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"ls"}, "", "", []Redirect{{2, ">", "err"}, {1, ">&", "2"}}},
+				ParsedCommand{[]string{"cat"}, "", "", []Redirect{{3, "<", "in"}}},
+			},
+		},
+		{
+			[]Token{"cat", "<", "/dev/stdin", ">", "/dev/stderr"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"cat"}, "", "", []Redirect{{0, ">&", "0"}, {1, ">&", "2"}}},
+			},
+		},
+		{
+			[]Token{"cat", "3<", "/dev/fd/0", "2>", "/dev/fd/12"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"cat"}, "", "", []Redirect{{3, ">&", "0"}, {2, ">&", "12"}}},
+			},
+		},
+		{
+			// Other files in /dev are still files.
+			[]Token{"cat", "<", "/dev/null", ">", "/dev/fd/x"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"cat"}, "/dev/null", "/dev/fd/x", nil},
+			},
+		},
+		{
+			[]Token{"ls", ">|", "out", "2>|", "err"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"ls"}, "", "", []Redirect{{1, ">|", "out"}, {2, ">|", "err"}}},
+			},
+		},
+		{
+			[]Token{"ls", ">&", "out.log"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"ls"}, "", "out.log", []Redirect{{2, ">&", "1"}}},
+			},
+		},
+		{
+			[]Token{"ls", ">&", "2"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"ls"}, "", "", []Redirect{{1, ">&", "2"}}},
+			},
+		},
+		{
+			[]Token{"cat", "<&", "3", "4<&", "0"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"cat"}, "", "", []Redirect{{0, ">&", "3"}, {4, ">&", "0"}}},
+			},
+		},
+		{
+			[]Token{"ls", ">>", "out.log"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"ls"}, "", "", []Redirect{{1, ">>", "out.log"}}},
+			},
+		},
+		{
+			[]Token{"ls", "2>>", "err.log"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"ls"}, "", "", []Redirect{{2, ">>", "err.log"}}},
+			},
+		},
+		{
+			[]Token{"cmd", "&>>", "log"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"cmd"}, "", "", []Redirect{{1, ">>", "log"}, {2, ">&", "1"}}},
+			},
+		},
+		{
+			[]Token{"cmd", "&>", "log"},
+			[]ParsedCommand{
+				ParsedCommand{[]string{"cmd"}, "", "log", []Redirect{{2, ">&", "1"}}},
 			},
 		},
 	}
 
 	for i, tc := range tests {
-		val := ParseCommands(tc.val)
+		val, err := ParseCommands(tc.val)
+		if err != nil {
+			t.Fatalf("Unexpected error in test %d: %v", i, err)
+		}
 		if len(val) != len(tc.expected) {
 			t.Fatalf("Unexpected number of ParsedCommands in test %d. Got %v want %v", i, val, tc.expected)
 		}
@@ -81,11 +222,145 @@ func TestParseCommands(t *testing.T) {
 			if val[j].Stdout != tc.expected[j].Stdout {
 				t.Fatalf("Mismatch for test %d Stdout. Got %v want %v", i, val[j].Stdout, tc.expected[j].Stdout)
 			}
+			if len(val[j].Args) != len(tc.expected[j].Args) {
+				t.Fatalf("Mismatch for test %d Args. Got %v want %v", i, val[j].Args, tc.expected[j].Args)
+			}
 			for k, _ := range val[j].Args {
 				if val[j].Args[k] != tc.expected[j].Args[k] {
 					t.Fatalf("Mismatch for test %d. Got %v want %v", i, val[j].Args[k], tc.expected[j].Args[k])
 				}
 			}
+			if len(val[j].Redirects) != len(tc.expected[j].Redirects) {
+				t.Fatalf("Mismatch for test %d Redirects. Got %v want %v", i, val[j].Redirects, tc.expected[j].Redirects)
+			}
+			for k, _ := range val[j].Redirects {
+				if val[j].Redirects[k] != tc.expected[j].Redirects[k] {
+					t.Fatalf("Mismatch for test %d Redirects. Got %v want %v", i, val[j].Redirects[k], tc.expected[j].Redirects[k])
+				}
+			}
+		}
+	}
+}
+
+func TestParseCommandsSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		cmd      Command
+		expected string
+	}{
+		{"| cat", "syntax error near unexpected token '|'"},
+		{"ls ||", "syntax error near unexpected token '|'"},
+		{"ls || cat", "syntax error near unexpected token '|'"},
+		{"ls |", "syntax error near unexpected token 'newline'"},
+		{"ls >", "syntax error near unexpected token 'newline'"},
+		{"ls <", "syntax error near unexpected token 'newline'"},
+		{"ls > | cat", "syntax error near unexpected token '|'"},
+		{"cat < > foo", "syntax error near unexpected token '>'"},
+	}
+	for i, tc := range tests {
+		var tokens []Token
+		for _, t := range tc.cmd.Tokenize() {
+			tokens = append(tokens, Token(t))
+		}
+		_, err := ParseCommands(tokens)
+		if err == nil {
+			t.Errorf("Expected error for test %d (%v), got none", i, tc.cmd)
+			continue
+		}
+		if err.Error() != tc.expected {
+			t.Errorf("Unexpected error for test %d: got %v want %v", i, err, tc.expected)
+		}
+	}
+}
+
+func TestDoubleQuoteEscapes(t *testing.T) {
+	tests := []struct {
+		cmd      Command
+		expected string
+	}{
+		// Characters that can be escaped
+		{`"a\"b"`, `a"b`},
+		{`"a\\b"`, `a\b`},
+		{`"a\$b"`, `a$$b`},
+		{"\"a\\`b\"", "a`b"},
+		{"\"a\\\nb\"", "ab"},
+
+		// Characters that can't be, where the backslash is literal
+		{`"a\nb"`, `a\nb`},
+		{`"a\'b"`, `a\'b`},
+		{`"a\ b"`, `a\ b`},
+
+		// An escaped backslash doesn't escape the next character
+		{`"a\\"b`, `a\b`},
+		{`"a\\\"b"`, `a\"b`},
+	}
+	for i, tc := range tests {
+		val := tc.cmd.Tokenize()
+		if len(val) != 1 {
+			t.Errorf("Unexpected tokens for test %d: got %q want [%q]", i, val, tc.expected)
+			continue
+		}
+		if val[0] != tc.expected {
+			t.Errorf("Unexpected token for test %d: got %q want %q", i, val[0], tc.expected)
+		}
+	}
+}
+
+func TestParseRedirectErrors(t *testing.T) {
+	tests := []struct {
+		cmd      Command
+		expected string
+	}{
+		{"ls 3>", "syntax error near unexpected token 'newline'"},
+		{"ls 2> | cat", "syntax error near unexpected token '|'"},
+		{"ls 2>&foo", "foo: ambiguous redirect"},
+	}
+	for i, tc := range tests {
+		var tokens []Token
+		for _, t := range tc.cmd.Tokenize() {
+			tokens = append(tokens, Token(t))
+		}
+		_, err := ParseCommands(tokens)
+		if err == nil {
+			t.Errorf("Expected error for test %d (%v), got none", i, tc.cmd)
+			continue
+		}
+		if err.Error() != tc.expected {
+			t.Errorf("Unexpected error for test %d: got %v want %v", i, err, tc.expected)
+		}
+	}
+}
+
+func TestTokenizePositions(t *testing.T) {
+	tests := []struct {
+		cmd      Command
+		expected []TokenSpan
+	}{
+		{"ls -l", []TokenSpan{{"ls", 0, 2}, {"-l", 3, 5}}},
+		{"  echo   foo ", []TokenSpan{{"echo", 2, 6}, {"foo", 9, 12}}},
+		{"echo 'a b' c", []TokenSpan{{"echo", 0, 4}, {"a b", 5, 10}, {"c", 11, 12}}},
+		{`echo x"y z"w`, []TokenSpan{{"echo", 0, 4}, {"xy zw", 5, 12}}},
+		{"echo ''", []TokenSpan{{"echo", 0, 4}, {"", 5, 7}}},
+		{"ls|wc", []TokenSpan{{"ls", 0, 2}, {"|", 2, 3}, {"wc", 3, 5}}},
+		{"cat<in>out", []TokenSpan{{"cat", 0, 3}, {"<", 3, 4}, {"in", 4, 6}, {">", 6, 7}, {"out", 7, 10}}},
+		{"ls 2>&1 >|f", []TokenSpan{{"ls", 0, 2}, {"2>&", 3, 6}, {"1", 6, 7}, {">|", 8, 10}, {"f", 10, 11}}},
+		{"echo 'héllo' x", []TokenSpan{{"echo", 0, 4}, {"héllo", 5, 12}, {"x", 13, 14}}},
+		{"echo $(ls | wc)&", []TokenSpan{{"echo", 0, 4}, {"$(ls | wc)", 5, 15}, {"&", 15, 16}}},
+		{"echo 'open", []TokenSpan{{"echo", 0, 4}, {"open", 5, 10}}},
+		{"", nil},
+	}
+	for i, tc := range tests {
+		got := tc.cmd.TokenizePositions()
+		if len(got) != len(tc.expected) {
+			t.Errorf("Unexpected tokens for case %d (%q): got %v want %v", i, tc.cmd, got, tc.expected)
+			continue
+		}
+		runes := []rune(string(tc.cmd))
+		for j, span := range got {
+			if span != tc.expected[j] {
+				t.Errorf("Unexpected token %d for case %d (%q): got %v want %v", j, i, tc.cmd, span, tc.expected[j])
+			} else if span.End > len(runes) || span.Start > span.End {
+				t.Errorf("Invalid span %d for case %d (%q): %v", j, i, tc.cmd, span)
+			}
 		}
 	}
 }
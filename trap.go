@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// traps is the command to run for each trapped signal. The command for EXIT
+// is the trap for signal 0.
+var traps = make(map[syscall.Signal]string)
+
+// trapped is where the trapped signals are sent when they arrive.
+var trapped = make(chan os.Signal, 16)
+
+// Trap implements the trap builtin.
+func Trap(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		listTraps(w)
+		return nil
+	}
+	if args[0] == "-l" {
+		listSignals(w)
+		return nil
+	}
+	if len(args) < 2 {
+		return builtinError(ErrUsage, "Usage: trap [command|-] signal...")
+	}
+	for _, name := range args[1:] {
+		sig, err := trapSignal(name)
+		if err != nil {
+			return err
+		}
+		if args[0] == "-" {
+			resetTrap(sig)
+		} else {
+			setTrap(sig, args[0])
+		}
+	}
+	return nil
+}
+
+// trapSignal returns the signal called name for trap.
+func trapSignal(name string) (syscall.Signal, error) {
+	if strings.ToUpper(name) == "EXIT" {
+		return 0, nil
+	}
+	sig, ok := signalByName(name)
+	if !ok {
+		return 0, builtinError(ErrInvalidArgument, "trap: %s: invalid signal specification", name)
+	}
+	switch sig {
+	case syscall.SIGKILL, syscall.SIGSTOP, syscall.SIGCHLD:
+		return 0, builtinError(ErrInvalidArgument, "trap: %s: can't be trapped", signalName(sig))
+	}
+	return sig, nil
+}
+
+// trapName returns the name of sig, as trap shows it.
+func trapName(sig syscall.Signal) string {
+	if sig == 0 {
+		return "EXIT"
+	}
+	return signalName(sig)
+}
+
+// setTrap runs cmd when sig arrives.
+func setTrap(sig syscall.Signal, cmd string) {
+	traps[sig] = cmd
+	if sig != 0 {
+		signal.Notify(trapped, sig)
+	}
+}
+
+// resetTrap removes the trap for sig.
+func resetTrap(sig syscall.Signal) {
+	delete(traps, sig)
+	if sig == 0 {
+		return
+	}
+	signal.Reset(sig)
+	// These are the signals that we ignore or catch when we start.
+	switch sig {
+	case syscall.SIGINT, syscall.SIGTTOU:
+		signal.Ignore(sig)
+	case syscall.SIGTSTP:
+		signal.Notify(make(chan os.Signal, 1), sig)
+	}
+}
+
+// listTraps prints the traps that are set to w.
+func listTraps(w io.Writer) {
+	var sigs []int
+	for sig := range traps {
+		sigs = append(sigs, int(sig))
+	}
+	sort.Ints(sigs)
+	for _, sig := range sigs {
+		cmd := strings.Replace(traps[syscall.Signal(sig)], "'", `\'`, -1)
+		fmt.Fprintf(w, "trap -- '%s' %s\n", cmd, trapName(syscall.Signal(sig)))
+	}
+}
+
+// listSignals prints the signals that can be trapped to w.
+func listSignals(w io.Writer) {
+	var sigs []int
+	for _, sig := range signals {
+		if _, err := trapSignal(signalName(sig)); err == nil {
+			sigs = append(sigs, int(sig))
+		}
+	}
+	sort.Ints(sigs)
+	for _, sig := range sigs {
+		fmt.Fprintf(w, "%2d) %s\n", sig, signalName(syscall.Signal(sig)))
+	}
+}
+
+// runTraps runs the traps for the signals that have arrived, and returns
+// true if there were any.
+func runTraps() bool {
+	ran := false
+	for {
+		select {
+		case sig := <-trapped:
+			if cmd, ok := traps[sig.(syscall.Signal)]; ok {
+				runTrap(cmd)
+				ran = true
+			}
+		default:
+			return ran
+		}
+	}
+}
+
+// runTrap runs the trap command cmd.
+func runTrap(cmd string) {
+	status := os.Getenv("?")
+	defer os.Setenv("?", status)
+
+	child := make(chan os.Signal, 1)
+	signal.Notify(child, syscall.SIGCHLD)
+	defer signal.Stop(child)
+	if err := Command(cmd).Run(child); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+// runExitTrap runs the trap for EXIT, if there is one.
+func runExitTrap() {
+	if cmd, ok := traps[0]; ok {
+		// The trap might exit, which would run it again.
+		delete(traps, 0)
+		runTrap(cmd)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTrap(t *testing.T) {
+	defer func() {
+		for sig := range traps {
+			resetTrap(sig)
+		}
+	}()
+
+	if err := Trap(nil, []string{"echo interrupted", "INT", "SIGTERM", "15"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Trap(nil, []string{"echo it's done", "EXIT"}); err != nil {
+		t.Fatal(err)
+	}
+	for sig, expected := range map[syscall.Signal]string{
+		syscall.SIGINT:  "echo interrupted",
+		syscall.SIGTERM: "echo interrupted",
+		0:               "echo it's done",
+	} {
+		if got := traps[sig]; got != expected {
+			t.Errorf("Unexpected trap for %v: got %q want %q", sig, got, expected)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := Trap(&out, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := "trap -- 'echo it\\'s done' EXIT\ntrap -- 'echo interrupted' SIGINT\ntrap -- 'echo interrupted' SIGTERM\n"
+	if out.String() != expected {
+		t.Errorf("Unexpected trap listing: got %q want %q", out.String(), expected)
+	}
+
+	out.Reset()
+	if err := Trap(&out, []string{"-l"}); err != nil {
+		t.Fatal(err)
+	}
+	if listing := out.String(); !strings.Contains(listing, " 2) SIGINT\n") || strings.Contains(listing, "SIGKILL") {
+		t.Errorf("Unexpected signal listing: %q", listing)
+	}
+
+	if err := Trap(nil, []string{"-", "INT", "EXIT"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := traps[syscall.SIGINT]; ok {
+		t.Error("Trap for SIGINT was not removed")
+	}
+	if _, ok := traps[0]; ok {
+		t.Error("Trap for EXIT was not removed")
+	}
+	if _, ok := traps[syscall.SIGTERM]; !ok {
+		t.Error("Trap for SIGTERM was removed")
+	}
+
+	for i, args := range [][]string{{"echo"}, {"echo", "NOTASIGNAL"}, {"echo", "KILL"}, {"echo", "SIGCHLD"}} {
+		if err := Trap(nil, args); err == nil {
+			t.Errorf("Expected error for case %d (%v)", i, args)
+		}
+	}
+}
+
+func TestRunTraps(t *testing.T) {
+	defer func() {
+		for sig := range traps {
+			resetTrap(sig)
+		}
+	}()
+	defer os.Unsetenv("GOSHTRAP")
+	os.Setenv("?", "3")
+
+	if err := Trap(nil, []string{"GOSHTRAP=usr1", "USR1"}); err != nil {
+		t.Fatal(err)
+	}
+	if runTraps() {
+		t.Error("Ran a trap before its signal arrived")
+	}
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	for deadline := time.Now().Add(5 * time.Second); !runTraps(); {
+		if time.Now().After(deadline) {
+			t.Fatal("Trap did not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := os.Getenv("GOSHTRAP"); got != "usr1" {
+		t.Errorf("Unexpected value from trap: got %q want %q", got, "usr1")
+	}
+	if status := os.Getenv("?"); status != "3" {
+		t.Errorf("Trap changed $?: got %v want 3", status)
+	}
+
+	if err := Trap(nil, []string{"GOSHTRAP=exit", "EXIT"}); err != nil {
+		t.Fatal(err)
+	}
+	runExitTrap()
+	if got := os.Getenv("GOSHTRAP"); got != "exit" {
+		t.Errorf("Unexpected value from exit trap: got %q want %q", got, "exit")
+	}
+	os.Setenv("GOSHTRAP", "")
+	runExitTrap()
+	if got := os.Getenv("GOSHTRAP"); got != "" {
+		t.Errorf("Exit trap ran twice")
+	}
+}